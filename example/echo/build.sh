@@ -1,5 +1,5 @@
 #!/bin/bash
-pid=$(ps -ef|grep kimenet|grep -v grep|awk '{print $2}')
+pid=$(ps -ef|grep kimenet_echo|grep -v grep|awk '{print $2}')
 echo $pid
 if [[ "$pid" != "" ]];then
   echo "发送信号"
@@ -9,8 +9,8 @@ fi
 HULU_VERSION="0.0.1"
 GIT_COMMIT=$(git rev-parse HEAD)
 
-go build -ldflags "-X main.version=$HULU_VERSION -X main.commit=$GIT_COMMIT" -o kimenet
+go build -ldflags "-X main.version=$HULU_VERSION -X main.commit=$GIT_COMMIT" -o kimenet_echo
 
 mkdir -p output
 
-mv ./kimenet output/
+mv ./kimenet_echo output/
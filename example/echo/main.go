@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/aizsfgk/kimego/kimenet"
+)
+
+var (
+	addr = flag.String("addr", "tcp://0.0.0.0:9192", "listen address, e.g. tcp6://[::]:9192 or unix:///run/echo.sock")
+)
+
+var version string
+var commit string
+
+type echoHandler struct {
+	kimenet.BaseHandler
+}
+
+func (h *echoHandler) OnOpen(conn *kimenet.Connection) {
+	fmt.Println("新建连接成功: ", conn.RemoteAddr())
+}
+
+func (h *echoHandler) OnData(conn *kimenet.Connection) {
+	// 业务逻辑处理: 原样写回
+	_, _ = conn.Write(conn.ReadBuff.Bytes())
+	conn.ReadBuff.Reset()
+}
+
+func (h *echoHandler) OnClose(conn *kimenet.Connection, err error) {
+	fmt.Println("连接关闭: ", conn.RemoteAddr(), err)
+}
+
+func main() {
+	flag.Parse()
+
+	fmt.Printf("echo version: %s, commit: %s\n", version, commit)
+
+	err := kimenet.Serve(*addr, &echoHandler{}, &kimenet.Options{
+		HandleSignal: true,
+	})
+	if err != nil {
+		panic("Serve: " + err.Error())
+	}
+}
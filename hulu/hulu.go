@@ -74,7 +74,7 @@ func main() {
 	log4go.SetLogFormat(log4go.FORMAT_DEFAULT)
 	err = log.Init("hulu", logLevel, *logPath, *stdOut, "midnight", 7)
 	if err != nil {
-		fmt.Println("hulu: err in log.Init(): %s", err.Error())
+		fmt.Printf("hulu: err in log.Init(): %s\n", err.Error())
 		return
 	}
 
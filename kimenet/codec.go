@@ -1,60 +1,267 @@
-package main
+package kimenet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
 )
 
+// GraceInfo 平滑重启时传给子进程的连接信息, fd本身通过SCM_RIGHTS传递
 type GraceInfo struct {
-	Fd int
-	State int
-	ReadBuff []byte
-	WriteBuff []byte
-	idx string
+	Fd          int // 父进程中的fd, 只用于日志
+	State       int
+	ReadBuff    []byte
+	WriteBuff   []byte
+	RemoteAddr  string
+	Outbound    bool
+	SessionType string // Connection.Context的Session类型名, 空表示没有
+	Session     []byte
+
+	// 连接的关闭、读取暂停和写缓冲区水位状态, 含义见Connection
+	Closing       bool
+	HalfClosing   bool
+	WriteShut     bool
+	ReadPaused    bool
+	AboveHigh     bool
+	HighWatermark int
+	LowWatermark  int
+
+	ReadDeadline time.Time // 连接的读超时, 子进程中重新设置
 }
 
-func Encode(conn *Connection) (bt []byte, err error){
+func newGraceInfo(conn *Connection) (gi *GraceInfo, err error) {
+	gi = &GraceInfo{
+		Fd:            conn.Fd,
+		State:         conn.State,
+		ReadBuff:      append([]byte(nil), conn.ReadBuff.Bytes()...),
+		WriteBuff:     append([]byte(nil), conn.WriteBuff.Bytes()...),
+		RemoteAddr:    conn.idx,
+		Outbound:      conn.Outbound,
+		Closing:       conn.closing,
+		HalfClosing:   conn.halfClosing,
+		WriteShut:     conn.writeShut,
+		ReadPaused:    conn.readPaused,
+		AboveHigh:     conn.aboveHigh,
+		HighWatermark: conn.highWatermark,
+		LowWatermark:  conn.lowWatermark,
+		ReadDeadline:  conn.readDeadline,
+	}
+	gi.SessionType, gi.Session, err = marshalSession(conn)
+	return
+}
 
-	gi := GraceInfo{}
-	gi.Fd = conn.Fd
-	gi.State = conn.State
-	gi.ReadBuff = conn.ReadBuff.Bytes()
-	gi.WriteBuff = conn.ReadBuff.Bytes()
-	gi.idx = conn.idx
+// connection 用子进程收到的fd重建连接, 并恢复Session; Codec使用子进程的opts.Codec, SessionDecoder可以用SetCodec修改
+func (gi *GraceInfo) connection(fd int, opts *Options) (conn *Connection, err error) {
+	conn = &Connection{
+		Fd:            fd,
+		State:         gi.State,
+		ReadBuff:      NewRingBuffer(len(gi.ReadBuff)),
+		WriteBuff:     NewRingBuffer(len(gi.WriteBuff)),
+		idx:           gi.RemoteAddr,
+		Outbound:      gi.Outbound,
+		closing:       gi.Closing,
+		halfClosing:   gi.HalfClosing,
+		writeShut:     gi.WriteShut,
+		readPaused:    gi.ReadPaused,
+		aboveHigh:     gi.AboveHigh,
+		highWatermark: gi.HighWatermark,
+		lowWatermark:  gi.LowWatermark,
+		readDeadline:  gi.ReadDeadline,
+	}
+	if opts != nil {
+		conn.codec = opts.Codec
+	}
+	_, _ = conn.ReadBuff.Write(gi.ReadBuff)
+	_, _ = conn.WriteBuff.Write(gi.WriteBuff)
+	err = restoreSession(conn, gi.SessionType, gi.Session)
+	return
+}
+
+// migratable 连接能否交给子进程; 不能迁移的连接留在父进程中, 交接完成后按Shutdown的流程关闭:
+// 还没有完成的Dial、TLS和等待PROXY头部的连接, 配对的连接(两端要在同一个进程中互相暂停/恢复读取),
+// 用SetHandler/SetCodec单独设置过但Context不是Session、子进程无法恢复的连接, 以及Context实现了Migratable并返回false的连接
+func (conn *Connection) migratable() bool {
+	if conn.connecting || conn.tls != nil || conn.pendingOpen || conn.peer != nil {
+		return false
+	}
+	if m, ok := conn.Context.(Migratable); ok && !m.Migratable() {
+		return false
+	}
+	if conn.handler != nil || conn.codecSet {
+		_, ok := conn.Context.(Session)
+		return ok
+	}
+	return true
+}
 
+func Encode(conn *Connection) (bt []byte, err error) {
+	gi, err := newGraceInfo(conn)
+	if err != nil {
+		return
+	}
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
-
 	if err = enc.Encode(gi); err != nil {
 		return
 	}
-
 	bt = buf.Bytes()
 	return
 }
 
 func Decode(bt []byte) (conn *Connection, err error) {
-	var c GraceInfo
-	var buf bytes.Buffer
-	_, err = buf.Write(bt)
-	if err != nil {
-		fmt.Println("buf.Write err: ", err.Error())
+	var gi GraceInfo
+	dec := gob.NewDecoder(bytes.NewReader(bt))
+	if err = dec.Decode(&gi); err != nil {
+		fmt.Println("dec.Decode err: ", err.Error())
 		return
 	}
+	return gi.connection(-1, nil)
+}
 
-	dec := gob.NewDecoder(&buf)
-	if err = dec.Decode(&c); err != nil {
-		fmt.Println("dec.Decode err: ", err.Error())
+// 平滑重启交接协议的版本, 父子进程版本不同时回滚
+const graceVersion = 1
+
+// 交接消息类型, 顺序见grace.go
+const (
+	graceHello    = iota + 1 // 父->子: 版本和监听地址
+	graceListener            // 父->子: 一个监听socket, 携带1个fd
+	graceReady               // 子->父: 子进程就绪检查结果
+	graceConn                // 父->子: 一个连接, 携带1个fd
+	graceEnd                 // 父->子: 传输结束, Count为连接数
+	graceAck                 // 子->父: 收到的连接数
+	graceCommit              // 父->子: 父进程退出, 子进程开始处理
+)
+
+// graceMsg 交接消息, 每个消息gob编码后加4字节长度前缀在unix socket上传输
+type graceMsg struct {
+	Version int
+	Type    int
+	Fds     int // 本消息携带的fd数
+	Network string
+	Addr    string
+	Count   int
+	Err     string
+	Conn    *GraceInfo
+}
+
+const graceMaxFds = 64
+
+// graceChan 父子进程之间的交接通道
+// 流式unix socket上多个消息的数据可能被一次读出, 收到的fd按顺序放进队列, 由消息的Fds字段认领
+type graceChan struct {
+	conn *net.UnixConn
+	buf  []byte
+	fds  []int
+}
+
+func newGraceChan(conn *net.UnixConn) *graceChan {
+	return &graceChan{conn: conn}
+}
+
+func (gc *graceChan) send(msg *graceMsg, fds ...int) (err error) {
+	msg.Version = graceVersion
+	msg.Fds = len(fds)
+
+	var body bytes.Buffer
+	body.Write([]byte{0, 0, 0, 0})
+	if err = gob.NewEncoder(&body).Encode(msg); err != nil {
 		return
 	}
+	b := body.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
 
-	conn = &Connection{
-		Fd:        c.Fd,
-		State:     c.State,
-		ReadBuff:  bytes.NewBuffer(c.ReadBuff),
-		WriteBuff: bytes.NewBuffer(c.WriteBuff),
-		idx:       c.idx,
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	n, _, err := gc.conn.WriteMsgUnix(b, oob, nil)
+	if err != nil {
+		return
+	}
+	if n < len(b) {
+		_, err = gc.conn.Write(b[n:])
 	}
 	return
 }
+
+// recv 读取一个消息和它携带的fd
+func (gc *graceChan) recv() (msg *graceMsg, fds []int, err error) {
+	for {
+		if len(gc.buf) >= 4 {
+			size := int(binary.BigEndian.Uint32(gc.buf))
+			if len(gc.buf) >= 4+size {
+				msg = new(graceMsg)
+				err = gob.NewDecoder(bytes.NewReader(gc.buf[4 : 4+size])).Decode(msg)
+				gc.buf = gc.buf[4+size:]
+				if err != nil {
+					return
+				}
+				if msg.Fds > len(gc.fds) {
+					return nil, nil, fmt.Errorf("grace message %d: want %d fds, got %d", msg.Type, msg.Fds, len(gc.fds))
+				}
+				fds = gc.fds[:msg.Fds:msg.Fds]
+				gc.fds = gc.fds[msg.Fds:]
+				return
+			}
+		}
+
+		b := make([]byte, 64*1024)
+		oob := make([]byte, syscall.CmsgSpace(graceMaxFds*4))
+		n, oobn, _, _, e := gc.conn.ReadMsgUnix(b, oob)
+		if oobn > 0 {
+			scms, pe := syscall.ParseSocketControlMessage(oob[:oobn])
+			if pe != nil {
+				return nil, nil, pe
+			}
+			for i := range scms {
+				if rights, re := syscall.ParseUnixRights(&scms[i]); re == nil {
+					gc.fds = append(gc.fds, rights...)
+				}
+			}
+		}
+		gc.buf = append(gc.buf, b[:n]...)
+		if e != nil {
+			if e == io.EOF && n > 0 {
+				continue
+			}
+			return nil, nil, e
+		}
+	}
+}
+
+// expect 读取一个指定类型的消息, 版本不同或者对方报告错误时返回error
+func (gc *graceChan) expect(typ int) (msg *graceMsg, fds []int, err error) {
+	msg, fds, err = gc.recv()
+	if err != nil {
+		return
+	}
+	if msg.Version != graceVersion {
+		err = fmt.Errorf("grace protocol version %d, want %d", msg.Version, graceVersion)
+	} else if msg.Err != "" {
+		err = fmt.Errorf("grace peer: %s", msg.Err)
+	} else if msg.Type != typ {
+		err = fmt.Errorf("grace message type %d, want %d", msg.Type, typ)
+	}
+	if err != nil {
+		closeFds(fds)
+		return nil, nil, err
+	}
+	return
+}
+
+func (gc *graceChan) close() {
+	closeFds(gc.fds)
+	gc.fds = nil
+	_ = gc.conn.Close()
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		_ = syscall.Close(fd)
+	}
+}
@@ -1,28 +1,225 @@
-package main
-
-import "bytes"
+package kimenet
 
+import (
+	"time"
+)
 
 const (
 	ESTABLISHED = 1
-	CLOSED = 0
+	CLOSED      = 0
 )
 
 type Connection struct {
-	Fd int
-	State int
-	ReadBuff *bytes.Buffer
-	WriteBuff *bytes.Buffer
-	idx string
-}
+	Fd        int
+	State     int
+	ReadBuff  *RingBuffer
+	WriteBuff *RingBuffer
+	idx       string
+
+	// 使用者自定义的连接上下文
+	Context interface{}
+
+	// 是否是通过Dial主动发起的连接
+	Outbound bool
+
+	loop        *EventLoop
+	codec       Codec
+	codecSet    bool // 用SetCodec单独设置过, 不再使用Options.Codec
+	writing     bool // 是否在监听写事件
+	closing     bool // 写缓冲区发送完毕后关闭
+	halfClosing bool // 写缓冲区发送完毕后关闭写方向
+	writeShut   bool // 已经关闭写方向
+
+	readyEvents Event // 在EventLoop就绪队列中等待处理的事件
+
+	handler    Handler // SetHandler设置的Handler, nil时使用Server的Handler
+	handlerGen uint32  // 每次SetHandler加1
+
+	// 写缓冲区水位和读取暂停, 见watermark.go
+	highWatermark int
+	lowWatermark  int
+	aboveHigh     bool        // 写缓冲区超过了高水位还没有回落到低水位
+	readPaused    bool        // 暂停读取, 不监听读事件
+	peer          *Connection // 配对的连接
+
+	tls         *tlsConn // TLS连接的状态, 见tls.go
+	pendingOpen bool     // 还没有回调OnOpen(例如TLS握手中), 关闭时也不回调OnClose
+
+	proxyState  uint8        // PROXY头部的处理状态, 见proxy_protocol.go
+	proxyHeader *ProxyHeader // 连接开头的PROXY头部
+	proxyTimer  *Timer
 
+	admitted bool   // 计入了Server的连接数限制, 关闭时归还
+	limitKey string // 计入单个IP连接数限制时的IP
+
+	connecting   bool      // Dial发起的连接还未完成
+	dialDeadline time.Time // Dial的连接超时时间
+	dialTimer    *Timer
+
+	// 超时控制, 见timeout.go
+	lastActive   time.Time
+	lastWrite    time.Time
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+	readDeadline time.Time // SetReadDeadline设置的时间, 平滑重启摘下连接后用来恢复读超时
+	idleTimer    *Timer
+	readTimer    *Timer
+	writeTimer   *Timer
+
+	// 连接注册表, 见registry.go; 统计只在EventLoop协程中更新
+	id       uint64
+	created  time.Time
+	bytesIn  uint64
+	bytesOut uint64
+	msgsIn   uint64
+	msgsOut  uint64
+}
 
 func NewConnection(fd int, idx string) (conn *Connection, err error) {
 	conn = new(Connection)
 	conn.Fd = fd
 	conn.idx = idx
-	conn.ReadBuff = bytes.NewBuffer(make([]byte, 1024))
-	conn.WriteBuff = bytes.NewBuffer(make([]byte, 1024))
+	conn.ReadBuff = NewRingBuffer(0)
+	conn.WriteBuff = NewRingBuffer(0)
 	conn.State = ESTABLISHED
 	return
 }
+
+// RemoteAddr 对端地址
+func (conn *Connection) RemoteAddr() string {
+	return conn.idx
+}
+
+// Loop 连接所属的EventLoop
+func (conn *Connection) Loop() *EventLoop {
+	return conn.loop
+}
+
+// Write 将数据放入写缓冲区, 由EventLoop在socket可写时发送
+// 只能在EventLoop协程中调用
+func (conn *Connection) Write(b []byte) (n int, err error) {
+	if conn.State != ESTABLISHED || conn.closing || conn.halfClosing {
+		return 0, ErrConnClosed
+	}
+	if conn.tls != nil {
+		return conn.tls.write(b)
+	}
+	n, err = conn.WriteBuff.Write(b)
+	if err != nil {
+		return
+	}
+	err = conn.flush()
+	return
+}
+
+// WriteMessage 用连接的Codec编码msg后放入写缓冲区, 没有设置Codec时同Write
+// 只能在EventLoop协程中调用
+func (conn *Connection) WriteMessage(msg []byte) (err error) {
+	if conn.codec == nil {
+		if _, err = conn.Write(msg); err == nil {
+			conn.msgsOut++
+		}
+		return
+	}
+	if conn.State != ESTABLISHED || conn.closing || conn.halfClosing {
+		return ErrConnClosed
+	}
+	conn.msgsOut++
+	if conn.tls != nil {
+		// 先编码再加密
+		buf := NewRingBuffer(0)
+		defer buf.release()
+		if err = conn.codec.Encode(buf, msg); err != nil {
+			return
+		}
+		_, err = conn.tls.write(buf.Bytes())
+		return
+	}
+	err = conn.codec.Encode(conn.WriteBuff, msg)
+	if err != nil {
+		return
+	}
+	return conn.flush()
+}
+
+// flush 写缓冲区有数据时开始监听写事件
+func (conn *Connection) flush() (err error) {
+	if conn.WriteBuff.Len() > 0 && !conn.connecting {
+		err = conn.loop.enableWrite(conn)
+	}
+	conn.checkHighWatermark()
+	return
+}
+
+// SetHandler 替换这个连接的Handler, 例如HTTP连接升级为WebSocket; nil恢复为Server的Handler
+// 之后的OnData/OnMessage/OnWritable/OnClose以及WatermarkHandler、ShutdownHandler都回调新的Handler, 不回调它的OnOpen
+// 在OnData/OnMessage中切换时, ReadBuff中剩下的数据立即交给新的Handler; 只能在EventLoop协程中调用
+func (conn *Connection) SetHandler(h Handler) {
+	conn.handler = h
+	conn.handlerGen++
+}
+
+// getHandler 连接当前的Handler
+func (conn *Connection) getHandler() Handler {
+	if conn.handler != nil {
+		return conn.handler
+	}
+	return conn.loop.serv.handler
+}
+
+func (conn *Connection) msgHandler() MessageHandler {
+	if conn.handler != nil {
+		mh, _ := conn.handler.(MessageHandler)
+		return mh
+	}
+	return conn.loop.serv.msgHandler
+}
+
+func (conn *Connection) watermarkHandler() WatermarkHandler {
+	if conn.handler != nil {
+		wh, _ := conn.handler.(WatermarkHandler)
+		return wh
+	}
+	return conn.loop.serv.watermarkHandler
+}
+
+// SetCodec 设置连接的帧编解码, 为nil时回调OnData; 只能在EventLoop协程中调用
+// 例如协议协商完成后切换帧格式; 在OnMessage中切换时, ReadBuff中剩下的数据立即按新的Codec处理
+func (conn *Connection) SetCodec(c Codec) {
+	conn.codec = c
+	conn.codecSet = true
+	// 新的Codec分隔符可能不同, 从头查找
+	conn.ReadBuff.scanned = 0
+}
+
+// Close 关闭连接, 写缓冲区中还有数据时等待发送完毕再关闭
+// 只能在EventLoop协程中调用
+func (conn *Connection) Close() (err error) {
+	if conn.State != ESTABLISHED {
+		return
+	}
+	if conn.tls != nil && !conn.closing && !conn.halfClosing {
+		conn.tls.closeNotify()
+	}
+	if conn.WriteBuff.Len() > 0 {
+		conn.closing = true
+		return
+	}
+	return conn.loop.closeConn(conn, nil)
+}
+
+// CloseWrite 写缓冲区中的数据发送完毕后关闭写方向(半关闭), 对端收到EOF; 之后不能再Write,
+// 仍然可以读取对端的数据, 对端关闭后连接关闭; 只能在EventLoop协程中调用
+func (conn *Connection) CloseWrite() (err error) {
+	if conn.State != ESTABLISHED || conn.closing || conn.halfClosing {
+		return
+	}
+	if conn.tls != nil {
+		conn.tls.closeNotify()
+	}
+	conn.halfClosing = true
+	if conn.WriteBuff.Len() > 0 || conn.connecting {
+		return
+	}
+	return conn.loop.shutdownWrite(conn)
+}
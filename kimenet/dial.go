@@ -0,0 +1,83 @@
+package kimenet
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrConnectTimeout = errors.New("kimenet: connect timeout")
+)
+
+// Dial 在本EventLoop上发起非阻塞连接, 可以在任意协程调用
+// addr格式同ParseListenAddr, 支持tcp和unix; timeout<=0时不限制连接时间
+// 连接成功后回调OnOpen, 之后与accept的连接一样回调OnData/OnWritable/OnClose;
+// 连接失败或超时直接回调OnClose, err为对应的错误(超时为ErrConnectTimeout)
+// 返回的连接只能在本EventLoop协程中使用, 连接成功前Write的数据会在连接成功后发送
+func (el *EventLoop) Dial(addr string, timeout time.Duration, ctx interface{}) (conn *Connection, err error) {
+	la, err := ParseListenAddr(addr)
+	if err != nil {
+		return
+	}
+	if la.IsPacket() {
+		return nil, fmt.Errorf("dial %s: packet network is not supported", la.Network)
+	}
+
+	family, sa := la.sockaddr()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	el.serv.applyConnSockopts(fd)
+
+	err = syscall.Connect(fd, sa)
+	if err != nil && err != syscall.EINPROGRESS && err != syscall.EINTR {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("dial %s: %s", la.String(), err.Error())
+	}
+
+	conn, err = NewConnection(fd, la.String())
+	if err != nil {
+		_ = syscall.Close(fd)
+		return
+	}
+	conn.register()
+	conn.Context = ctx
+	conn.Outbound = true
+	conn.connecting = true
+	if timeout > 0 {
+		conn.dialDeadline = time.Now().Add(timeout)
+	}
+
+	el.register(conn)
+	return
+}
+
+// Dial 按负载均衡策略选择一个EventLoop发起连接, 见EventLoop.Dial
+func (srv *Server) Dial(addr string, timeout time.Duration, ctx interface{}) (*Connection, error) {
+	return srv.pickLoop(nil).Dial(addr, timeout, ctx)
+}
+
+// handleConnect 连接中的socket可写或出错, 用SO_ERROR判断连接结果
+func (el *EventLoop) handleConnect(conn *Connection) (err error) {
+	soErr, err := syscall.GetsockoptInt(conn.Fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+	if err == nil && soErr != 0 {
+		err = syscall.Errno(soErr)
+	}
+	if err != nil {
+		return el.closeConn(conn, err)
+	}
+
+	conn.connecting = false
+	conn.dialTimer.Stop()
+	if sa, e := syscall.Getpeername(conn.Fd); e == nil {
+		conn.idx = sockAddrToString(sa)
+	}
+
+	el.initTimeouts(conn)
+	el.callOpen(conn)
+	el.afterOpen(conn)
+	return
+}
@@ -0,0 +1,142 @@
+package kimenet
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type dialHandler struct {
+	BaseHandler
+	opened chan *Connection
+	data   chan string
+	closed chan error
+}
+
+func (h *dialHandler) OnOpen(conn *Connection) {
+	if conn.Outbound {
+		_, _ = conn.Write([]byte(conn.Context.(string)))
+	}
+	h.opened <- conn
+}
+
+func (h *dialHandler) OnData(conn *Connection) {
+	h.data <- conn.ReadBuff.String()
+	conn.ReadBuff.Reset()
+}
+
+func (h *dialHandler) OnClose(conn *Connection, err error) {
+	h.closed <- err
+}
+
+func newDialHandler() *dialHandler {
+	return &dialHandler{
+		opened: make(chan *Connection, 4),
+		data:   make(chan string, 4),
+		closed: make(chan error, 4),
+	}
+}
+
+func TestDial(t *testing.T) {
+	upstream := startTestServer(t, &echoHandler{closed: make(chan error, 4)}, &Options{NumLoops: 1})
+	defer upstream.Stop()
+
+	h := newDialHandler()
+	srv := startTestServer(t, h, &Options{NumLoops: 2})
+	defer srv.Stop()
+
+	if _, err := srv.Dial("tcp://"+upstream.Addr(), time.Second, "ping"); err != nil {
+		t.Fatal("Dial: ", err)
+	}
+
+	select {
+	case conn := <-h.opened:
+		if !conn.Outbound || conn.RemoteAddr() != upstream.Addr() {
+			t.Errorf("unexpected conn: outbound %v, addr %s", conn.Outbound, conn.RemoteAddr())
+		}
+	case err := <-h.closed:
+		t.Fatal("dial failed: ", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOpen not called")
+	}
+
+	select {
+	case s := <-h.data:
+		if s != "ping" {
+			t.Errorf("got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnData not called")
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	// 找一个没有监听的端口
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	h := newDialHandler()
+	srv := startTestServer(t, h, &Options{NumLoops: 1})
+	defer srv.Stop()
+
+	if _, err = srv.Dial(addr, time.Second, "ping"); err != nil {
+		t.Fatal("Dial: ", err)
+	}
+
+	select {
+	case <-h.opened:
+		t.Fatal("OnOpen called on refused connection")
+	case err = <-h.closed:
+		if err != syscall.ECONNREFUSED {
+			t.Errorf("OnClose err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// backlog为0且不accept的监听socket, 队列满后新的SYN会被丢弃, 连接一直处于进行中
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	_ = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	_ = syscall.Listen(fd, 0)
+	sa, _ := syscall.Getsockname(fd)
+	addr := sockAddrToString(sa)
+	for i := 0; i < 3; i++ {
+		go func() {
+			if c, err := net.DialTimeout("tcp", addr, 3*time.Second); err == nil {
+				time.Sleep(3 * time.Second)
+				_ = c.Close()
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	h := newDialHandler()
+	srv := startTestServer(t, h, &Options{NumLoops: 1})
+	defer srv.Stop()
+
+	if _, err = srv.Dial(addr, 200*time.Millisecond, "ping"); err != nil {
+		t.Fatal("Dial: ", err)
+	}
+
+	select {
+	case <-h.opened:
+		t.Skip("connect was not blocked by full backlog")
+	case err = <-h.closed:
+		if err != ErrConnectTimeout {
+			t.Errorf("OnClose err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
@@ -1,23 +1,55 @@
-package main
+package kimenet
 
 import (
 	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 type EventLoop struct {
 	serv *Server
 	EpFd int
+
+	idx        int
+	listenFd   int                 // 本EventLoop负责accept的监听fd或udp socket, 没有时为-1
+	reserveFd  int                 // 预留的fd, 文件描述符用完时释放它来拒绝新连接, 见limit.go
+	packetConn *PacketConn         // 数据报服务时listenFd对应的udp socket
+	conns      map[int]*Connection // 只在本EventLoop协程中访问
+	timers     timerHeap           // 本EventLoop的定时器
+	now        time.Time           // 本轮事件循环开始的时间
+
+	buf         []byte        // 读socket用的缓冲区
+	readBudget  int           // 每个连接每轮最多读取的字节数
+	writeBudget int           // 每个连接每轮最多发送的字节数
+	ready       []*Connection // 没有新事件通知但需要继续处理的连接
+	readyNext   []*Connection
+	connCount   int32 // 连接数, 供负载均衡跨协程读取
+
+	tasks    *taskQueue // 其他协程提交到本EventLoop执行的任务
+	wakeFd   int        // eventfd, 有新任务时唤醒EpollWait
+	notified int32      // 已经写过wakeFd还没被处理
+
+	metrics *loopMetrics // 统计, 见metrics.go
 }
 
 type Event int
 
+const (
+	epollET               = 1 << 31 // EPOLLET, syscall包里定义成了负数
+	defaultReadBufferSize = 64 * 1024
+	defaultIOBudget       = 256 * 1024
+)
+
 const (
 	INVALID_EVNET Event = 0
 	READ_EVENT    Event = 1
 	WRITE_EVNET   Event = 2
-)
 
+	hupEvent Event = 4 // EPOLLERR或EPOLLHUP
+)
 
 func NewEventLoop() (el *EventLoop, err error) {
 	el = new(EventLoop)
@@ -25,6 +57,26 @@ func NewEventLoop() (el *EventLoop, err error) {
 	if err != nil {
 		return
 	}
+	el.tasks = newTaskQueue()
+	el.metrics = newLoopMetrics()
+	el.wakeFd, err = eventfd()
+	if err != nil {
+		_ = syscall.Close(el.EpFd)
+		return
+	}
+	err = el.AddRead(el.wakeFd)
+	if err != nil {
+		_ = syscall.Close(el.wakeFd)
+		_ = syscall.Close(el.EpFd)
+		return
+	}
+	el.conns = make(map[int]*Connection, 1<<5)
+	el.listenFd = -1
+	el.reserveFd = -1
+	el.now = time.Now()
+	el.buf = make([]byte, defaultReadBufferSize)
+	el.readBudget = defaultIOBudget
+	el.writeBudget = defaultIOBudget
 	//syscall.CloseOnExec(el.EpFd)
 	return
 }
@@ -33,33 +85,61 @@ func (el *EventLoop) Poll(callback func(fd int, event Event) error) (err error)
 
 	var (
 		defaultSize = 1024
-		epollEvent []syscall.EpollEvent
-		num int
+		epollEvent  []syscall.EpollEvent
+		num         int
 	)
 
+	// 每个EventLoop独占一个系统线程
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if el.serv.opts.ReusePortCPUSteering && el.idx >= 0 {
+		if e := bindCPU(el.idx % runtime.NumCPU()); e != nil {
+			fmt.Println("bindCPU err: ", e.Error())
+		}
+	}
+
 	for {
-		if el.serv.State == Stop {
+		if el.serv.state() == Stop {
 			fmt.Println("服务器已经停止")
 			return
 		}
 
 		epollEvent = make([]syscall.EpollEvent, defaultSize)
 
-		num, err = syscall.EpollWait(el.EpFd, epollEvent, 1000)
-		if err !=nil && err != syscall.EAGAIN && err != syscall.EINTR {
-			fmt.Println("EpollWait err: ", err.Error())
+		// 最长等待1秒, 以便检查服务器状态; 有定时器时等到最近的定时器到期
+		msec := 0
+		if len(el.ready) == 0 {
+			msec = el.nextTimeout(time.Now(), 1000)
+		}
+
+		num, err = syscall.EpollWait(el.EpFd, epollEvent, msec)
+		if err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+			atomic.AddUint64(&el.metrics.pollErrors, 1)
 			continue
 		}
 
+		el.now = time.Now()
+		if num < 0 {
+			// EINTR时返回-1
+			num = 0
+		}
+		atomic.AddUint64(&el.metrics.wakeups, 1)
+		el.metrics.events.observe(uint64(num))
+
+		if len(el.timers) > 0 {
+			el.runTimers(el.now)
+		}
+
 		//fmt.Println("epollWait return num: ", num)
 		for i := 0; i < num; i++ {
 			fd := int(epollEvent[i].Fd)
 			ev := INVALID_EVNET
-			if (epollEvent[i].Events & syscall.EPOLLIN ) != 0 {
+			if (epollEvent[i].Events & syscall.EPOLLIN) != 0 {
 				ev |= READ_EVENT
 			}
 
-			if (epollEvent[i].Events & syscall.EPOLLRDHUP ) != 0 {
+			if (epollEvent[i].Events & syscall.EPOLLRDHUP) != 0 {
 				ev |= READ_EVENT
 			}
 
@@ -67,16 +147,22 @@ func (el *EventLoop) Poll(callback func(fd int, event Event) error) (err error)
 				ev |= WRITE_EVNET
 			}
 
+			// 出错或挂断时读写都触发, 由读写处理函数发现错误并关闭连接
 			if (epollEvent[i].Events & syscall.EPOLLERR) != 0 {
-				ev |= WRITE_EVNET
+				ev |= READ_EVENT | WRITE_EVNET | hupEvent
 			}
 
-			if (epollEvent[i].Events) & syscall.EPOLLHUP != 0 {
-				ev |= WRITE_EVNET
+			if (epollEvent[i].Events)&syscall.EPOLLHUP != 0 {
+				ev |= READ_EVENT | WRITE_EVNET | hupEvent
 			}
 			err = callback(fd, ev)
 		}
 
+		if len(el.ready) > 0 {
+			el.runReady()
+		}
+		el.metrics.iteration.observe(uint64(time.Since(el.now)))
+
 		if num == defaultSize {
 			defaultSize <<= 1
 		}
@@ -84,11 +170,466 @@ func (el *EventLoop) Poll(callback func(fd int, event Event) error) (err error)
 
 }
 
-func (el EventLoop) CloseFd(fd int) (err error) {
-	return el.Remove(fd)
+// register 把连接移交给本EventLoop, 可以在任意协程调用
+func (el *EventLoop) register(conn *Connection) {
+	conn.loop = el
+	atomic.AddInt32(&el.connCount, 1)
+	el.Execute(func() {
+		if err := el.openConn(conn); err != nil {
+			fmt.Println("openConn err: ", err.Error())
+		}
+	})
+}
+
+// openConn 在本EventLoop协程中把连接加入epoll并回调OnOpen, 主动发起的连接等连接完成后再回调OnOpen
+// 调用前connCount已经加一
+func (el *EventLoop) openConn(conn *Connection) (err error) {
+	if !conn.Outbound {
+		el.serv.applyConnSockopts(conn.Fd)
+	}
+	el.initConn(conn)
+	// 连接中的socket在连接完成(成功或失败)时可写, 触发EPOLLOUT
+	conn.writing = conn.connecting
+	err = el.addEvent(conn.Fd, el.connEvents(conn))
+	if err != nil {
+		atomic.AddInt32(&el.connCount, -1)
+		el.serv.limiter.release(conn)
+		_ = syscall.Close(conn.Fd)
+		conn.State = CLOSED
+		if conn.connecting {
+			el.callClose(el.serv.handler, conn, err)
+		}
+		return
+	}
+	el.conns[conn.Fd] = conn
+	el.serv.trackConn(el, conn)
+
+	if conn.connecting {
+		if !conn.dialDeadline.IsZero() {
+			conn.dialTimer = el.AfterFunc(time.Until(conn.dialDeadline), func() {
+				if conn.connecting {
+					_ = el.closeConn(conn, ErrConnectTimeout)
+				}
+			})
+		}
+		return
+	}
+
+	el.initTimeouts(conn)
+	el.initReadHeaderTimeout(conn)
+	if conn.proxyState == proxyRequired {
+		// 等PROXY头部解析完再TLS握手/回调OnOpen
+		el.startProxy(conn)
+		return
+	}
+	if el.serv.tlsConfig != nil && !conn.Outbound {
+		el.startTLS(conn)
+		return
+	}
+	el.callOpen(conn)
+	return
+}
+
+// initConn 按Options设置连接
+func (el *EventLoop) initConn(conn *Connection) {
+	opts := &el.serv.opts
+	conn.loop = el
+	conn.codec = opts.Codec
+	conn.SetWriteWatermarks(opts.WriteHighWatermark, opts.WriteLowWatermark)
+}
+
+// afterOpen OnOpen回调之后, 根据写缓冲区是否有数据调整写事件
+func (el *EventLoop) afterOpen(conn *Connection) {
+	if conn.State != ESTABLISHED {
+		return
+	}
+	if conn.WriteBuff.Len() == 0 {
+		_ = el.disableWrite(conn)
+		if conn.halfClosing {
+			_ = el.shutdownWrite(conn)
+		}
+	} else if el.serv.opts.EdgeTriggered {
+		// 边缘触发下socket一直可写不会再有EPOLLOUT, 放到就绪队列里发送
+		el.markReady(conn, WRITE_EVNET)
+	}
+}
+
+// addConn 把平滑重启迁移过来的连接直接加入本EventLoop, Codec、水位和读超时已经由GraceInfo恢复
+// 只能在EventLoop未运行或本EventLoop协程中调用
+func (el *EventLoop) addConn(conn *Connection) (err error) {
+	conn.register()
+	conn.loop = el
+	conn.writing = false
+	err = el.addEvent(conn.Fd, el.connEvents(conn))
+	if err != nil {
+		return
+	}
+	el.conns[conn.Fd] = conn
+	el.serv.trackConn(el, conn)
+	atomic.AddInt32(&el.connCount, 1)
+	el.initTimeouts(conn)
+	if !conn.readDeadline.IsZero() {
+		conn.SetReadDeadline(conn.readDeadline)
+	}
+	return
+}
+
+// attachListener 由本EventLoop负责监听fd: tcp/unix上accept新连接, udp上收发数据报
+func (el *EventLoop) attachListener(fd int) (err error) {
+	el.listenFd = fd
+	if el.serv.laddr.IsPacket() {
+		opts := &el.serv.opts
+		el.packetConn = newPacketConn(el, fd, el.serv.packetHandler, opts.PacketBatch, opts.MaxPacketSize)
+	} else if el.reserveFd < 0 {
+		el.reserveFd = openReserveFd()
+	}
+	return el.AddRead(fd)
+}
+
+// ConnCount 本EventLoop上的连接数
+func (el *EventLoop) ConnCount() int {
+	return int(atomic.LoadInt32(&el.connCount))
+}
+
+func (el *EventLoop) handleEvent(fd int, event Event) (err error) {
+	if fd == el.wakeFd {
+		el.runTasks()
+		return
+	}
+
+	if fd == el.listenFd {
+		if pc := el.packetConn; pc != nil {
+			if (event & WRITE_EVNET) != 0 {
+				err = pc.handleWrite()
+			}
+			if (event & READ_EVENT) != 0 {
+				err = pc.handleRead()
+			}
+			return
+		}
+		return el.serv.HandleAccept(el, fd)
+	}
+
+	conn, ok := el.conns[fd]
+	if !ok {
+		return
+	}
+	return el.handleConnEvent(conn, event)
+}
+
+func (el *EventLoop) handleConnEvent(conn *Connection, event Event) (err error) {
+	if conn.connecting {
+		return el.handleConnect(conn)
+	}
+
+	// 暂停读取时只有出错或挂断才读, 以便发现连接关闭
+	if (event&READ_EVENT) != 0 && (!conn.readPaused || (event&hupEvent) != 0) {
+		err = el.read(conn)
+	}
+
+	if (event&WRITE_EVNET) != 0 && conn.State == ESTABLISHED {
+		err = el.write(conn)
+	}
+
+	return
+}
+
+func (el *EventLoop) HandleRead(fd int) (err error) {
+	if conn, ok := el.conns[fd]; ok {
+		err = el.read(conn)
+	}
+	return
+}
+
+func (el *EventLoop) HandleWrite(fd int) (err error) {
+	if conn, ok := el.conns[fd]; ok {
+		err = el.write(conn)
+	}
+	return
+}
+
+// read 用readv读取socket数据到ReadBuff, ReadBuff空间不够的部分先读到el.buf再追加, 然后交给Handler
+// 边缘触发时一直读到EAGAIN; 单次读取超过ReadBudget时先停下, 放到就绪队列下一轮继续读, 避免一个连接饿死其他连接
+func (el *EventLoop) read(conn *Connection) (err error) {
+	var (
+		readN int
+		avail int
+		total int
+		et    = el.serv.opts.EdgeTriggered
+	)
+
+	// TLS连接先读到密文缓冲区
+	rb := conn.ReadBuff
+	if conn.tls != nil {
+		rb = conn.tls.in
+	}
+
+	for {
+		avail = rb.Free() + len(el.buf)
+		readN, err = rb.readFd(conn.Fd, el.buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				err = nil
+				break
+			}
+			if total > 0 {
+				el.countRead(conn, total)
+				el.process(conn)
+			}
+			_ = el.closeConn(conn, err)
+			return
+		}
+
+		if readN == 0 {
+			if total > 0 {
+				el.countRead(conn, total)
+				el.process(conn)
+			}
+			_ = el.closeConn(conn, io.EOF)
+			return
+		}
+
+		total += readN
+
+		if total >= el.readBudget {
+			if et {
+				el.markReady(conn, READ_EVENT)
+			}
+			break
+		}
+		// 水平触发下没读满说明socket缓冲区已经读空, 剩下的数据还会再通知
+		if !et && readN < avail {
+			break
+		}
+	}
+
+	// 业务逻辑处理
+	if total > 0 {
+		el.countRead(conn, total)
+		el.onRead(conn)
+		el.process(conn)
+	}
+	return
+}
+
+// process 处理读到的数据, TLS连接先解密
+func (el *EventLoop) process(conn *Connection) {
+	if conn.proxyState != proxyNone && !el.proxyProcess(conn) {
+		return
+	}
+	if conn.tls != nil {
+		el.tlsProcess(conn)
+		return
+	}
+	el.deliver(conn)
+}
+
+// deliver 把ReadBuff中的数据交给Handler: 连接设置了Codec时逐个解出消息回调OnMessage, 否则回调OnData
+func (el *EventLoop) deliver(conn *Connection) {
+	for first := true; conn.State == ESTABLISHED; first = false {
+		mh := conn.msgHandler()
+		if conn.codec == nil || mh == nil {
+			// OnMessage里取消了Codec或者切换了Handler, 剩下的数据交给OnData
+			if !first && conn.ReadBuff.Len() == 0 {
+				return
+			}
+			gen := conn.handlerGen
+			start := el.handlerStart()
+			conn.getHandler().OnData(conn)
+			el.handlerDone(cbOnData, start)
+			if conn.handlerGen == gen {
+				return
+			}
+			continue
+		}
+		msg, ok, err := conn.codec.Decode(conn.ReadBuff)
+		if err != nil {
+			_ = el.closeConn(conn, err)
+			return
+		}
+		if !ok {
+			return
+		}
+		conn.msgsIn++
+		start := el.handlerStart()
+		mh.OnMessage(conn, msg)
+		el.handlerDone(cbOnMessage, start)
+	}
+}
+
+// write 用writev发送WriteBuff中的数据, 单次发送超过WriteBudget时先停下
+func (el *EventLoop) write(conn *Connection) (err error) {
+	var (
+		writeN int
+		total  int
+	)
+
+	if !conn.writing {
+		return
+	}
+
+	for conn.WriteBuff.Len() > 0 {
+		writeN, err = conn.WriteBuff.writeFd(conn.Fd)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			if err == syscall.EAGAIN {
+				// 等待下一次EPOLLOUT
+				return nil
+			}
+			_ = el.closeConn(conn, err)
+			return
+		}
+
+		total += writeN
+		el.countWrite(conn, writeN)
+		el.onWrite(conn)
+		el.checkLowWatermark(conn)
+
+		if total >= el.writeBudget && conn.WriteBuff.Len() > 0 {
+			if el.serv.opts.EdgeTriggered {
+				el.markReady(conn, WRITE_EVNET)
+			}
+			return
+		}
+	}
+
+	conn.WriteBuff.Reset()
+	_ = el.disableWrite(conn)
+
+	if conn.closing {
+		return el.closeConn(conn, nil)
+	}
+	if conn.halfClosing {
+		return el.shutdownWrite(conn)
+	}
+	start := el.handlerStart()
+	conn.getHandler().OnWritable(conn)
+	el.handlerDone(cbOnWritable, start)
+	return
+}
+
+// connEvents 连接需要监听的事件
+// 边缘触发时读写事件一直注册, 不再用epoll_ctl切换; 暂停读取时不监听读事件
+func (el *EventLoop) connEvents(conn *Connection) (events uint32) {
+	if !conn.readPaused {
+		events = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	}
+	if conn.writing || el.serv.opts.EdgeTriggered {
+		events |= syscall.EPOLLOUT
+	}
+	if el.serv.opts.EdgeTriggered {
+		events |= epollET
+	}
+	return
+}
+
+// enableWrite 写缓冲区有数据时开始监听写事件
+func (el *EventLoop) enableWrite(conn *Connection) (err error) {
+	if conn.writing {
+		return
+	}
+	conn.writing = true
+	conn.lastWrite = el.now
+	el.armWriteTimer(conn)
+	if el.serv.opts.EdgeTriggered {
+		el.markReady(conn, WRITE_EVNET)
+		return
+	}
+	return el.modEvent(conn.Fd, el.connEvents(conn)) // 修改为监听写事件
+}
+
+// disableWrite 写缓冲区发送完毕后不再监听写事件
+func (el *EventLoop) disableWrite(conn *Connection) (err error) {
+	if !conn.writing {
+		return
+	}
+	conn.writing = false
+	conn.writeTimer.Stop()
+	if el.serv.opts.EdgeTriggered {
+		return
+	}
+	return el.modEvent(conn.Fd, el.connEvents(conn))
+}
+
+// shutdownWrite 写缓冲区发送完毕后关闭写方向
+func (el *EventLoop) shutdownWrite(conn *Connection) (err error) {
+	if conn.writeShut {
+		return
+	}
+	conn.writeShut = true
+	err = syscall.Shutdown(conn.Fd, syscall.SHUT_WR)
+	if err != nil {
+		return el.closeConn(conn, err)
+	}
+	return
+}
+
+// markReady 把连接放入就绪队列, 在本轮事件处理完后继续处理, 用于边缘触发下没有新事件通知的情况
+func (el *EventLoop) markReady(conn *Connection, event Event) {
+	if conn.readyEvents == 0 {
+		el.ready = append(el.ready, conn)
+	}
+	conn.readyEvents |= event
+}
+
+func (el *EventLoop) runReady() {
+	ready := el.ready
+	el.ready = el.readyNext[:0]
+	for i, conn := range ready {
+		ready[i] = nil
+		event := conn.readyEvents
+		conn.readyEvents = 0
+		if conn.State == ESTABLISHED {
+			_ = el.handleConnEvent(conn, event)
+		}
+	}
+	el.readyNext = ready[:0]
+}
+
+// closeConn 关闭连接并通知Handler
+func (el *EventLoop) closeConn(conn *Connection, reason error) (err error) {
+	if conn.State == CLOSED {
+		return
+	}
+	conn.State = CLOSED
+	conn.dialTimer.Stop()
+	conn.proxyTimer.Stop()
+	el.stopTimeouts(conn)
+	conn.unpair()
+	el.serv.limiter.release(conn)
+	err = el.CloseFd(conn.Fd)
+	if conn.tls != nil {
+		conn.tls.close()
+	}
+	if !conn.pendingOpen {
+		el.callClose(conn.getHandler(), conn, reason)
+	}
+	conn.ReadBuff.release()
+	conn.WriteBuff.release()
+	return
+}
+
+func (el *EventLoop) CloseFd(fd int) (err error) {
+	err = el.Remove(fd)
+	err = syscall.Close(fd)
+	if conn, ok := el.conns[fd]; ok {
+		el.serv.untrackConn(conn)
+		delete(el.conns, fd)
+		atomic.AddInt32(&el.connCount, -1)
+	}
+	return
 }
 
 func (el *EventLoop) Close() (err error) {
+	if el.reserveFd >= 0 {
+		_ = syscall.Close(el.reserveFd)
+	}
+	_ = syscall.Close(el.wakeFd)
 	err = syscall.Close(el.EpFd)
 	return
 }
@@ -126,7 +667,7 @@ func (el *EventLoop) addEvent(fd int, events uint32) (err error) {
 	return
 }
 
-func  (el *EventLoop) modEvent(fd int, events uint32) (err error) {
+func (el *EventLoop) modEvent(fd int, events uint32) (err error) {
 	err = syscall.EpollCtl(el.EpFd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{
 		Events: events,
 		Fd:     int32(fd),
@@ -134,7 +675,7 @@ func  (el *EventLoop) modEvent(fd int, events uint32) (err error) {
 	return
 }
 
-func  (el *EventLoop) removeEvent(fd int) (err error) {
+func (el *EventLoop) removeEvent(fd int) (err error) {
 	err = syscall.EpollCtl(el.EpFd, syscall.EPOLL_CTL_DEL, fd, nil)
 	return
 }
@@ -0,0 +1,261 @@
+package kimenet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const defaultMaxFrameLength = 16 << 20 // 默认最大消息长度, 16MB
+
+var (
+	ErrFrameTooLarge     = errors.New("kimenet: frame too large")
+	ErrInvalidFrame      = errors.New("kimenet: invalid frame")
+	ErrInvalidFrameCodec = errors.New("kimenet: invalid frame codec")
+)
+
+// Codec 帧编解码, 设置后连接收到的数据按帧解码成消息回调MessageHandler.OnMessage, WriteMessage写出的消息自动编码
+// 同一个Codec被所有连接共享, 实现不能保存连接相关的状态
+type Codec interface {
+	// Decode 从buf中解出一个完整的消息并消费掉对应的数据; 数据不够一个消息时ok为false
+	// 返回的消息可以直接引用buf的底层数组, 只在OnMessage回调中有效; 返回error时关闭连接
+	Decode(buf *RingBuffer) (msg []byte, ok bool, err error)
+
+	// Encode 把msg编码后写入buf
+	Encode(buf *RingBuffer, msg []byte) error
+}
+
+// MessageHandler 设置了Codec的服务器, Handler需要实现它来接收解码后的消息, 此时不再回调OnData
+type MessageHandler interface {
+	OnMessage(conn *Connection, msg []byte)
+}
+
+// LengthFieldCodec 长度字段+消息体的帧格式
+type LengthFieldCodec struct {
+	// 长度字段的字节数: 1/2/4/8, 默认4
+	LengthFieldLength int
+
+	// 长度字段的字节序, 默认大端
+	ByteOrder binary.ByteOrder
+
+	// 长度字段的值加上LengthAdjustment等于消息体长度
+	// 例如长度字段的值包含了长度字段本身时, LengthAdjustment为-LengthFieldLength
+	LengthAdjustment int
+
+	// 消息体最大长度, 超过时关闭连接, 默认16MB
+	MaxFrameLength int
+}
+
+func (c *LengthFieldCodec) params() (size int, order binary.ByteOrder, max int, err error) {
+	size, order, max = c.LengthFieldLength, c.ByteOrder, c.MaxFrameLength
+	if size == 0 {
+		size = 4
+	}
+	switch size {
+	case 1, 2, 4, 8:
+	default:
+		err = ErrInvalidFrameCodec
+		return
+	}
+	if order == nil {
+		order = binary.BigEndian
+	}
+	if max <= 0 {
+		max = defaultMaxFrameLength
+	}
+	return
+}
+
+func (c *LengthFieldCodec) Decode(buf *RingBuffer) (msg []byte, ok bool, err error) {
+	size, order, max, err := c.params()
+	if err != nil {
+		return
+	}
+	if buf.Len() < size {
+		return
+	}
+
+	var header [8]byte
+	head, tail := buf.Peek(size)
+	copy(header[copy(header[:], head):], tail)
+
+	var length uint64
+	switch size {
+	case 1:
+		length = uint64(header[0])
+	case 2:
+		length = uint64(order.Uint16(header[:]))
+	case 4:
+		length = uint64(order.Uint32(header[:]))
+	case 8:
+		length = order.Uint64(header[:])
+	}
+
+	if length > uint64(max)+uint64(abs(c.LengthAdjustment)) {
+		err = ErrFrameTooLarge
+		return
+	}
+	n := int64(length) + int64(c.LengthAdjustment)
+	if n < 0 {
+		err = fmt.Errorf("%w: length field %d", ErrInvalidFrame, length)
+		return
+	}
+	if n > int64(max) {
+		err = ErrFrameTooLarge
+		return
+	}
+	if buf.Len() < size+int(n) {
+		return
+	}
+
+	buf.Discard(size)
+	return buf.Next(int(n)), true, nil
+}
+
+func (c *LengthFieldCodec) Encode(buf *RingBuffer, msg []byte) (err error) {
+	size, order, max, err := c.params()
+	if err != nil {
+		return
+	}
+	if len(msg) > max {
+		return ErrFrameTooLarge
+	}
+
+	length := int64(len(msg)) - int64(c.LengthAdjustment)
+	if length < 0 || size < 8 && uint64(length) >= 1<<(uint(size)*8) {
+		return fmt.Errorf("%w: length %d overflows %d-byte length field", ErrInvalidFrame, length, size)
+	}
+
+	var header [8]byte
+	switch size {
+	case 1:
+		header[0] = byte(length)
+	case 2:
+		order.PutUint16(header[:], uint16(length))
+	case 4:
+		order.PutUint32(header[:], uint32(length))
+	case 8:
+		order.PutUint64(header[:], uint64(length))
+	}
+	_, _ = buf.Write(header[:size])
+	_, _ = buf.Write(msg)
+	return
+}
+
+// DelimiterCodec 以分隔符结尾的帧格式, 解出的消息不包含分隔符
+type DelimiterCodec struct {
+	Delimiter []byte
+
+	// 消息最大长度, 超过时还没有找到分隔符就关闭连接, 默认16MB
+	MaxFrameLength int
+}
+
+func (c *DelimiterCodec) Decode(buf *RingBuffer) (msg []byte, ok bool, err error) {
+	return decodeDelimited(buf, c.Delimiter, c.MaxFrameLength, false)
+}
+
+func (c *DelimiterCodec) Encode(buf *RingBuffer, msg []byte) error {
+	if len(c.Delimiter) == 0 {
+		return ErrInvalidFrameCodec
+	}
+	_, _ = buf.Write(msg)
+	_, _ = buf.Write(c.Delimiter)
+	return nil
+}
+
+// LineCodec 按行分割的文本协议, 解码时兼容\n和\r\n, 解出的消息不包含换行符
+type LineCodec struct {
+	// 编码时以\r\n结尾, 默认\n
+	CRLF bool
+
+	// 一行的最大长度, 默认16MB
+	MaxLineLength int
+}
+
+var lineDelimiter = []byte{'\n'}
+
+func (c *LineCodec) Decode(buf *RingBuffer) (msg []byte, ok bool, err error) {
+	return decodeDelimited(buf, lineDelimiter, c.MaxLineLength, true)
+}
+
+func (c *LineCodec) Encode(buf *RingBuffer, msg []byte) error {
+	_, _ = buf.Write(msg)
+	if c.CRLF {
+		_, _ = buf.WriteString("\r\n")
+	} else {
+		_ = buf.WriteByte('\n')
+	}
+	return nil
+}
+
+func decodeDelimited(buf *RingBuffer, delim []byte, max int, trimCR bool) (msg []byte, ok bool, err error) {
+	if len(delim) == 0 {
+		err = ErrInvalidFrameCodec
+		return
+	}
+	if max <= 0 {
+		max = defaultMaxFrameLength
+	}
+
+	// 从上次查找到的位置继续, 往回退len(delim)-1个字节, 以免漏掉分两次到达的分隔符
+	data := buf.Bytes()
+	from := buf.scanned - len(delim) + 1
+	if from < 0 {
+		from = 0
+	}
+	i := bytes.Index(data[from:], delim)
+	if i < 0 {
+		buf.scanned = len(data)
+		if buf.Len() > max+len(delim) {
+			err = ErrFrameTooLarge
+		}
+		return
+	}
+	i += from
+	buf.scanned = 0
+	if i > max {
+		err = ErrFrameTooLarge
+		return
+	}
+
+	msg = buf.Next(i + len(delim))[:i]
+	if trimCR && i > 0 && msg[i-1] == '\r' {
+		msg = msg[:i-1]
+	}
+	return msg, true, nil
+}
+
+// FixedLengthCodec 固定长度的帧格式
+type FixedLengthCodec struct {
+	Length int
+}
+
+func (c *FixedLengthCodec) Decode(buf *RingBuffer) (msg []byte, ok bool, err error) {
+	if c.Length <= 0 {
+		err = ErrInvalidFrameCodec
+		return
+	}
+	if buf.Len() < c.Length {
+		return
+	}
+	return buf.Next(c.Length), true, nil
+}
+
+func (c *FixedLengthCodec) Encode(buf *RingBuffer, msg []byte) error {
+	if c.Length <= 0 {
+		return ErrInvalidFrameCodec
+	}
+	if len(msg) != c.Length {
+		return fmt.Errorf("%w: message length %d, want %d", ErrInvalidFrame, len(msg), c.Length)
+	}
+	_, _ = buf.Write(msg)
+	return nil
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
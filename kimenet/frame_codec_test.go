@@ -0,0 +1,176 @@
+package kimenet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func decodeAll(t *testing.T, c Codec, buf *RingBuffer) (msgs []string) {
+	for {
+		msg, ok, err := c.Decode(buf)
+		if err != nil {
+			t.Fatal("Decode: ", err)
+		}
+		if !ok {
+			return
+		}
+		msgs = append(msgs, string(msg))
+	}
+}
+
+func TestLengthFieldCodec(t *testing.T) {
+	cases := []*LengthFieldCodec{
+		{},
+		{LengthFieldLength: 1},
+		{LengthFieldLength: 2, ByteOrder: binary.LittleEndian},
+		{LengthFieldLength: 8},
+		{LengthFieldLength: 4, LengthAdjustment: -4},
+	}
+	for _, c := range cases {
+		buf := NewRingBuffer(0)
+		for _, m := range []string{"hello", "", "kimenet"} {
+			if err := c.Encode(buf, []byte(m)); err != nil {
+				t.Fatal("Encode: ", err)
+			}
+		}
+		// 只有部分数据时不能解出消息
+		all := []byte(buf.String())
+		part := NewRingBuffer(0)
+		_, _ = part.Write(all[:3])
+		if msgs := decodeAll(t, c, part); len(msgs) != 0 {
+			t.Fatalf("%+v decode partial: %q", c, msgs)
+		}
+
+		msgs := decodeAll(t, c, buf)
+		if len(msgs) != 3 || msgs[0] != "hello" || msgs[1] != "" || msgs[2] != "kimenet" {
+			t.Fatalf("%+v decode: %q", c, msgs)
+		}
+	}
+
+	// 长度字段包含自身
+	buf := NewRingBuffer(0)
+	_ = (&LengthFieldCodec{LengthAdjustment: -4}).Encode(buf, []byte("ab"))
+	if got := buf.Bytes(); !bytes.Equal(got, []byte{0, 0, 0, 6, 'a', 'b'}) {
+		t.Fatalf("encode with adjustment: %v", got)
+	}
+
+	c := &LengthFieldCodec{LengthFieldLength: 1}
+	if err := c.Encode(buf, make([]byte, 256)); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("encode overflow: %v", err)
+	}
+
+	c = &LengthFieldCodec{MaxFrameLength: 10}
+	buf.Reset()
+	_, _ = buf.Write([]byte{0, 0, 0, 11})
+	if _, _, err := c.Decode(buf); err != ErrFrameTooLarge {
+		t.Fatalf("decode too large: %v", err)
+	}
+
+	c = &LengthFieldCodec{LengthFieldLength: 3}
+	if _, _, err := c.Decode(buf); err != ErrInvalidFrameCodec {
+		t.Fatalf("invalid length field: %v", err)
+	}
+}
+
+func TestDelimiterCodecs(t *testing.T) {
+	buf := NewRingBuffer(0)
+	_, _ = buf.WriteString("GET\r\nPUT\nDEL")
+	lc := &LineCodec{}
+	if msgs := decodeAll(t, lc, buf); len(msgs) != 2 || msgs[0] != "GET" || msgs[1] != "PUT" {
+		t.Fatalf("line decode: %q", msgs)
+	}
+	if buf.String() != "DEL" {
+		t.Fatalf("line rest: %q", buf.String())
+	}
+
+	buf.Reset()
+	_ = (&LineCodec{CRLF: true}).Encode(buf, []byte("OK"))
+	if buf.String() != "OK\r\n" {
+		t.Fatalf("line encode: %q", buf.String())
+	}
+
+	dc := &DelimiterCodec{Delimiter: []byte("$$"), MaxFrameLength: 4}
+	buf.Reset()
+	_ = dc.Encode(buf, []byte("a"))
+	_ = dc.Encode(buf, []byte("bcd"))
+	if msgs := decodeAll(t, dc, buf); len(msgs) != 2 || msgs[0] != "a" || msgs[1] != "bcd" {
+		t.Fatalf("delimiter decode: %q", msgs)
+	}
+	_, _ = buf.WriteString("toolong")
+	if _, _, err := dc.Decode(buf); err != ErrFrameTooLarge {
+		t.Fatalf("delimiter too large: %v", err)
+	}
+
+	// 分隔符分几次到达, 每次只查找新到的数据
+	dc = &DelimiterCodec{Delimiter: []byte("\r\n\r\n")}
+	buf.Reset()
+	for i, s := range []string{"head", "er\r\n", "\r", "\nnext"} {
+		_, _ = buf.WriteString(s)
+		msg, ok, err := dc.Decode(buf)
+		if err != nil || ok != (i == 3) {
+			t.Fatalf("step %d: %q %v %v", i, msg, ok, err)
+		}
+		if ok && string(msg) != "header" {
+			t.Fatalf("split delimiter decode: %q", msg)
+		}
+		if !ok && buf.scanned != buf.Len() {
+			t.Fatalf("step %d scanned %d of %d", i, buf.scanned, buf.Len())
+		}
+	}
+	if buf.String() != "next" || buf.scanned != 0 {
+		t.Fatalf("split delimiter rest: %q %d", buf.String(), buf.scanned)
+	}
+
+	fc := &FixedLengthCodec{Length: 3}
+	buf.Reset()
+	_, _ = buf.WriteString("abcdefg")
+	if msgs := decodeAll(t, fc, buf); len(msgs) != 2 || msgs[0] != "abc" || msgs[1] != "def" {
+		t.Fatalf("fixed decode: %q", msgs)
+	}
+	if err := fc.Encode(buf, []byte("ab")); !errors.Is(err, ErrInvalidFrame) {
+		t.Fatalf("fixed encode: %v", err)
+	}
+}
+
+type msgEchoHandler struct {
+	BaseHandler
+}
+
+func (h *msgEchoHandler) OnMessage(conn *Connection, msg []byte) {
+	_ = conn.WriteMessage(bytes.ToUpper(msg))
+}
+
+func TestServerCodec(t *testing.T) {
+	if _, err := NewServer("127.0.0.1:0", &echoHandler{}, &Options{Codec: &LineCodec{}}); err == nil {
+		t.Fatal("Codec without MessageHandler should fail")
+	}
+
+	srv := startTestServer(t, &msgEchoHandler{}, &Options{NumLoops: 1, Codec: &LengthFieldCodec{LengthFieldLength: 2}})
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 一个消息分两次发送, 再和下一个消息合并发送
+	_, _ = c.Write([]byte{0, 5, 'h', 'e'})
+	time.Sleep(20 * time.Millisecond)
+	_, _ = c.Write([]byte{'l', 'l', 'o', 0, 2, 'o', 'k'})
+
+	want := []byte{0, 5, 'H', 'E', 'L', 'L', 'O', 0, 2, 'O', 'K'}
+	got := make([]byte, len(want))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v", got)
+	}
+}
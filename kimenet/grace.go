@@ -1,16 +1,26 @@
-package main
+package kimenet
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
-	"fmt"
 	"time"
 )
 
-func handleSignal() {
-	sigChan = make(chan os.Signal)
+const (
+	// 父进程通过这个环境变量把交接用的unix socket路径告诉子进程
+	graceSocketEnv      = "KIMENET_GRACE_SOCKET"
+	defaultGraceTimeout = 30 * time.Second
+)
+
+func (srv *Server) handleSignal() {
+	sigChan := make(chan os.Signal, 1)
 
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
 
@@ -19,45 +29,79 @@ func handleSignal() {
 		switch sig {
 		case syscall.SIGHUP:
 			fmt.Println("get SIGHUP")
-			ParentWriteFds()
+			if err := srv.ParentWriteFds(); err != nil {
+				fmt.Println("平滑重启失败: ", err.Error())
+			}
 		case syscall.SIGUSR1:
 			fmt.Println("get SIGUSR1")
-			stop()
+			srv.Stop()
 		default:
 			fmt.Println("未知的信号")
 		}
 	}
 }
 
-func ParentWriteFds() {
-	fmt.Println("parent-server: ", server)
-	server.State = Gracing
-
-	fmt.Println("start grace...")
-	os.Remove(unixSocketFile)
-	fmt.Println("start grace rm file...")
-
+/*
+   平滑重启的交接协议(graceVersion), 父子进程之间用流式unix socket通信, 消息格式见codec.go:
+     1. 父进程停止accept, 监听Options.GraceSocket, 启动子进程, 路径通过环境变量传给子进程
+     2. 父->子 Hello, 之后每个监听socket一个Listener消息; 子进程在NewServer中直接使用这些监听socket
+     3. 子进程Start时执行Options.GraceReadyCheck, 子->父 Ready; 检查失败时父进程回滚
+     4. 父进程把连接从EventLoop上摘下来, 每个连接一个Conn消息(fd、读写缓冲区、对端地址、关闭/暂停状态、Session), 最后End
+        不能迁移的连接见Connection.migratable
+        Session见session.go, 子进程用注册的SessionDecoder恢复Connection.Context, 失败时父进程回滚
+     5. 子->父 Ack(收到的连接数), 父->子 Commit; 子进程接手连接开始处理, 父进程关闭自己的fd,
+        没有交接的连接按Shutdown的流程处理完(最多GraceTimeout)后退出
+   Commit之前任何一步出错或超时(Options.GraceTimeout), 父进程杀掉子进程, 恢复连接和accept继续服务
+   fd在父子进程中指向同一个socket, 交接期间到达的数据和新连接留在内核缓冲区中, 不会丢失
+*/
+
+// ParentWriteFds 启动新的子进程并把监听socket和连接交给它, 成功后父进程停止
+func (srv *Server) ParentWriteFds() (err error) {
+	fmt.Println("parent-server: ", srv)
+	if !atomic.CompareAndSwapInt32(&srv.State, Start, Gracing) {
+		return fmt.Errorf("server is not running")
+	}
+	sdNotifyReloading()
+	srv.pauseListeners()
 
-	unixAddr, err := net.ResolveUnixAddr("unix", unixSocketFile)
+	pid := 0
+	defer func() {
+		if err == nil {
+			return
+		}
+		if pid > 0 {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			go func() {
+				var ws syscall.WaitStatus
+				_, _ = syscall.Wait4(pid, &ws, 0, nil)
+			}()
+		}
+		srv.resumeListeners()
+		atomic.StoreInt32(&srv.State, Start)
+		sdNotify("READY=1")
+	}()
 
-	fmt.Println("ResolveUnixAddr")
-	if err != nil {
-		panic("ResolveUnixAddr: " + err.Error())
+	path := srv.opts.GraceSocket
+	if path == "" {
+		path = filepath.Join(os.TempDir(), fmt.Sprintf("kimenet-grace-%d.sock", os.Getpid()))
 	}
-
-	unixLn, err := net.ListenUnix("unix", unixAddr)
-	fmt.Println("net.ListenUnix")
+	_ = os.Remove(path)
+	unixLn, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
 	if err != nil {
-		panic("ListenUnix: "+err.Error())
+		return fmt.Errorf("ListenUnix: %s", err.Error())
 	}
+	defer func() {
+		_ = unixLn.Close()
+		_ = os.Remove(path)
+	}()
 
 	execSpec := &syscall.ProcAttr{
-		Env:   os.Environ(),
-		Files: append([]uintptr{
+		Env: append(os.Environ(), graceSocketEnv+"="+path),
+		Files: []uintptr{
 			os.Stdin.Fd(),
 			os.Stdout.Fd(),
 			os.Stderr.Fd(),
-		}),
+		},
 	}
 
 	fmt.Println("start fork")
@@ -68,134 +112,335 @@ func ParentWriteFds() {
 		}
 	}
 
-	pid, err := syscall.ForkExec(os.Args[0], append(args, "graceKey"), execSpec)
+	pid, err = syscall.ForkExec(os.Args[0], append(args, "graceKey"), execSpec)
 	if err != nil {
-		fmt.Println("forkExec err: ", err.Error())
-		return
+		return fmt.Errorf("forkExec: %s", err.Error())
 	}
-	fmt.Println("end fork")
+	fmt.Println("end fork, PID: ", pid)
 
-	// Write Conn
-	unixConn, err := unixLn.AcceptUnix() // 阻塞再这里了
+	deadline := time.Now().Add(srv.graceTimeout())
+	_ = unixLn.SetDeadline(deadline)
+	unixConn, err := unixLn.AcceptUnix()
 	if err != nil {
-		panic("acceptUnix: " + err.Error())
+		return fmt.Errorf("acceptUnix: %s", err.Error())
 	}
-	fmt.Println("unixSocket create success!!!")
-
+	_ = unixConn.SetDeadline(deadline)
 
-	var buf []byte
-	fmt.Println("server.len", len(server.Conns))
-	for _, conn := range server.Conns {
-		buf, err = Encode(conn) /// 对数据进行了编码
+	gc := newGraceChan(unixConn)
+	defer gc.close()
+	return srv.handoff(gc)
+}
 
-		if err != nil {
-			fmt.Println("Encode err: ", err.Error())
-			continue
+// handoff 父进程一侧的交接, 出错时已经摘下的连接会恢复到EventLoop上
+func (srv *Server) handoff(gc *graceChan) (err error) {
+	var listenFds []int
+	for _, el := range srv.allLoops() {
+		if el.listenFd >= 0 {
+			listenFds = append(listenFds, el.listenFd)
 		}
-		if len(buf) == 0 {
-			fmt.Println("len(buf) == 0 ")
-			continue
+	}
+	err = gc.send(&graceMsg{Type: graceHello, Network: srv.laddr.Network, Addr: srv.laddr.String(), Count: len(listenFds)})
+	if err != nil {
+		return
+	}
+	for _, fd := range listenFds {
+		if err = gc.send(&graceMsg{Type: graceListener}, fd); err != nil {
+			return
 		}
-		rights := syscall.UnixRights(conn.Fd)
+	}
 
-		// buf 表示 payload
-		// rights 表示带外数据
-		n, oobn, err := unixConn.WriteMsgUnix(buf, rights, nil)
+	if _, _, err = gc.expect(graceReady); err != nil {
+		return
+	}
+
+	// 连接只能在各自的EventLoop协程中访问, 在EventLoop协程中摘下并编码
+	type detached struct {
+		conn *Connection
+		info *GraceInfo
+	}
+	var (
+		mu       sync.Mutex
+		conns    []detached
+		marshalE error
+	)
+	srv.runOnLoops(func(el *EventLoop) {
+		for _, c := range el.conns {
+			if !c.migratable() {
+				continue
+			}
+			info, e := newGraceInfo(c)
+			mu.Lock()
+			if e != nil {
+				// Session编码失败时放弃交接, 这个连接留在EventLoop上
+				if marshalE == nil {
+					marshalE = e
+				}
+			} else {
+				el.detach(c)
+				conns = append(conns, detached{conn: c, info: info})
+			}
+			mu.Unlock()
+		}
+	})
+	defer func() {
 		if err != nil {
-			fmt.Println("oob err: ", err.Error())
-			break
+			for _, gi := range conns {
+				c := gi.conn
+				c.loop.Execute(func() { c.loop.reattach(c) })
+			}
 		}
+	}()
 
-		fmt.Println("n: ", n, "; oobn: ", oobn)
+	if marshalE != nil {
+		err = marshalE
+		_ = gc.send(&graceMsg{Type: graceEnd, Err: err.Error()})
+		return
 	}
 
-	fmt.Println("PID: ", pid)
+	fmt.Println("server.len", len(conns))
+	for _, c := range conns {
+		if err = gc.send(&graceMsg{Type: graceConn, Conn: c.info}, c.conn.Fd); err != nil {
+			return
+		}
+	}
+	if err = gc.send(&graceMsg{Type: graceEnd, Count: len(conns)}); err != nil {
+		return
+	}
+
+	ack, _, err := gc.expect(graceAck)
+	if err != nil {
+		return
+	}
+	if ack.Count != len(conns) {
+		return fmt.Errorf("child received %d conns, want %d", ack.Count, len(conns))
+	}
+	if err = gc.send(&graceMsg{Type: graceCommit}); err != nil {
+		return
+	}
+
+	// 连接已经交给子进程, 只关闭父进程中的fd, 不影响连接本身
+	for _, c := range conns {
+		_ = syscall.Close(c.conn.Fd)
+	}
+	fmt.Println("平滑重启完成, ", len(conns), "个连接交给子进程")
+
+	// 留在父进程中的连接回调OnShutdown或者半关闭, 等它们关闭后父进程退出
+	ctx, cancel := context.WithTimeout(context.Background(), srv.graceTimeout())
+	defer cancel()
+	_, _ = srv.Shutdown(ctx)
+	return
 }
 
-/*
-    平滑重启的两种方式：
-    <1>
-      1. acceptFd = accept(), 返回的fd设置 close-on-exec 标识
-      2. 使用unixSocket建立通道，将文件描述符，传递给子进程；这时候fd改变，但文件控制权不变; 事件重做
-    <2>
-      1. acceptFd = accept(), 返回的fd 不设置 close-on-exec 标识
-      2. 这时候继承了父进程FD; 如何把Context和Session也继承过来???
+// pauseListeners 交接期间不再accept, 新连接留在监听socket的队列中
+func (srv *Server) pauseListeners() {
+	srv.runOnAllLoops(func(el *EventLoop) {
+		if el.listenFd >= 0 {
+			_ = el.Remove(el.listenFd)
+		}
+	})
+}
 
+func (srv *Server) resumeListeners() {
+	srv.runOnAllLoops(func(el *EventLoop) {
+		if el.listenFd >= 0 {
+			_ = el.AddRead(el.listenFd)
+		}
+	})
+}
 
- */
+func (srv *Server) graceTimeout() time.Duration {
+	if srv.opts.GraceTimeout > 0 {
+		return srv.opts.GraceTimeout
+	}
+	return defaultGraceTimeout
+}
+
+// detach 把连接从本EventLoop上摘下来但不关闭fd, 也不回调OnClose
+// 定时器都停止, 读超时的时间保留在readDeadline中, 交接失败时reattach重新设置
+func (el *EventLoop) detach(conn *Connection) {
+	_ = el.Remove(conn.Fd)
+	el.serv.untrackConn(conn)
+	delete(el.conns, conn.Fd)
+	atomic.AddInt32(&el.connCount, -1)
+	el.stopTimeouts(conn)
+	// 在就绪队列中的连接不会再被处理
+	conn.State = CLOSED
+}
 
-func ChildReceiveFds() {
+// reattach 交接失败时把摘下的连接恢复到本EventLoop上
+func (el *EventLoop) reattach(conn *Connection) {
+	conn.State = ESTABLISHED
+	if err := el.addEvent(conn.Fd, el.connEvents(conn)); err != nil {
+		conn.State = CLOSED
+		el.serv.limiter.release(conn)
+		_ = syscall.Close(conn.Fd)
+		el.callClose(conn.getHandler(), conn, err)
+		return
+	}
+	el.conns[conn.Fd] = conn
+	el.serv.trackConn(el, conn)
+	atomic.AddInt32(&el.connCount, 1)
+	el.initTimeouts(conn)
+	if !conn.readDeadline.IsZero() {
+		// 例如还没有读完请求头的连接, 不能因为交接失败而不再受ReadHeaderTimeout限制
+		conn.SetReadDeadline(conn.readDeadline)
+	}
+	if conn.writing {
+		el.armWriteTimer(conn)
+	}
+}
+
+// graceDial 子进程连接父进程的交接socket, 不是平滑重启启动的子进程时返回nil
+func graceDial(opts *Options) (gc *graceChan, err error) {
+	if !isGrace() {
+		return
+	}
+	path := os.Getenv(graceSocketEnv)
+	if path == "" && opts != nil {
+		path = opts.GraceSocket
+	}
+	if path == "" {
+		return
+	}
+	_ = os.Unsetenv(graceSocketEnv)
 
-	fmt.Println("child-server:", server)
 	fmt.Println("in grace....")
-	// read conn
-	// decode
-	unixAddr, err := net.ResolveUnixAddr("unix", unixSocketFile)
+	unixConn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
 	if err != nil {
-		fmt.Println("net.ResolveUnixAddr err ")
-		return
+		return nil, fmt.Errorf("grace DialUnix: %s", err.Error())
 	}
+	timeout := defaultGraceTimeout
+	if opts != nil && opts.GraceTimeout > 0 {
+		timeout = opts.GraceTimeout
+	}
+	_ = unixConn.SetDeadline(time.Now().Add(timeout))
+	return newGraceChan(unixConn), nil
+}
 
-	unixConn, err :=  net.DialUnix("unix", nil, unixAddr)
+// adoptListeners 子进程接收父进程的监听socket, 返回第一个, 其余的留给ReusePort的其他EventLoop
+// 监听地址的网络类型不同时不使用父进程的监听socket, 返回-1
+func (srv *Server) adoptListeners(gc *graceChan, la *ListenAddr) (fd int, err error) {
+	hello, _, err := gc.expect(graceHello)
 	if err != nil {
-		fmt.Println(" net.DialUnix err ")
-		return
+		return -1, err
+	}
+	var fds []int
+	for i := 0; i < hello.Count; i++ {
+		_, lfds, e := gc.expect(graceListener)
+		if e != nil {
+			closeFds(fds)
+			return -1, e
+		}
+		fds = append(fds, lfds...)
 	}
+	if len(fds) == 0 || hello.Network != la.Network {
+		fmt.Println("父进程监听地址不同, 不使用父进程的监听socket: ", hello.Addr)
+		closeFds(fds)
+		return -1, nil
+	}
+	la.fillPort(fds[0])
+	srv.inheritedFds = fds[1:]
+	return fds[0], nil
+}
 
-	unixConn.SetReadDeadline(time.Now().Add(10 * time.Second))
+// ChildReceiveFds 子进程在Start时接收父进程的连接, 在EventLoop开始运行之前调用
+func (srv *Server) ChildReceiveFds() (err error) {
+	gc := srv.graceChild
+	srv.graceChild = nil
+	defer gc.close()
+
+	fmt.Println("child-server:", srv)
+	ready := &graceMsg{Type: graceReady}
+	if check := srv.opts.GraceReadyCheck; check != nil {
+		if err = check(); err != nil {
+			ready.Err = err.Error()
+			_ = gc.send(ready)
+			return fmt.Errorf("grace ready check: %s", err.Error())
+		}
+	}
+	if err = gc.send(ready); err != nil {
+		return
+	}
 
+	var conns []*Connection
 	defer func() {
-		// 使用完后，关掉这个
-		_ = unixConn.Close()
+		if err != nil {
+			for _, c := range conns {
+				_ = syscall.Close(c.Fd)
+			}
+		}
 	}()
-
-	// b是payload数据; conn Session/Context
-	b := make([]byte, 65336)
-
-
-	// oob是带外数据; fd<这里的fd>可以批量
-	oob := make([]byte, 1024)
-
-
 	for {
-		n, oobn, _, _, err := unixConn.ReadMsgUnix(b, oob)
-		if err != nil {
-			fmt.Println("unixConn.ReadMsgUnix err ,", err.Error())
-			break
+		msg, fds, e := gc.recv()
+		if e != nil {
+			return e
 		}
-
-		sCtrMsg, err := syscall.ParseSocketControlMessage(oob[:oobn]);
-		if err != nil {
-			fmt.Println("ParseSocketControlMessage err ,", err.Error())
+		if msg.Err != "" {
+			closeFds(fds)
+			return fmt.Errorf("grace peer: %s", msg.Err)
+		}
+		if msg.Type == graceEnd {
+			if msg.Count != len(conns) {
+				err = fmt.Errorf("received %d conns, want %d", len(conns), msg.Count)
+				_ = gc.send(&graceMsg{Type: graceAck, Err: err.Error()})
+				return
+			}
 			break
 		}
-
-		fds, _ := syscall.ParseUnixRights(&sCtrMsg[0])
-
-		if len(fds) == 1 && fds[0] > 0 {
-			fmt.Println("fds: ", fds)
-			//syscall.Close(fds[0]) /// ??? /// 这里 FDS => 9u
-			//
-			// 这里传过来的是一个新的文件描述符
-			//
+		if msg.Type != graceConn || len(fds) != 1 || msg.Conn == nil {
+			closeFds(fds)
+			return fmt.Errorf("unexpected grace message %d", msg.Type)
 		}
+		conn, e := msg.Conn.connection(fds[0], &srv.opts)
+		if e != nil {
+			// 无法恢复Session, 让父进程回滚
+			_ = syscall.Close(fds[0])
+			err = e
+			_ = gc.send(&graceMsg{Type: graceAck, Err: err.Error()})
+			return
+		}
+		conns = append(conns, conn)
+	}
 
-		conn, err := Decode(b[:n])
-		if err != nil {
-			fmt.Println("DecodeErr: ", err.Error())
+	if err = gc.send(&graceMsg{Type: graceAck, Count: len(conns)}); err != nil {
+		return
+	}
+	if _, _, err = gc.expect(graceCommit); err != nil {
+		return
+	}
+
+	for _, conn := range conns {
+		el := srv.pickLoop(nil)
+		if e := el.addConn(conn); e != nil {
+			fmt.Println("addConn err: ", e.Error())
+			_ = syscall.Close(conn.Fd)
 			continue
 		}
-		if conn == nil {
-			fmt.Println("continue")
-			continue
+		srv.limiter.adopt(conn)
+		if conn.WriteBuff.Len() > 0 {
+			_ = el.enableWrite(conn)
 		}
-		conn.Fd = fds[0]
-		server.Conns[conn.Fd] = conn
-
-		_ = server.evloop.AddRead(conn.Fd)
+		// EventLoop运行后通知Handler, 再处理父进程读出来还没有处理的数据
+		c, loop := conn, el
+		loop.Execute(func() {
+			if rh, ok := c.getHandler().(RestoreHandler); ok && c.State == ESTABLISHED {
+				rh.OnRestore(c)
+			}
+			if c.State == ESTABLISHED && c.ReadBuff.Len() > 0 {
+				loop.deliver(c)
+			}
+		})
 	}
+	fmt.Println("接收连接数: ", len(conns))
+	return
 }
 
-func stop() {
-	server.State = Stop
+func isGrace() bool {
+	rt := false
+	for _, v := range os.Args {
+		if v == "graceKey" {
+			rt = true
+		}
+	}
+	return rt
 }
@@ -0,0 +1,393 @@
+package kimenet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// prefixHandler 回复时加上前缀, 用来区分连接是由父进程还是子进程处理的
+type prefixHandler struct {
+	BaseHandler
+	prefix string
+}
+
+func (h *prefixHandler) OnData(conn *Connection) {
+	_, _ = conn.Write(append([]byte(h.prefix), conn.ReadBuff.Bytes()...))
+	conn.ReadBuff.Reset()
+}
+
+// gracePair 在同一个进程中模拟父子进程之间的交接socket
+func gracePair(t *testing.T) (parent, child *graceChan) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal("Socketpair: ", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "grace")
+		c, err := net.FileConn(f)
+		_ = f.Close()
+		if err != nil {
+			t.Fatal("FileConn: ", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		_ = conns[i].SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	return newGraceChan(conns[0]), newGraceChan(conns[1])
+}
+
+func expectReply(t *testing.T, c net.Conn, msg, want string) {
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal("Write: ", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+	if string(got) != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestGraceHandoff(t *testing.T) {
+	srvA := startTestServer(t, &prefixHandler{prefix: "a:"}, &Options{NumLoops: 2})
+	addr := testAddr(srvA)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	expectReply(t, c, "1", "a:1")
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	srvB, err := newServer(addr, &prefixHandler{prefix: "b:"}, &Options{NumLoops: 2}, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	defer srvB.Stop()
+	go func() {
+		_ = srvB.Start()
+	}()
+
+	if err = <-errCh; err != nil {
+		t.Fatal("handoff: ", err)
+	}
+	select {
+	case <-srvA.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parent server did not stop")
+	}
+
+	// 原有的连接和新连接都由子进程处理
+	expectReply(t, c, "2", "b:2")
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c2.Close()
+	expectReply(t, c2, "3", "b:3")
+	if n := srvB.ActiveConns(); n != 2 {
+		t.Fatalf("child ActiveConns %d, want 2", n)
+	}
+}
+
+func TestGraceRollback(t *testing.T) {
+	srvA := startTestServer(t, &prefixHandler{prefix: "a:"}, &Options{NumLoops: 1})
+	defer srvA.Stop()
+	addr := testAddr(srvA)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	expectReply(t, c, "0", "a:0")
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	opts := &Options{GraceReadyCheck: func() error { return errors.New("not ready") }}
+	srvB, err := newServer(addr, &prefixHandler{prefix: "b:"}, opts, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	if err = srvB.Start(); err == nil {
+		t.Fatal("child Start should fail")
+	}
+	if err = <-errCh; err == nil {
+		t.Fatal("handoff should fail")
+	}
+	srvA.resumeListeners()
+
+	// 父进程继续服务
+	expectReply(t, c, "1", "a:1")
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c2.Close()
+	expectReply(t, c2, "2", "a:2")
+}
+
+// 不能迁移的TLS连接留在父进程中, 交接完成后按Shutdown的流程关闭
+func TestGraceDrainsTLS(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	opts := &Options{NumLoops: 1, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	h := newTLSEchoHandler()
+	srvA := startTestServer(t, h, opts)
+	addr := testAddr(srvA)
+	c := tlsDial(t, addr, &tls.Config{InsecureSkipVerify: true})
+	defer c.Close()
+	tlsEcho(t, c, "1")
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	srvB, err := newServer(addr, newTLSEchoHandler(), opts, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	defer srvB.Stop()
+	go func() {
+		_ = srvB.Start()
+	}()
+
+	// 父进程半关闭连接, 客户端读到close_notify后关闭, 父进程回调OnClose后退出
+	if got, err := ioutil.ReadAll(c); err != nil || len(got) != 0 {
+		t.Fatalf("ReadAll %q %v", got, err)
+	}
+	c.Close()
+	if err = <-h.closed; err != io.EOF {
+		t.Fatalf("parent OnClose %v", err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal("handoff: ", err)
+	}
+	select {
+	case <-srvA.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parent server did not stop")
+	}
+	tlsEcho(t, tlsDial(t, addr, &tls.Config{InsecureSkipVerify: true}), "2")
+}
+
+// stateHandler 按命令修改连接的状态, 用来检查交接时连接状态的迁移
+type stateHandler struct {
+	BaseHandler
+	closed chan error
+}
+
+func (h *stateHandler) OnData(conn *Connection) {
+	cmd := string(conn.ReadBuff.Bytes())
+	conn.ReadBuff.Reset()
+	switch cmd {
+	case "big":
+		_, _ = conn.Write(make([]byte, 16<<20))
+		_ = conn.Close()
+	case "pause":
+		_ = conn.PauseRead()
+		_, _ = conn.Write([]byte("paused"))
+	case "codec":
+		conn.SetCodec(&LineCodec{})
+		_, _ = conn.Write([]byte("codec"))
+	case "busy":
+		conn.Context = busyContext{}
+		_, _ = conn.Write([]byte("busy"))
+	}
+}
+
+// busyContext 协议处理到一半, 不能迁移
+type busyContext struct{}
+
+func (busyContext) Migratable() bool { return false }
+
+func (h *stateHandler) OnClose(conn *Connection, err error) {
+	h.closed <- err
+}
+
+// 关闭中和暂停读取的连接带着状态交给子进程, 单独设置过Codec和Context不能迁移的连接留在父进程中关闭
+func TestGraceConnState(t *testing.T) {
+	h := &stateHandler{closed: make(chan error, 4)}
+	srvA := startTestServer(t, h, &Options{NumLoops: 1})
+	addr := testAddr(srvA)
+	dial := func(cmd, want string) net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("Dial: ", err)
+		}
+		if want != "" {
+			expectReply(t, c, cmd, want)
+		} else if _, err = c.Write([]byte(cmd)); err != nil {
+			t.Fatal("Write: ", err)
+		}
+		return c
+	}
+	big := dial("big", "")
+	defer big.Close()
+	paused := dial("pause", "paused")
+	defer paused.Close()
+	codec := dial("codec", "codec")
+	defer codec.Close()
+	busy := dial("busy", "busy")
+	defer busy.Close()
+
+	// 等到big的写缓冲区中还有数据
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		infos, err := srvA.Conns(ctx)
+		if err != nil {
+			t.Fatal("Conns: ", err)
+		}
+		if len(infos) == 4 && infos[0].State == ConnClosing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+	srvB, err := newServer(addr, &stateHandler{closed: make(chan error, 4)}, &Options{NumLoops: 1}, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	defer srvB.Stop()
+	go func() {
+		_ = srvB.Start()
+	}()
+
+	// 父进程关闭codec和busy连接后退出
+	for _, c := range []net.Conn{codec, busy} {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		if got, err := ioutil.ReadAll(c); err != nil || len(got) != 0 {
+			t.Fatalf("ReadAll %q %v", got, err)
+		}
+		c.Close()
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal("handoff: ", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-h.closed; err != io.EOF {
+			t.Fatalf("parent OnClose %v", err)
+		}
+	}
+
+	// 子进程发送完big的写缓冲区后关闭连接
+	_ = big.SetDeadline(time.Now().Add(5 * time.Second))
+	if got, err := ioutil.ReadAll(big); err != nil || len(got) != 16<<20 {
+		t.Fatalf("big ReadAll %d %v", len(got), err)
+	}
+	infos, err := srvB.Conns(ctx)
+	if err != nil || len(infos) != 1 || !infos[0].ReadPaused || infos[0].RemoteAddr != paused.LocalAddr().String() {
+		t.Fatalf("child Conns %+v %v", infos, err)
+	}
+}
+
+// 子进程就绪后交接失败, 回滚到父进程的连接仍然受读超时限制
+func TestGraceRollbackReadDeadline(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 1)}
+	srvA := startTestServer(t, h, &Options{NumLoops: 1, ReadHeaderTimeout: 500 * time.Millisecond})
+	defer srvA.Stop()
+	addr := testAddr(srvA)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		// Start在另一个协程中执行, 可能还没有开始
+		infos, err := srvA.Conns(ctx)
+		if err != nil && err != ErrServerNotStarted {
+			t.Fatal("Conns: ", err)
+		}
+		if len(infos) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	// 子进程就绪后拒绝收到的连接, 父进程在摘下连接之后回滚
+	hello, _, err := cc.expect(graceHello)
+	if err != nil {
+		t.Fatal("expect hello: ", err)
+	}
+	for i := 0; i < hello.Count; i++ {
+		_, fds, err := cc.expect(graceListener)
+		if err != nil {
+			t.Fatal("expect listener: ", err)
+		}
+		closeFds(fds)
+	}
+	if err = cc.send(&graceMsg{Type: graceReady}); err != nil {
+		t.Fatal("send ready: ", err)
+	}
+	for {
+		msg, fds, err := cc.recv()
+		if err != nil {
+			t.Fatal("recv: ", err)
+		}
+		closeFds(fds)
+		if msg.Type == graceEnd {
+			if msg.Count != 1 {
+				t.Fatalf("handoff %d conns", msg.Count)
+			}
+			break
+		}
+	}
+	_ = cc.send(&graceMsg{Type: graceAck, Err: "rejected"})
+	cc.close()
+	if err = <-errCh; err == nil {
+		t.Fatal("handoff should fail")
+	}
+	srvA.resumeListeners()
+
+	select {
+	case err = <-h.closed:
+		if err != ErrReadTimeout {
+			t.Fatalf("OnClose %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read header timeout lost after rollback")
+	}
+}
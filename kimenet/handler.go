@@ -0,0 +1,157 @@
+package kimenet
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Handler 由使用者实现的业务接口
+// 所有回调都在连接所属的EventLoop协程中执行, 回调里不要做阻塞操作
+type Handler interface {
+	// 新连接建立
+	OnOpen(conn *Connection)
+
+	// 有新数据到达, 数据在 conn.ReadBuff 中, 处理完的数据需要自己消费掉(Next/Discard)
+	OnData(conn *Connection)
+
+	// 写缓冲区中的数据已经全部写入socket
+	OnWritable(conn *Connection)
+
+	// 连接关闭; err == nil 表示本端主动关闭, io.EOF 表示对端关闭
+	OnClose(conn *Connection, err error)
+}
+
+// BaseHandler 提供Handler的空实现, 使用者可以嵌入它只实现关心的回调
+type BaseHandler struct{}
+
+func (BaseHandler) OnOpen(conn *Connection) {}
+
+func (BaseHandler) OnData(conn *Connection) {}
+
+func (BaseHandler) OnWritable(conn *Connection) {}
+
+func (BaseHandler) OnClose(conn *Connection, err error) {}
+
+// Options 服务器配置
+type Options struct {
+	// 是否由kimenet接管信号处理(SIGHUP平滑重启, SIGUSR1停止)
+	HandleSignal bool
+
+	// 负责连接读写的EventLoop数量, 默认为GOMAXPROCS
+	// 大于1时另有一个主EventLoop专门负责accept
+	NumLoops int
+
+	// 新连接分配到EventLoop的策略, 默认轮询
+	LoadBalance LoadBalance
+
+	// 每个EventLoop绑定自己的SO_REUSEPORT监听socket, 由内核分配新连接, 此时LoadBalance不生效
+	ReusePort bool
+
+	// ReusePort模式下挂载CBPF程序, 按处理连接的CPU选择socket, 同时把EventLoop绑定到对应CPU
+	ReusePortCPUSteering bool
+
+	// 监听tcp://[::]这类IPv6地址时只接受IPv6连接, 默认双栈同时接受IPv4
+	IPv6Only bool
+
+	// 监听socket的backlog, 默认128, 实际不超过/proc/sys/net/core/somaxconn
+	ListenBacklog int
+
+	// 监听socket和每个accept/Dial的连接的socket选项; 监听socket的选项被内核拒绝时NewServer返回*SockoptError,
+	// 连接上被拒绝的选项不影响连接, 按选项计数(Server.SockoptErrors和Metrics), 每种只打印一次日志; 平滑重启和systemd传入的监听socket不再设置; 单个连接见Connection.SetSocketOptions
+	SocketOptions *SocketOptions
+
+	// 同时存在的accept连接数上限和单个IP的连接数上限, <=0表示不限制; Dial发起的连接不计入
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// accept速率限制(每秒连接数), 令牌桶容量为AcceptBurst(默认等于AcceptRate), <=0表示不限制
+	AcceptRate  float64
+	AcceptBurst int
+
+	// 超过限制被拒绝的连接在关闭前发送的数据, 例如"HTTP/1.1 503 Service Unavailable\r\n\r\n"
+	// 拒绝的连接数见Server.Rejects
+	RejectResponse []byte
+
+	// 连接使用边缘触发(EPOLLET), 读写都一直处理到EAGAIN
+	EdgeTriggered bool
+
+	// 每轮事件循环中单个连接最多读取/发送的字节数, 超过后先处理其他连接, 默认256KB
+	ReadBudget  int
+	WriteBudget int
+
+	// 连接超过IdleTimeout没有任何读写就关闭, OnClose的err为ErrIdleTimeout
+	IdleTimeout time.Duration
+
+	// 接受的连接ReadHeaderTimeout内协议层没有用Connection.SetReadDeadline(time.Time{})清除读超时
+	// (例如读完请求头)就关闭, OnClose的err为ErrReadTimeout; 只收到部分数据也不会延长
+	// 不清除读超时的协议不要设置; kimenet_http在解析完第一个请求的头部后清除
+	ReadHeaderTimeout time.Duration
+
+	// 写缓冲区有数据但超过WriteTimeout没有任何发送进展就关闭, OnClose的err为ErrWriteTimeout
+	WriteTimeout time.Duration
+
+	// 写缓冲区的高低水位(字节), 超过高水位和回落到低水位时回调WatermarkHandler, 并暂停/恢复读取配对的连接
+	// WriteHighWatermark<=0表示不检查, WriteLowWatermark默认为高水位的一半; 单个连接可以用SetWriteWatermarks修改
+	WriteHighWatermark int
+	WriteLowWatermark  int
+
+	// 连接的帧编解码, 设置后Handler需要实现MessageHandler, 收到的数据解码成消息回调OnMessage
+	// 单个连接可以用Connection.SetCodec修改
+	Codec Codec
+
+	// 开启TLS终止, 至少要设置Certificates、GetCertificate(例如CertStore, 按SNI选择证书)或GetConfigForClient之一
+	// ALPN使用NextProtos; 会复制一份, 默认最低TLS 1.2; 不支持udp, Dial发起的连接不使用
+	// TLS连接不在平滑重启时迁移, 交接完成后父进程按Shutdown的流程关闭它们(最多等待GraceTimeout)再退出
+	TLSConfig *tls.Config
+
+	// TLS握手的超时时间, 默认不限制
+	TLSHandshakeTimeout time.Duration
+
+	// 同时进行的TLS握手数上限, 每个正在握手的连接占用一个协程, 超过时连接排队等待, 不占用协程
+	// 默认1024, 小于0不限制; 握手协程在收到客户端的第一段数据后才启动, 只建立连接不发送数据的客户端不占用协程
+	TLSMaxHandshakes int
+
+	// session ticket密钥的轮换间隔, 默认不轮换(使用crypto/tls自动生成的密钥)
+	// 轮换时保留最近的3个密钥, 用旧密钥加密的ticket在之后的2个间隔内仍然可以恢复会话
+	TLSTicketKeyRotation time.Duration
+
+	// 新连接开头先解析PROXY protocol(v1/v2)头部, 用其中的客户端地址替换RemoteAddr, 之后再TLS握手/回调OnOpen
+	// 连接数限制(MaxConnsPerIP等)仍然按直接连接的地址(负载均衡)计算
+	ProxyProtocol bool
+
+	// 可以发送PROXY头部的来源(负载均衡), 每项是CIDR或IP; 这些来源的连接必须有头部,
+	// 其他来源的连接按普通连接处理, 开头是PROXY头部时关闭, OnClose的err为ErrProxyUntrusted; 为空时所有来源都必须有头部
+	ProxyProtocolAllowlist []string
+
+	// 等待PROXY头部的超时时间, 默认5秒
+	ProxyProtocolTimeout time.Duration
+
+	// 使用systemd socket activation传入的监听socket(LISTEN_FDS), 不是由systemd启动时自己创建
+	// ReusePort时其他EventLoop的socket也要由systemd传入(同名的多个socket), 或者unit文件中设置ReusePort=yes
+	SystemdSocket bool
+
+	// 按名字(unit文件中的FileDescriptorName)选择systemd传入的socket, 默认选第一个类型相同的
+	SystemdSocketName string
+
+	// 平滑重启(SIGHUP)时父子进程交接用的unix socket路径, 默认在临时目录下按父进程pid命名
+	GraceSocket string
+
+	// 平滑重启的超时时间, 超时后父进程回滚继续服务, 默认30秒
+	GraceTimeout time.Duration
+
+	// 平滑重启的子进程在接手连接之前执行的就绪检查, 返回error时父进程回滚
+	GraceReadyCheck func() error
+
+	// udp服务每次recvmmsg/sendmmsg最多处理的数据报个数, 默认32
+	PacketBatch int
+
+	// udp服务接收的最大数据报长度, 超过的会被丢弃, 默认8192
+	MaxPacketSize int
+
+	// 统计每次Handler回调的耗时, 每次回调多调用两次time.Now; 其他统计总是打开, 见Server.Metrics
+	HandlerTiming bool
+
+	// 不为空时在这个地址(例如":9100")上用net/http提供Prometheus格式的统计, 路径为/metrics
+	// 也可以把Server.MetricsHandler挂到已有的http服务上
+	MetricsAddr string
+}
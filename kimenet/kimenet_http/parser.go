@@ -0,0 +1,348 @@
+package kimenet_http
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/aizsfgk/kimego/kimenet"
+)
+
+// 解析器的状态
+const (
+	stateHeader    = iota // 请求行和头部
+	stateBody             // Content-Length的请求体
+	stateChunkSize        // chunk大小行
+	stateChunkData        // chunk数据
+	stateChunkEnd         // chunk数据之后的CRLF
+	stateTrailer          // 最后一个chunk之后的尾部头部
+)
+
+const maxChunkLineBytes = 4096
+
+// StatusError 请求不合法, 用Code回复后关闭连接
+type StatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *StatusError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Msg
+}
+
+func statusError(code int, msg string) *StatusError {
+	return &StatusError{Code: code, Msg: msg}
+}
+
+// parser 从连接的ReadBuff中增量解析请求, 数据不够时记住状态, 下次收到数据后继续
+type parser struct {
+	maxHeader int
+	maxBody   int64
+
+	state   int
+	scanned int // 已经查找过头部结束标记的字节数, 避免每次从头查找
+	req     *Request
+	remain  int64 // 当前请求体或chunk剩余的字节数
+	trailer int   // 尾部头部的字节数
+}
+
+// parse 解析出一个完整的请求; 数据不够时返回nil, 已经消费的数据从buf中丢弃
+func (p *parser) parse(buf *kimenet.RingBuffer) (req *Request, err error) {
+	for buf.Len() > 0 || p.state == stateBody && p.remain == 0 {
+		data := buf.Bytes()
+		var n int
+		switch p.state {
+		case stateHeader:
+			n, err = p.parseHeader(data)
+		case stateBody:
+			n = p.readBody(data)
+			if p.remain == 0 {
+				req = p.done()
+			}
+		case stateChunkSize:
+			n, err = p.parseChunkSize(data)
+		case stateChunkData:
+			n = p.readBody(data)
+			if p.remain == 0 {
+				p.state = stateChunkEnd
+			}
+		case stateChunkEnd:
+			if len(data) < 2 {
+				return
+			}
+			if data[0] != '\r' || data[1] != '\n' {
+				return nil, statusError(400, "malformed chunk")
+			}
+			n = 2
+			p.state = stateChunkSize
+		case stateTrailer:
+			var end bool
+			n, end, err = p.parseTrailer(data)
+			if end {
+				req = p.done()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Discard(n)
+		if req != nil {
+			return
+		}
+		if n == 0 {
+			return
+		}
+	}
+	return
+}
+
+// waitingBody 请求头已经解析, 正在等待请求体
+func (p *parser) waitingBody() *Request {
+	if p.state == stateHeader {
+		return nil
+	}
+	return p.req
+}
+
+func (p *parser) done() (req *Request) {
+	req = p.req
+	p.req = nil
+	p.state = stateHeader
+	p.scanned = 0
+	p.trailer = 0
+	return
+}
+
+func (p *parser) parseHeader(data []byte) (n int, err error) {
+	// 请求之前的空行忽略, 见RFC 7230 3.5
+	for n+1 < len(data) && data[n] == '\r' && data[n+1] == '\n' {
+		n += 2
+	}
+	if n > 0 {
+		p.scanned = 0
+		return
+	}
+
+	start := p.scanned - 3
+	if start < 0 {
+		start = 0
+	}
+	i := bytes.Index(data[start:], []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(data) > p.maxHeader {
+			return 0, statusError(431, "request header too large")
+		}
+		p.scanned = len(data)
+		return 0, nil
+	}
+	end := start + i + 4
+	if end > p.maxHeader {
+		return 0, statusError(431, "request header too large")
+	}
+
+	lines := strings.Split(string(data[:end-4]), "\r\n")
+	req := &Request{Header: make(Header)}
+	if err = parseRequestLine(req, lines[0]); err != nil {
+		return
+	}
+	for _, line := range lines[1:] {
+		if err = parseHeaderLine(req.Header, line); err != nil {
+			return
+		}
+	}
+	if err = p.framing(req); err != nil {
+		return
+	}
+	p.req = req
+	return end, nil
+}
+
+func parseRequestLine(req *Request, line string) (err error) {
+	i := strings.IndexByte(line, ' ')
+	j := strings.LastIndexByte(line, ' ')
+	if i <= 0 || j <= i+1 {
+		return statusError(400, "malformed request line")
+	}
+	req.Method, req.RequestURI, req.Proto = line[:i], line[i+1:j], line[j+1:]
+	if !isToken(req.Method) {
+		return statusError(400, "invalid method")
+	}
+	if strings.IndexAny(req.RequestURI, " \t") >= 0 || !validValue(req.RequestURI) {
+		return statusError(400, "invalid request uri")
+	}
+
+	switch req.Proto {
+	case "HTTP/1.1":
+		req.ProtoMinor = 1
+	case "HTTP/1.0":
+		req.ProtoMinor = 0
+	default:
+		if strings.HasPrefix(req.Proto, "HTTP/") {
+			return statusError(505, "http version not supported")
+		}
+		return statusError(400, "malformed http version")
+	}
+
+	req.Path = req.RequestURI
+	if q := strings.IndexByte(req.Path, '?'); q >= 0 {
+		req.Path, req.RawQuery = req.Path[:q], req.Path[q+1:]
+	}
+	return
+}
+
+func parseHeaderLine(h Header, line string) (err error) {
+	if line == "" || line[0] == ' ' || line[0] == '\t' {
+		// 不支持obs-fold
+		return statusError(400, "malformed header line")
+	}
+	i := strings.IndexByte(line, ':')
+	if i <= 0 || !isToken(line[:i]) {
+		return statusError(400, "malformed header line")
+	}
+	value := strings.Trim(line[i+1:], " \t")
+	if !validValue(value) {
+		return statusError(400, "invalid header value")
+	}
+	h.Add(line[:i], value)
+	return
+}
+
+// framing 确定请求体的长度, 同时有Transfer-Encoding和Content-Length的请求拒绝, 防止请求走私
+func (p *parser) framing(req *Request) (err error) {
+	h := req.Header
+	if req.ProtoMinor >= 1 && len(h.Values("Host")) != 1 {
+		return statusError(400, "missing or duplicate host header")
+	}
+	req.Host = h.Get("Host")
+
+	if req.ProtoMinor >= 1 {
+		req.Close = h.hasToken("Connection", "close")
+	} else {
+		req.Close = !h.hasToken("Connection", "keep-alive")
+	}
+
+	if expect := h.Get("Expect"); expect != "" && !strings.EqualFold(expect, "100-continue") {
+		return statusError(417, "unsupported expectation")
+	}
+
+	te := h.Values("Transfer-Encoding")
+	cl := h.Values("Content-Length")
+	if len(te) > 0 {
+		if len(cl) > 0 {
+			return statusError(400, "both transfer-encoding and content-length")
+		}
+		if len(te) != 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return statusError(501, "unsupported transfer-encoding")
+		}
+		req.Chunked = true
+		req.ContentLength = -1
+		p.state = stateChunkSize
+		return
+	}
+
+	for _, v := range cl {
+		if v != cl[0] {
+			return statusError(400, "conflicting content-length")
+		}
+	}
+	if len(cl) > 0 {
+		n, e := strconv.ParseInt(cl[0], 10, 64)
+		if e != nil || n < 0 || cl[0][0] == '+' {
+			return statusError(400, "invalid content-length")
+		}
+		if n > p.maxBody {
+			return statusError(413, "request body too large")
+		}
+		req.ContentLength = n
+	}
+	p.remain = req.ContentLength
+	p.state = stateBody
+	return
+}
+
+// readBody 读取请求体或chunk数据
+func (p *parser) readBody(data []byte) (n int) {
+	n = len(data)
+	if int64(n) > p.remain {
+		n = int(p.remain)
+	}
+	p.req.Body = append(p.req.Body, data[:n]...)
+	p.remain -= int64(n)
+	return
+}
+
+func (p *parser) parseChunkSize(data []byte) (n int, err error) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		if len(data) > maxChunkLineBytes {
+			return 0, statusError(400, "chunk size line too long")
+		}
+		return 0, nil
+	}
+	line := string(data[:i])
+	// 忽略chunk扩展
+	if j := strings.IndexByte(line, ';'); j >= 0 {
+		line = line[:j]
+	}
+	line = strings.TrimRight(line, " \t")
+	if line == "" || len(line) > 15 {
+		return 0, statusError(400, "invalid chunk size")
+	}
+	// 只接受十六进制数字, ParseInt还会接受"+a"这样的符号
+	var size int64
+	for k := 0; k < len(line); k++ {
+		d := unhex(line[k])
+		if d < 0 {
+			return 0, statusError(400, "invalid chunk size")
+		}
+		size = size<<4 | int64(d)
+	}
+	if int64(len(p.req.Body))+size > p.maxBody {
+		return 0, statusError(413, "request body too large")
+	}
+
+	if size == 0 {
+		p.state = stateTrailer
+	} else {
+		p.remain = size
+		p.state = stateChunkData
+	}
+	return i + 2, nil
+}
+
+func unhex(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+// parseTrailer 解析一行尾部头部, 空行表示请求结束
+func (p *parser) parseTrailer(data []byte) (n int, end bool, err error) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		if p.trailer+len(data) > p.maxHeader {
+			return 0, false, statusError(431, "request trailer too large")
+		}
+		return 0, false, nil
+	}
+	p.trailer += i + 2
+	if p.trailer > p.maxHeader {
+		return 0, false, statusError(431, "request trailer too large")
+	}
+	if i == 0 {
+		return 2, true, nil
+	}
+	if p.req.Trailer == nil {
+		p.req.Trailer = make(Header)
+	}
+	if err = parseHeaderLine(p.req.Trailer, string(data[:i])); err != nil {
+		return
+	}
+	return i + 2, false, nil
+}
@@ -0,0 +1,39 @@
+package kimenet_http
+
+import (
+	"net/url"
+)
+
+// Request 一个完整的HTTP请求, 请求体已经全部读入Body
+type Request struct {
+	Method     string
+	RequestURI string // 请求行中的原始URI
+	Path       string // RequestURI中?之前的部分
+	RawQuery   string // RequestURI中?之后的部分
+	Proto      string // "HTTP/1.1"或"HTTP/1.0"
+	ProtoMinor int
+	Header     Header
+	Host       string
+
+	// 请求头中的Content-Length, 分块传输时为-1
+	ContentLength int64
+	Chunked       bool
+	Body          []byte
+	Trailer       Header // 分块传输的尾部头部
+
+	RemoteAddr string
+
+	// 响应之后关闭连接: HTTP/1.1请求带了Connection: close, 或者HTTP/1.0请求没有带Connection: keep-alive
+	Close bool
+}
+
+// Query 解析RawQuery
+func (r *Request) Query() url.Values {
+	v, _ := url.ParseQuery(r.RawQuery)
+	return v
+}
+
+// expectContinue 请求带了Expect: 100-continue
+func (r *Request) expectContinue() bool {
+	return r.ProtoMinor >= 1 && r.Header.hasToken("Expect", "100-continue")
+}
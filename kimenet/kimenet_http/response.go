@@ -0,0 +1,254 @@
+package kimenet_http
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet"
+)
+
+// 没有Flush时响应体先缓存, 结束时计算Content-Length; 超过这个大小时自动Flush, 改为分块传输
+const responseBufferSize = 64 * 1024
+
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+var (
+	ErrResponseEnded  = errors.New("http: response already ended")
+	ErrBodyNotAllowed = errors.New("http: request method or response status code does not allow body")
+	ErrContentLength  = errors.New("http: wrote more than the declared Content-Length")
+	ErrHeaderSent     = errors.New("http: header already sent")
+)
+
+// ResponseWriter 构造响应; 只能在连接所属的EventLoop协程中使用
+// ServeHTTP返回时响应自动结束; 调用Async之后由使用者在之后调用End结束, 期间同一连接上流水线的后续请求等待
+type ResponseWriter struct {
+	conn *kimenet.Connection
+	hc   *httpConn
+	req  *Request
+
+	header      Header
+	status      int
+	headerSent  bool
+	chunked     bool
+	length      int64 // Content-Length, -1表示没有
+	written     int64
+	buf         []byte
+	async       bool
+	ended       bool
+	hijacked    bool
+	closeAfter  bool // 响应之后关闭连接
+	wroteStatus bool
+}
+
+func newResponseWriter(conn *kimenet.Connection, hc *httpConn, req *Request) *ResponseWriter {
+	return &ResponseWriter{
+		conn:   conn,
+		hc:     hc,
+		req:    req,
+		header: make(Header),
+		status: 200,
+		length: -1,
+	}
+}
+
+// Header 响应头部, 在WriteHeader/第一次Flush之前修改有效
+func (w *ResponseWriter) Header() Header {
+	return w.header
+}
+
+// Conn 请求所在的连接
+func (w *ResponseWriter) Conn() *kimenet.Connection {
+	return w.conn
+}
+
+// WriteHeader 设置状态码, 头部在Flush或End时发送
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.wroteStatus || w.ended {
+		return
+	}
+	w.wroteStatus = true
+	w.status = code
+}
+
+// Write 写入响应体
+func (w *ResponseWriter) Write(b []byte) (n int, err error) {
+	if w.ended {
+		return 0, ErrResponseEnded
+	}
+	w.wroteStatus = true
+	if !bodyAllowedForStatus(w.status) {
+		return 0, ErrBodyNotAllowed
+	}
+	if !w.headerSent {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) > responseBufferSize {
+			if err = w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if err = w.writeBody(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush 发送头部和已经缓存的响应体; 没有设置Content-Length时HTTP/1.1使用分块传输, HTTP/1.0发送完关闭连接
+func (w *ResponseWriter) Flush() (err error) {
+	if w.ended {
+		return ErrResponseEnded
+	}
+	w.wroteStatus = true
+	if !w.headerSent {
+		if w.header.Get("Content-Length") == "" && bodyAllowedForStatus(w.status) {
+			if w.req.ProtoMinor >= 1 {
+				w.chunked = true
+			} else {
+				w.closeAfter = true
+			}
+		}
+		if err = w.sendHeader(); err != nil {
+			return
+		}
+	}
+	body := w.buf
+	w.buf = nil
+	if len(body) > 0 {
+		err = w.writeBody(body)
+	}
+	return
+}
+
+// Async 响应在ServeHTTP返回之后由使用者调用End结束, 例如等待后端的结果
+func (w *ResponseWriter) Async() {
+	w.async = true
+}
+
+// End 结束响应, 然后处理这个连接上的下一个请求; 只能在EventLoop协程中调用, 例如用conn.Loop().Execute
+func (w *ResponseWriter) End() (err error) {
+	if w.ended {
+		return ErrResponseEnded
+	}
+	w.wroteStatus = true
+	if !w.headerSent {
+		if w.header.Get("Content-Length") == "" && bodyAllowedForStatus(w.status) {
+			w.header.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		}
+		if err = w.sendHeader(); err != nil {
+			w.ended = true
+			w.hc.finish(w)
+			return
+		}
+		body := w.buf
+		w.buf = nil
+		if len(body) > 0 {
+			err = w.writeBody(body)
+		}
+	} else if w.chunked && w.req.Method != "HEAD" {
+		_, err = w.conn.Write([]byte("0\r\n\r\n"))
+	}
+	if w.length >= 0 && w.written != w.length && w.req.Method != "HEAD" {
+		// 响应体和Content-Length不一致, 连接上的数据已经不可用
+		w.closeAfter = true
+		if err == nil {
+			err = ErrContentLength
+		}
+	}
+	w.ended = true
+	w.hc.finish(w)
+	return
+}
+
+// Hijack 接管连接, 之后不再按HTTP处理, 例如升级为WebSocket; 接管后应调用conn.SetHandler
+// ReadBuff中请求之后的数据留给新的Handler
+func (w *ResponseWriter) Hijack() *kimenet.Connection {
+	w.hijacked = true
+	w.ended = true
+	w.hc.hijacked = true
+	w.hc.w = nil
+	return w.conn
+}
+
+func (w *ResponseWriter) sendHeader() (err error) {
+	if w.headerSent {
+		return ErrHeaderSent
+	}
+	w.headerSent = true
+
+	if !bodyAllowedForStatus(w.status) {
+		w.header.Del("Content-Length")
+		w.header.Del("Transfer-Encoding")
+		w.chunked = false
+	} else if w.chunked {
+		w.header.Del("Content-Length")
+		w.header.Set("Transfer-Encoding", "chunked")
+	} else if cl := w.header.Get("Content-Length"); cl != "" {
+		w.length, err = strconv.ParseInt(cl, 10, 64)
+		if err != nil || w.length < 0 {
+			w.length = -1
+			w.closeAfter = true
+			return ErrContentLength
+		}
+	}
+
+	if w.hc.shouldClose(w) {
+		w.closeAfter = true
+	}
+	if w.closeAfter || w.header.hasToken("Connection", "close") {
+		w.closeAfter = true
+		w.header.Set("Connection", "close")
+	} else if w.req.ProtoMinor == 0 {
+		w.header.Set("Connection", "keep-alive")
+	}
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.Now().UTC().Format(timeFormat))
+	}
+
+	b := make([]byte, 0, 256)
+	b = append(b, "HTTP/1.1 "...)
+	b = strconv.AppendInt(b, int64(w.status), 10)
+	b = append(b, ' ')
+	b = append(b, StatusText(w.status)...)
+	b = append(b, "\r\n"...)
+	b = w.header.appendTo(b)
+	b = append(b, "\r\n"...)
+	_, err = w.conn.Write(b)
+	return
+}
+
+func (w *ResponseWriter) writeBody(b []byte) (err error) {
+	if w.length >= 0 && w.written+int64(len(b)) > w.length {
+		return ErrContentLength
+	}
+	w.written += int64(len(b))
+	if w.req.Method == "HEAD" {
+		return
+	}
+	if w.chunked {
+		size := strconv.AppendInt(make([]byte, 0, 20), int64(len(b)), 16)
+		size = append(size, "\r\n"...)
+		if _, err = w.conn.Write(size); err != nil {
+			return
+		}
+		if _, err = w.conn.Write(b); err != nil {
+			return
+		}
+		_, err = w.conn.Write([]byte("\r\n"))
+		return
+	}
+	_, err = w.conn.Write(b)
+	return
+}
+
+// bodyAllowedForStatus 1xx、204和304的响应不能有响应体
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204, status == 304:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,230 @@
+package kimenet_http
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet"
+)
+
+const (
+	defaultMaxHeaderBytes = 64 * 1024
+	defaultMaxBodyBytes   = 10 * 1024 * 1024
+)
+
+// Handler 处理一个HTTP请求, 在连接所属的EventLoop协程中回调, 不能阻塞
+type Handler interface {
+	ServeHTTP(w *ResponseWriter, r *Request)
+}
+
+// HandlerFunc 把函数作为Handler
+type HandlerFunc func(w *ResponseWriter, r *Request)
+
+func (f HandlerFunc) ServeHTTP(w *ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+type Options struct {
+	// 请求行和头部的最大字节数, 超过时回复431, 默认64KB; 同时限制分块传输的尾部头部
+	MaxHeaderBytes int
+
+	// 请求体的最大字节数, 超过时回复413, 默认10MB
+	MaxBodyBytes int64
+
+	// 一个连接上最多处理的请求数, 之后的响应带Connection: close, 默认不限制
+	MaxRequestsPerConn int
+}
+
+// httpConn 连接上的HTTP状态, 放在Connection.Context中
+type httpConn struct {
+	conn      *kimenet.Connection
+	srv       *connHandler
+	p         parser
+	w         *ResponseWriter // 正在处理的请求, 异步响应时不为nil
+	requests  int
+	serving   bool // 在ServeHTTP中
+	paused    bool // 异步响应期间缓冲的请求太多, 暂停读取
+	closed    bool // 已经决定关闭连接
+	shutdown  bool // 服务器正在Shutdown, 当前请求处理完关闭
+	hijacked  bool
+	continued bool // 当前请求已经回复了100 Continue
+}
+
+// connHandler 把HTTP协议接到kimenet的连接上
+type connHandler struct {
+	kimenet.BaseHandler
+	h    Handler
+	opts Options
+}
+
+// NewHandler 返回处理HTTP/1.1的kimenet.Handler, 用于kimenet.NewServer; 可以和TLS、Shutdown等kimenet的功能一起使用
+func NewHandler(h Handler, opts *Options) kimenet.Handler {
+	s := &connHandler{h: h}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.MaxHeaderBytes <= 0 {
+		s.opts.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if s.opts.MaxBodyBytes <= 0 {
+		s.opts.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	return s
+}
+
+// ListenAndServe 在addr上启动HTTP服务, 阻塞直到服务器停止
+func ListenAndServe(addr string, h Handler, opts *Options, netOpts *kimenet.Options) (err error) {
+	srv, err := kimenet.NewServer(addr, NewHandler(h, opts), netOpts)
+	if err != nil {
+		return
+	}
+	return srv.Start()
+}
+
+func (s *connHandler) OnOpen(conn *kimenet.Connection) {
+	conn.Context = &httpConn{
+		conn: conn,
+		srv:  s,
+		p:    parser{maxHeader: s.opts.MaxHeaderBytes, maxBody: s.opts.MaxBodyBytes},
+	}
+}
+
+func (s *connHandler) OnData(conn *kimenet.Connection) {
+	if hc, ok := conn.Context.(*httpConn); ok {
+		hc.serve()
+	}
+}
+
+func (s *connHandler) OnClose(conn *kimenet.Connection, err error) {
+	if hc, ok := conn.Context.(*httpConn); ok {
+		hc.closed = true
+		if hc.w != nil {
+			// 异步响应还没有结束, 之后的End不再写入
+			hc.w.ended = true
+			hc.w = nil
+		}
+	}
+}
+
+// OnRestore 平滑重启时子进程接手父进程的连接, 重建HTTP状态; 迁移过来的ReadBuff中是下一个请求的开头
+func (s *connHandler) OnRestore(conn *kimenet.Connection) {
+	s.OnOpen(conn)
+}
+
+// OnShutdown 服务器Shutdown时空闲的连接直接关闭, 正在处理请求的连接在响应之后关闭
+func (s *connHandler) OnShutdown(conn *kimenet.Connection) {
+	hc, ok := conn.Context.(*httpConn)
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+	hc.shutdown = true
+	if hc.w == nil && hc.p.waitingBody() == nil && conn.ReadBuff.Len() == 0 {
+		hc.closed = true
+		_ = conn.Close()
+	}
+}
+
+// Migratable 平滑重启时只迁移在两个请求之间的连接, 还没有解析完的请求头部在ReadBuff中随连接交给子进程
+// 正在处理请求、读取请求体或者已经决定关闭的连接留在父进程中, 由Shutdown处理完当前请求后关闭
+func (hc *httpConn) Migratable() bool {
+	return hc.w == nil && hc.p.state == stateHeader && !hc.closed && !hc.shutdown && !hc.hijacked
+}
+
+// serve 依次解析和处理ReadBuff中的请求(流水线), 异步响应期间后面的请求等待
+func (hc *httpConn) serve() {
+	conn := hc.conn
+	for hc.w == nil && !hc.closed && !hc.hijacked && conn.ReadBuff.Len() > 0 {
+		req, err := hc.p.parse(conn.ReadBuff)
+		if err != nil {
+			hc.fail(err)
+			return
+		}
+		if hc.requests == 0 && (req != nil || hc.p.waitingBody() != nil) {
+			// 第一个请求的头部解析完, 清除kimenet.Options.ReadHeaderTimeout设置的读超时
+			conn.SetReadDeadline(time.Time{})
+		}
+		if req == nil {
+			hc.sendContinue()
+			return
+		}
+		hc.handle(req)
+	}
+
+	// 异步响应期间流水线的请求太多时暂停读取, 由TCP流控限制客户端
+	if hc.w != nil && !hc.paused && conn.ReadBuff.Len() > hc.srv.opts.MaxHeaderBytes {
+		hc.paused = true
+		_ = conn.PauseRead()
+	}
+}
+
+// sendContinue 请求头带Expect: 100-continue, 请求体还没有到达时回复100 Continue
+func (hc *httpConn) sendContinue() {
+	req := hc.p.waitingBody()
+	if req == nil || hc.continued || !req.expectContinue() {
+		return
+	}
+	hc.continued = true
+	_, _ = hc.conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+}
+
+func (hc *httpConn) handle(req *Request) {
+	hc.requests++
+	hc.continued = false
+	req.RemoteAddr = hc.conn.RemoteAddr()
+
+	w := newResponseWriter(hc.conn, hc, req)
+	hc.w = w
+	hc.serving = true
+	hc.srv.h.ServeHTTP(w, req)
+	hc.serving = false
+	if !w.async && !w.ended {
+		_ = w.End()
+	}
+}
+
+// shouldClose 响应之后是否关闭连接
+func (hc *httpConn) shouldClose(w *ResponseWriter) bool {
+	if w.req.Close || hc.shutdown {
+		return true
+	}
+	max := hc.srv.opts.MaxRequestsPerConn
+	return max > 0 && hc.requests >= max
+}
+
+// finish 一个响应结束
+func (hc *httpConn) finish(w *ResponseWriter) {
+	if hc.w != w {
+		return
+	}
+	hc.w = nil
+	if w.closeAfter {
+		hc.closed = true
+		_ = hc.conn.Close()
+		return
+	}
+	if hc.paused {
+		hc.paused = false
+		_ = hc.conn.ResumeRead()
+	}
+	// 异步响应结束后继续处理已经收到的请求
+	if !hc.serving {
+		hc.serve()
+	}
+}
+
+// fail 请求不合法, 回复错误后关闭连接
+func (hc *httpConn) fail(err error) {
+	se, ok := err.(*StatusError)
+	if !ok {
+		se = statusError(400, err.Error())
+	}
+	hc.closed = true
+	body := se.Msg + "\n"
+	resp := "HTTP/1.1 " + strconv.Itoa(se.Code) + " " + StatusText(se.Code) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body
+	_, _ = hc.conn.Write([]byte(resp))
+	_ = hc.conn.Close()
+}
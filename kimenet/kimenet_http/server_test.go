@@ -0,0 +1,366 @@
+package kimenet_http
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet"
+)
+
+func startServer(t *testing.T, h Handler, opts *Options) *kimenet.Server {
+	srv, err := kimenet.NewServer("127.0.0.1:0", NewHandler(h, opts), &kimenet.Options{NumLoops: 2})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	return srv
+}
+
+func dial(t *testing.T, srv *kimenet.Server) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+func readResponse(t *testing.T, br *bufio.Reader, method string) (*http.Response, string) {
+	resp, err := http.ReadResponse(br, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal("ReadResponse: ", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal("read body: ", err)
+	}
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+// echoRequest 回复请求的方法、路径、查询参数和请求体
+var echoRequest = HandlerFunc(func(w *ResponseWriter, r *Request) {
+	w.Header().Set("X-Method", r.Method)
+	w.Header().Set("X-Path", r.Path)
+	w.Header().Set("X-Query", r.Query().Get("q"))
+	if r.Trailer != nil {
+		w.Header().Set("X-Trailer", r.Trailer.Get("X-Sum"))
+	}
+	_, _ = w.Write(r.Body)
+})
+
+func TestHTTPClient(t *testing.T) {
+	srv := startServer(t, echoRequest, nil)
+	defer srv.Stop()
+
+	resp, err := http.Post("http://"+srv.Addr()+"/echo?q=1", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal("Post: ", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "hello" || resp.Header.Get("X-Path") != "/echo" || resp.Header.Get("X-Query") != "1" {
+		t.Fatalf("resp %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	if resp.ContentLength != 5 {
+		t.Fatalf("ContentLength %d", resp.ContentLength)
+	}
+}
+
+func TestHTTPKeepAlivePipelining(t *testing.T) {
+	srv := startServer(t, echoRequest, nil)
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	// 两个请求一次发送, 按顺序响应
+	_, _ = c.Write([]byte("GET /a HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc" +
+		"HEAD /c HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, body := readResponse(t, br, "GET")
+	if resp.Header.Get("X-Path") != "/a" || body != "" || resp.Close {
+		t.Fatalf("first %v %q", resp.Header, body)
+	}
+	resp, body = readResponse(t, br, "POST")
+	if resp.Header.Get("X-Path") != "/b" || body != "abc" {
+		t.Fatalf("second %v %q", resp.Header, body)
+	}
+	resp, body = readResponse(t, br, "HEAD")
+	if resp.Header.Get("X-Path") != "/c" || body != "" {
+		t.Fatalf("third %v %q", resp.Header, body)
+	}
+
+	// 分多次到达的请求
+	req := "GET /d HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n"
+	for i := 0; i < len(req); i += 7 {
+		end := i + 7
+		if end > len(req) {
+			end = len(req)
+		}
+		_, _ = c.Write([]byte(req[i:end]))
+		time.Sleep(time.Millisecond)
+	}
+	resp, _ = readResponse(t, br, "GET")
+	if resp.Header.Get("X-Path") != "/d" || !resp.Close {
+		t.Fatalf("fourth %v", resp.Header)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("conn not closed: %v", err)
+	}
+}
+
+func TestHTTPChunked(t *testing.T) {
+	srv := startServer(t, HandlerFunc(func(w *ResponseWriter, r *Request) {
+		if r.Path == "/stream" {
+			_, _ = w.Write([]byte("hello "))
+			_ = w.Flush()
+			_, _ = w.Write([]byte("world"))
+			return
+		}
+		echoRequest(w, r)
+	}), nil)
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	// 分块的请求体, 带扩展和尾部头部
+	_, _ = c.Write([]byte("POST /up HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;ext=1\r\nhello\r\n" + "6\r\n world\r\n" + "0\r\nX-Sum: 11\r\n\r\n"))
+	resp, body := readResponse(t, br, "POST")
+	if body != "hello world" || resp.Header.Get("X-Trailer") != "11" {
+		t.Fatalf("chunked request %q %v", body, resp.Header)
+	}
+
+	// 分块的响应体
+	_, _ = c.Write([]byte("GET /stream HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, body = readResponse(t, br, "GET")
+	if body != "hello world" || len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+		t.Fatalf("chunked response %q %v", body, resp.TransferEncoding)
+	}
+
+	// HTTP/1.0不能分块, 发送完关闭连接
+	_, _ = c.Write([]byte("GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	got, _ := ioutil.ReadAll(br)
+	if !strings.HasSuffix(string(got), "\r\n\r\nhello world") || !strings.Contains(string(got), "Connection: close") {
+		t.Fatalf("http/1.0 stream %q", got)
+	}
+}
+
+func TestHTTPExpectContinue(t *testing.T) {
+	srv := startServer(t, echoRequest, &Options{MaxBodyBytes: 100})
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	_, _ = c.Write([]byte("PUT /f HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n"))
+	line, err := br.ReadString('\n')
+	if err != nil || line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("100 continue %q %v", line, err)
+	}
+	_, _ = br.ReadString('\n')
+	_, _ = c.Write([]byte("data"))
+	if _, body := readResponse(t, br, "PUT"); body != "data" {
+		t.Fatalf("body %q", body)
+	}
+
+	// 请求体太大, 不回复100直接413
+	_, _ = c.Write([]byte("PUT /f HTTP/1.1\r\nHost: x\r\nContent-Length: 101\r\nExpect: 100-continue\r\n\r\n"))
+	if resp, _ := readResponse(t, br, "PUT"); resp.StatusCode != 413 {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPBadRequests(t *testing.T) {
+	srv := startServer(t, echoRequest, &Options{MaxHeaderBytes: 256, MaxBodyBytes: 16})
+	defer srv.Stop()
+
+	cases := []struct {
+		req  string
+		code int
+	}{
+		{"GET / HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("a", 300) + "\r\n\r\n", 431},
+		{"GET / HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("a", 300), 431},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 17\r\n\r\n", 413},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n11\r\n", 413},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n+a\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n;ext=1\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n0x1\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n", 400},
+		{"POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\n\r\n", 400},
+		{"GET / HTTP/2.0\r\nHost: x\r\n\r\n", 505},
+		{"GET /\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: x\r\n folded\r\n\r\n", 400},
+		{"GET / HTTP/1.1\r\nHost: x\r\nExpect: later\r\n\r\n", 417},
+	}
+	for _, tc := range cases {
+		c, br := dial(t, srv)
+		_, _ = c.Write([]byte(tc.req))
+		resp, _ := readResponse(t, br, "GET")
+		if resp.StatusCode != tc.code || !resp.Close {
+			t.Fatalf("%q: status %d close %v, want %d", tc.req, resp.StatusCode, resp.Close, tc.code)
+		}
+		c.Close()
+	}
+}
+
+func TestHTTPAsync(t *testing.T) {
+	srv := startServer(t, HandlerFunc(func(w *ResponseWriter, r *Request) {
+		if r.Path != "/slow" {
+			echoRequest(w, r)
+			return
+		}
+		w.Async()
+		loop := w.Conn().Loop()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			loop.Execute(func() {
+				_, _ = w.Write([]byte("slow"))
+				_ = w.End()
+			})
+		}()
+	}), nil)
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	// 慢请求之后的请求等待慢请求响应之后再处理
+	_, _ = c.Write([]byte("GET /slow HTTP/1.1\r\nHost: x\r\n\r\nGET /fast HTTP/1.1\r\nHost: x\r\n\r\n"))
+	if _, body := readResponse(t, br, "GET"); body != "slow" {
+		t.Fatalf("first body %q", body)
+	}
+	if resp, _ := readResponse(t, br, "GET"); resp.Header.Get("X-Path") != "/fast" {
+		t.Fatalf("second %v", resp.Header)
+	}
+}
+
+func TestHTTPMaxRequestsAndStatus(t *testing.T) {
+	srv := startServer(t, HandlerFunc(func(w *ResponseWriter, r *Request) {
+		code, _ := strconv.Atoi(r.Path[1:])
+		w.WriteHeader(code)
+		_, _ = w.Write([]byte("x"))
+	}), &Options{MaxRequestsPerConn: 2})
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	_, _ = c.Write([]byte("GET /204 HTTP/1.1\r\nHost: x\r\n\r\nGET /404 HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, body := readResponse(t, br, "GET")
+	if resp.StatusCode != 204 || body != "" || resp.Header.Get("Content-Length") != "" {
+		t.Fatalf("204 response %v %q", resp.Header, body)
+	}
+	resp, body = readResponse(t, br, "GET")
+	if resp.StatusCode != 404 || body != "x" || !resp.Close {
+		t.Fatalf("404 response %d %q close %v", resp.StatusCode, body, resp.Close)
+	}
+}
+
+// upgradeEcho 接管连接后回显
+type upgradeEcho struct {
+	kimenet.BaseHandler
+}
+
+func (upgradeEcho) OnData(conn *kimenet.Connection) {
+	_, _ = conn.Write(conn.ReadBuff.Bytes())
+	conn.ReadBuff.Reset()
+}
+
+func TestHTTPHijack(t *testing.T) {
+	srv := startServer(t, HandlerFunc(func(w *ResponseWriter, r *Request) {
+		conn := w.Hijack()
+		_, _ = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n"))
+		conn.SetHandler(upgradeEcho{})
+	}), nil)
+	defer srv.Stop()
+	c, br := dial(t, srv)
+	defer c.Close()
+
+	// 升级请求之后紧跟的数据交给新的Handler
+	_, _ = c.Write([]byte("GET /up HTTP/1.1\r\nHost: x\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nping"))
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil || resp.StatusCode != 101 {
+		t.Fatalf("upgrade %v %v", resp, err)
+	}
+	got := make([]byte, 4)
+	if _, err = io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo %q %v", got, err)
+	}
+	_, _ = c.Write([]byte("pong"))
+	if _, err = io.ReadFull(br, got); err != nil || string(got) != "pong" {
+		t.Fatalf("echo %q %v", got, err)
+	}
+}
+
+func TestHTTPMigratable(t *testing.T) {
+	hc := &httpConn{p: parser{maxHeader: defaultMaxHeaderBytes, maxBody: defaultMaxBodyBytes}}
+	buf := kimenet.NewRingBuffer(1024)
+	steps := []struct {
+		data string
+		want bool
+	}{
+		{"POST / HTTP/1.1\r\nHost:", true}, // 头部还在ReadBuff中
+		{" a\r\nContent-Length: 4\r\n\r\nab", false},
+		{"cd", true},
+	}
+	for i, s := range steps {
+		_, _ = buf.Write([]byte(s.data))
+		req, err := hc.p.parse(buf)
+		if err != nil {
+			t.Fatal("parse: ", err)
+		}
+		if got := hc.Migratable(); got != s.want {
+			t.Fatalf("step %d Migratable %v", i, got)
+		}
+		if i == 2 && (req == nil || string(req.Body) != "abcd") {
+			t.Fatalf("request %+v", req)
+		}
+	}
+}
+
+func TestHTTPReadHeaderTimeout(t *testing.T) {
+	srv, err := kimenet.NewServer("127.0.0.1:0", NewHandler(echoRequest, nil), &kimenet.Options{NumLoops: 1, ReadHeaderTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	// 头部一个字节一个字节地发送, 超时后关闭
+	c, br := dial(t, srv)
+	defer c.Close()
+	start := time.Now()
+	for _, b := range []byte("GET / HTTP/1.1\r\nHost: a\r\n") {
+		if _, err = c.Write([]byte{b}); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err = br.ReadByte(); err != io.EOF || time.Since(start) > 2*time.Second {
+		t.Fatalf("slow header read %v after %v", err, time.Since(start))
+	}
+
+	// 读完头部后不再限制
+	c2, br2 := dial(t, srv)
+	defer c2.Close()
+	_, _ = c2.Write([]byte("GET /a HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if resp, _ := readResponse(t, br2, "GET"); resp.Header.Get("X-Path") != "/a" {
+		t.Fatalf("resp %v", resp.Header)
+	}
+	time.Sleep(300 * time.Millisecond)
+	_, _ = c2.Write([]byte("GET /b HTTP/1.1\r\nHost: a\r\n\r\n"))
+	if resp, _ := readResponse(t, br2, "GET"); resp.Header.Get("X-Path") != "/b" {
+		t.Fatalf("resp %v", resp.Header)
+	}
+}
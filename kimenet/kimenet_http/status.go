@@ -0,0 +1,48 @@
+package kimenet_http
+
+var statusText = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	204: "No Content",
+	206: "Partial Content",
+
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	411: "Length Required",
+	413: "Request Entity Too Large",
+	414: "Request URI Too Long",
+	417: "Expectation Failed",
+	426: "Upgrade Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText 状态码的描述, 未知的状态码返回"Status"
+func StatusText(code int) string {
+	if s, ok := statusText[code]; ok {
+		return s
+	}
+	return "Status"
+}
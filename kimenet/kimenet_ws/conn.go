@@ -0,0 +1,331 @@
+package kimenet_ws
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aizsfgk/kimego/kimenet"
+	"github.com/aizsfgk/kimego/kimenet/kimenet_http"
+)
+
+var (
+	ErrCloseSent     = errors.New("websocket: close frame already sent")
+	ErrInvalidOpcode = errors.New("websocket: invalid message type")
+	ErrControlTooBig = errors.New("websocket: control frame payload too big")
+)
+
+// Handler 处理WebSocket连接上的事件, 所有回调都在连接所属的EventLoop协程中执行, 不能阻塞
+type Handler interface {
+	// 握手完成
+	OnOpen(c *Conn)
+
+	// 收到一条完整的消息(分片已经合并, 已经解压), op为OpText或OpBinary; data之后不再被使用
+	OnMessage(c *Conn, op int, data []byte)
+
+	// 连接关闭, 只回调一次; code为对端close帧的状态码, 协议错误时为发送给对端的状态码,
+	// 没有close帧就断开时为CloseAbnormal
+	OnClose(c *Conn, code int, reason string)
+}
+
+// Conn 一个WebSocket连接, 方法只能在EventLoop协程中调用, 其他协程通过Conn().Loop().Execute调用
+type Conn struct {
+	conn *kimenet.Connection
+	u    *Upgrader
+	req  *kimenet_http.Request
+
+	subprotocol string
+	compress    bool
+
+	// 使用者自定义的连接上下文
+	Context interface{}
+
+	// 正在接收的分片消息, msgOp为0表示没有
+	msgOp         int
+	msgCompressed bool
+	msg           []byte
+
+	closeSent  bool // 已经发送close帧
+	closed     bool // 已经回调OnClose
+	closeTimer *kimenet.Timer
+
+	// 保活, 见keepalive
+	lastRead  time.Time
+	pingAt    time.Time
+	waitPong  bool
+	pingTimer *kimenet.Timer
+}
+
+// Conn 底层的kimenet连接
+func (c *Conn) Conn() *kimenet.Connection {
+	return c.conn
+}
+
+// Request 升级时的HTTP请求
+func (c *Conn) Request() *kimenet_http.Request {
+	return c.req
+}
+
+// Subprotocol 协商的子协议, 没有时为空
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr()
+}
+
+// WriteMessage 发送一条消息, op为OpText或OpBinary; 协商了permessage-deflate时较长的消息压缩后发送
+func (c *Conn) WriteMessage(op int, data []byte) (err error) {
+	if op != OpText && op != OpBinary {
+		return ErrInvalidOpcode
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if c.compress && len(data) >= c.u.compressionThreshold() {
+		if data, err = compress(data, c.u.compressionLevel()); err != nil {
+			return
+		}
+		return c.writeFrame(true, op, data)
+	}
+	return c.writeFrame(false, op, data)
+}
+
+func (c *Conn) WriteText(s string) error {
+	return c.WriteMessage(OpText, []byte(s))
+}
+
+func (c *Conn) WriteBinary(b []byte) error {
+	return c.WriteMessage(OpBinary, b)
+}
+
+// Ping 发送ping帧, 对端回复的pong不回调Handler
+func (c *Conn) Ping(data []byte) (err error) {
+	if len(data) > maxControlPayload {
+		return ErrControlTooBig
+	}
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return c.writeFrame(false, OpPing, data)
+}
+
+// Close 开始关闭握手: 发送close帧, 等对端回复close帧后关闭连接, 超过CloseTimeout没有回复直接关闭
+// 之后收到的消息不再回调OnMessage
+func (c *Conn) Close(code int, reason string) (err error) {
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+	if err = c.sendClose(code, reason); err != nil {
+		c.notifyClose(code, reason)
+		_ = c.conn.Close()
+		return
+	}
+	c.pingTimer.Stop()
+	c.closeTimer = c.conn.Loop().AfterFunc(c.u.closeTimeout(), func() {
+		c.notifyClose(code, reason)
+		_ = c.conn.Close()
+	})
+	return
+}
+
+func (c *Conn) writeFrame(rsv1 bool, op int, payload []byte) (err error) {
+	_, err = c.conn.Write(appendFrame(make([]byte, 0, len(payload)+10), rsv1, op, payload))
+	return
+}
+
+// sendClose 发送close帧, code为CloseNoStatus时不带状态码
+func (c *Conn) sendClose(code int, reason string) error {
+	c.closeSent = true
+	if code == CloseNoStatus {
+		return c.writeFrame(false, OpClose, nil)
+	}
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	return c.writeFrame(false, OpClose, payload)
+}
+
+// notifyClose 回调OnClose, 只回调一次
+func (c *Conn) notifyClose(code int, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.pingTimer.Stop()
+	c.closeTimer.Stop()
+	c.msg = nil
+	c.u.Handler.OnClose(c, code, reason)
+}
+
+// fail 出错时发送close帧(CloseAbnormal不发送)后立即关闭连接, 不等对端回复
+func (c *Conn) fail(e *CloseError) {
+	if !c.closeSent && e.Code != CloseAbnormal {
+		_ = c.sendClose(e.Code, e.Text)
+	}
+	c.notifyClose(e.Code, e.Text)
+	_ = c.conn.Close()
+}
+
+// onData 解析ReadBuff中的帧
+func (c *Conn) onData() {
+	buf := c.conn.ReadBuff
+	c.lastRead = time.Now()
+	for buf.Len() > 0 && !c.closed {
+		f, n, e := parseFrame(buf.Bytes(), c.u.maxMessageSize()-int64(len(c.msg)))
+		if e == nil && n > 0 {
+			buf.Discard(n)
+			e = c.handleFrame(f)
+		}
+		if e != nil {
+			c.fail(e)
+			return
+		}
+		if n == 0 {
+			return
+		}
+	}
+	if c.closed {
+		// 关闭之后收到的数据丢弃
+		buf.Reset()
+	}
+}
+
+func (c *Conn) handleFrame(f frame) *CloseError {
+	if f.rsv1 && (!c.compress || f.op != OpText && f.op != OpBinary) {
+		return closeError(CloseProtocolError, "unexpected rsv1")
+	}
+	switch f.op {
+	case OpPing:
+		if !c.closeSent {
+			_ = c.writeFrame(false, OpPong, f.payload)
+		}
+	case OpPong:
+		// lastRead已经更新, 保活只需要收到数据
+	case OpClose:
+		return c.onClose(f.payload)
+	case OpText, OpBinary:
+		if c.msgOp != 0 {
+			return closeError(CloseProtocolError, "expected continuation frame")
+		}
+		if f.fin {
+			return c.onMessage(f.op, f.rsv1, f.payload)
+		}
+		c.msgOp, c.msgCompressed, c.msg = f.op, f.rsv1, f.payload
+	case OpContinuation:
+		if c.msgOp == 0 {
+			return closeError(CloseProtocolError, "unexpected continuation frame")
+		}
+		c.msg = append(c.msg, f.payload...)
+		if f.fin {
+			op, compressed, data := c.msgOp, c.msgCompressed, c.msg
+			c.msgOp, c.msgCompressed, c.msg = 0, false, nil
+			return c.onMessage(op, compressed, data)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) onMessage(op int, compressed bool, data []byte) *CloseError {
+	if compressed {
+		var err error
+		if data, err = decompress(data, c.u.maxMessageSize()); err == errDeflateTooBig {
+			return closeError(CloseMessageTooBig, "message too big")
+		} else if err != nil {
+			return closeError(CloseInvalidPayload, "invalid compressed data")
+		}
+	}
+	if op == OpText && !utf8.Valid(data) {
+		return closeError(CloseInvalidPayload, "invalid utf-8 text")
+	}
+	if c.closeSent {
+		return nil
+	}
+	c.u.Handler.OnMessage(c, op, data)
+	return nil
+}
+
+// onClose 收到close帧: 还没有发送close帧时回复相同的状态码, 然后由服务端先关闭TCP连接
+func (c *Conn) onClose(payload []byte) *CloseError {
+	code, reason := CloseNoStatus, ""
+	switch {
+	case len(payload) == 1:
+		return closeError(CloseProtocolError, "invalid close frame")
+	case len(payload) >= 2:
+		code, reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+		if !validCloseCode(code) {
+			return closeError(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.ValidString(reason) {
+			return closeError(CloseInvalidPayload, "invalid utf-8 close reason")
+		}
+	}
+	if !c.closeSent {
+		_ = c.sendClose(code, "")
+	}
+	c.notifyClose(code, reason)
+	_ = c.conn.Close()
+	return nil
+}
+
+// keepalive PingInterval内没有收到数据时发送ping, 之后PongTimeout内仍然没有收到数据就断开连接
+// 空闲的连接每个间隔只有一次定时器回调, 有数据的连接不发送ping
+func (c *Conn) keepalive() {
+	interval := c.u.PingInterval
+	if c.waitPong {
+		if c.lastRead.Before(c.pingAt) {
+			c.fail(closeError(CloseAbnormal, "ping timeout"))
+			return
+		}
+		c.waitPong = false
+	}
+	now := time.Now()
+	if idle := now.Sub(c.lastRead); idle < interval {
+		c.pingTimer.Reset(interval - idle)
+		return
+	}
+	c.pingAt, c.waitPong = now, true
+	_ = c.writeFrame(false, OpPing, nil)
+	c.pingTimer.Reset(c.u.pongTimeout())
+}
+
+// connHandler 升级之后kimenet连接的Handler
+type connHandler struct {
+	kimenet.BaseHandler
+	c *Conn
+}
+
+func (h connHandler) OnData(conn *kimenet.Connection) {
+	h.c.onData()
+}
+
+func (h connHandler) OnClose(conn *kimenet.Connection, err error) {
+	reason := ""
+	if err != nil {
+		reason = err.Error()
+	}
+	h.c.notifyClose(CloseAbnormal, reason)
+}
+
+// OnRestore 平滑重启时子进程接手连接, 启动保活定时器后通知Handler
+func (h connHandler) OnRestore(conn *kimenet.Connection) {
+	c := h.c
+	if c.u.PingInterval > 0 {
+		c.pingTimer = conn.Loop().AfterFunc(c.u.PingInterval, c.keepalive)
+	}
+	if rh, ok := c.u.Handler.(RestoreHandler); ok {
+		rh.OnRestore(c)
+	}
+}
+
+// OnShutdown 服务器Shutdown时用CloseGoingAway开始关闭握手
+func (h connHandler) OnShutdown(conn *kimenet.Connection) {
+	if h.c.Close(CloseGoingAway, "server shutdown") == ErrCloseSent {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package kimenet_ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// permessage-deflate(RFC 7692)
+// 双方都不保留压缩上下文(no_context_takeover), 每条消息单独压缩, 空闲的连接不占用压缩状态, 压缩器可以在连接之间复用
+
+const deflateResponse = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// 每条压缩消息去掉的结尾, 解压时补回; 再加一个BFINAL的空块让解压器正常结束
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+var errDeflateTooBig = errors.New("websocket: decompressed message too big")
+
+var (
+	flateWriters [flate.BestCompression + 1]sync.Pool // 按压缩级别
+	flateReaders sync.Pool
+)
+
+// negotiateDeflate 客户端的Sec-WebSocket-Extensions中有可以接受的permessage-deflate
+// 不支持限制服务端的窗口大小(server_max_window_bits小于15), 这样的提议跳过
+func negotiateDeflate(values []string) bool {
+	for _, v := range values {
+		for _, ext := range strings.Split(v, ",") {
+			params := strings.Split(ext, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			ok := true
+			for _, p := range params[1:] {
+				name, value := strings.TrimSpace(p), ""
+				if i := strings.IndexByte(name, '='); i >= 0 {
+					name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+				}
+				switch name {
+				case "server_no_context_takeover", "client_no_context_takeover", "client_max_window_bits":
+				case "server_max_window_bits":
+					ok = ok && value == "15"
+				default:
+					ok = false
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compress 压缩一条消息
+func compress(data []byte, level int) (b []byte, err error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2+16))
+	fw, _ := flateWriters[level].Get().(*flate.Writer)
+	if fw == nil {
+		if fw, err = flate.NewWriter(buf, level); err != nil {
+			return
+		}
+	} else {
+		fw.Reset(buf)
+	}
+	defer flateWriters[level].Put(fw)
+
+	if _, err = fw.Write(data); err != nil {
+		return
+	}
+	if err = fw.Flush(); err != nil {
+		return
+	}
+	// 去掉Flush产生的00 00 ff ff
+	b = buf.Bytes()
+	return b[:len(b)-4], nil
+}
+
+// decompress 解压一条消息, 解压后超过max字节时返回errDeflateTooBig
+func decompress(data []byte, max int64) (b []byte, err error) {
+	src := io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail))
+	fr, _ := flateReaders.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(src)
+	} else if err = fr.(flate.Resetter).Reset(src, nil); err != nil {
+		return
+	}
+	defer flateReaders.Put(fr)
+
+	b, err = ioutil.ReadAll(io.LimitReader(fr, max+1))
+	if err == nil && int64(len(b)) > max {
+		err = errDeflateTooBig
+	}
+	return
+}
@@ -0,0 +1,154 @@
+package kimenet_ws
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// 帧的操作码, 见RFC 6455 5.2
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// 关闭状态码, 见RFC 6455 7.4.1
+const (
+	CloseNormal             = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatus           = 1005 // 对端的close帧没有状态码, 不会发送
+	CloseAbnormal           = 1006 // 没有close帧连接就断开了, 不会发送
+	CloseInvalidPayload     = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalError      = 1011
+)
+
+// 控制帧的负载最多125字节
+const maxControlPayload = 125
+
+// CloseError 因为协议错误等关闭连接时的状态码和原因
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	return "websocket: close " + strconv.Itoa(e.Code) + " " + e.Text
+}
+
+func closeError(code int, text string) *CloseError {
+	return &CloseError{Code: code, Text: text}
+}
+
+type frame struct {
+	fin     bool
+	rsv1    bool // permessage-deflate压缩的消息
+	op      int
+	payload []byte
+}
+
+// parseFrame 从data中解析一个客户端发来的帧, 数据不够时n为0
+// 帧头就能确定负载超过maxPayload时直接返回错误, 不等数据全部到达
+func parseFrame(data []byte, maxPayload int64) (f frame, n int, err *CloseError) {
+	if len(data) < 2 {
+		return
+	}
+	b0, b1 := data[0], data[1]
+	if b0&0x30 != 0 {
+		return f, 0, closeError(CloseProtocolError, "reserved bits set")
+	}
+	f.fin = b0&0x80 != 0
+	f.rsv1 = b0&0x40 != 0
+	f.op = int(b0 & 0x0f)
+	switch f.op {
+	case OpContinuation, OpText, OpBinary:
+	case OpClose, OpPing, OpPong:
+		if !f.fin || b1&0x7f > maxControlPayload {
+			return f, 0, closeError(CloseProtocolError, "invalid control frame")
+		}
+	default:
+		return f, 0, closeError(CloseProtocolError, "reserved opcode")
+	}
+	// 客户端发来的帧必须掩码
+	if b1&0x80 == 0 {
+		return f, 0, closeError(CloseProtocolError, "unmasked client frame")
+	}
+
+	length := int64(b1 & 0x7f)
+	pos := 2
+	switch length {
+	case 126:
+		if len(data) < 4 {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(data[2:]))
+		pos = 4
+	case 127:
+		if len(data) < 10 {
+			return
+		}
+		u := binary.BigEndian.Uint64(data[2:])
+		if u>>63 != 0 {
+			return f, 0, closeError(CloseProtocolError, "invalid payload length")
+		}
+		length = int64(u)
+		pos = 10
+	}
+	if f.op < OpClose && length > maxPayload {
+		return f, 0, closeError(CloseMessageTooBig, "message too big")
+	}
+	if int64(len(data)-pos-4) < length {
+		return
+	}
+
+	key := data[pos : pos+4]
+	pos += 4
+	f.payload = make([]byte, length)
+	copy(f.payload, data[pos:])
+	maskBytes(key, f.payload)
+	return f, pos + int(length), nil
+}
+
+// appendFrame 服务端发送的帧, 不掩码
+func appendFrame(b []byte, rsv1 bool, op int, payload []byte) []byte {
+	b0 := byte(0x80 | op)
+	if rsv1 {
+		b0 |= 0x40
+	}
+	b = append(b, b0)
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 127)
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(n))
+	}
+	return append(b, payload...)
+}
+
+func maskBytes(key []byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+// validCloseCode 可以出现在close帧中的状态码
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
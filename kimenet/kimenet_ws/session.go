@@ -0,0 +1,131 @@
+package kimenet_ws
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet"
+	"github.com/aizsfgk/kimego/kimenet/kimenet_http"
+)
+
+// sessionType Conn在kimenet的Session注册表中的类型名
+const sessionType = "kimenet_ws.Conn"
+
+// RestoreHandler Handler可以选择实现它, 平滑重启时子进程接手连接后在EventLoop协程中回调, 不回调OnOpen
+type RestoreHandler interface {
+	OnRestore(c *Conn)
+}
+
+var (
+	upgraderMu sync.RWMutex
+	upgraders  = make(map[string]*Upgrader)
+)
+
+func init() {
+	kimenet.RegisterSession(sessionType, decodeSession)
+}
+
+// RegisterUpgrader 给Upgrader注册一个名字, 平滑重启时它升级的连接连同正在接收的分片消息、压缩协商结果
+// 和Conn.Context一起交给子进程, 由子进程中同名的Upgrader继续处理; Conn.Context不为nil时要实现kimenet.Session
+// 父子进程都要注册, 一般在init中调用, 同一个名字重复注册时panic
+// 没有注册的Upgrader升级的连接不迁移, 留在父进程中用CloseGoingAway关闭
+func RegisterUpgrader(name string, u *Upgrader) {
+	upgraderMu.Lock()
+	defer upgraderMu.Unlock()
+	if name == "" || u == nil {
+		panic("kimenet_ws: RegisterUpgrader with empty name or nil Upgrader")
+	}
+	if _, dup := upgraders[name]; dup {
+		panic("kimenet_ws: RegisterUpgrader called twice for " + name)
+	}
+	u.name = name
+	upgraders[name] = u
+}
+
+// connSession Conn迁移时编码的状态; 双方都不保留压缩上下文, 压缩只需要协商结果
+type connSession struct {
+	Upgrader    string
+	Request     *kimenet_http.Request
+	Subprotocol string
+	Compress    bool
+
+	MsgOp         int
+	MsgCompressed bool
+	Msg           []byte
+
+	ContextType string
+	Context     []byte
+}
+
+func (c *Conn) SessionType() string {
+	return sessionType
+}
+
+func (c *Conn) MarshalSession() (data []byte, err error) {
+	cs := connSession{
+		Upgrader:      c.u.name,
+		Request:       c.req,
+		Subprotocol:   c.subprotocol,
+		Compress:      c.compress,
+		MsgOp:         c.msgOp,
+		MsgCompressed: c.msgCompressed,
+		Msg:           c.msg,
+	}
+	if s, ok := c.Context.(kimenet.Session); ok {
+		cs.ContextType = s.SessionType()
+		if cs.Context, err = s.MarshalSession(); err != nil {
+			return
+		}
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(&cs)
+	data = buf.Bytes()
+	return
+}
+
+// Migratable 只迁移Upgrader注册过名字、还没有开始关闭握手、Context可以编码的连接
+func (c *Conn) Migratable() bool {
+	if c.u.name == "" || c.closeSent || c.closed {
+		return false
+	}
+	if c.Context == nil {
+		return true
+	}
+	_, ok := c.Context.(kimenet.Session)
+	return ok
+}
+
+// decodeSession 子进程中重建Conn, 保活定时器在OnRestore中启动
+func decodeSession(conn *kimenet.Connection, data []byte) (s kimenet.Session, err error) {
+	var cs connSession
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&cs); err != nil {
+		return
+	}
+	upgraderMu.RLock()
+	u := upgraders[cs.Upgrader]
+	upgraderMu.RUnlock()
+	if u == nil {
+		return nil, errors.New("upgrader " + cs.Upgrader + " not registered")
+	}
+	c := &Conn{
+		conn:          conn,
+		u:             u,
+		req:           cs.Request,
+		subprotocol:   cs.Subprotocol,
+		compress:      cs.Compress,
+		msgOp:         cs.MsgOp,
+		msgCompressed: cs.MsgCompressed,
+		msg:           cs.Msg,
+		lastRead:      time.Now(),
+	}
+	if cs.ContextType != "" {
+		if c.Context, err = kimenet.DecodeSession(conn, cs.ContextType, cs.Context); err != nil {
+			return
+		}
+	}
+	conn.SetHandler(connHandler{c: c})
+	return c, nil
+}
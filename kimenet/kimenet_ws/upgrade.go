@@ -0,0 +1,177 @@
+package kimenet_ws
+
+import (
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet/kimenet_http"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	defaultMaxMessageSize       = 1024 * 1024
+	defaultCloseTimeout         = 5 * time.Second
+	defaultCompressionThreshold = 128
+)
+
+// Upgrader 把HTTP请求升级为WebSocket连接(RFC 6455), 可以直接作为kimenet_http.Handler使用
+type Upgrader struct {
+	Handler Handler
+
+	// 服务端支持的子协议, 按客户端Sec-WebSocket-Protocol中的顺序选第一个支持的
+	Subprotocols []string
+
+	// 检查Origin等, 返回false时回复403; nil表示不检查
+	CheckOrigin func(r *kimenet_http.Request) bool
+
+	// 消息(合并分片、解压之后)的最大字节数, 超过时以CloseMessageTooBig关闭, 默认1MB
+	MaxMessageSize int64
+
+	// 连接PingInterval没有收到任何数据时发送ping, 之后PongTimeout(默认等于PingInterval)内
+	// 还没有收到数据就断开连接, OnClose的code为CloseAbnormal; <=0表示不发送
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// 发送close帧后等待对端回复的时间, 默认5秒
+	CloseTimeout time.Duration
+
+	// 客户端提议时启用permessage-deflate, 双方都不保留压缩上下文
+	EnableCompression bool
+
+	// 压缩级别1-9, 默认flate.BestSpeed
+	CompressionLevel int
+
+	// 小于这个字节数的消息不压缩, 默认128
+	CompressionThreshold int
+
+	name string // RegisterUpgrader注册的名字, 为空时升级的连接不迁移
+}
+
+func (u *Upgrader) ServeHTTP(w *kimenet_http.ResponseWriter, r *kimenet_http.Request) {
+	_, _ = u.Upgrade(w, r)
+}
+
+// Upgrade 在kimenet_http.Handler中调用, 校验握手请求并回复101, 之后连接由Handler处理
+// 请求不合法时回复错误状态码, 返回*kimenet_http.StatusError; 只能在ServeHTTP返回之前调用
+func (u *Upgrader) Upgrade(w *kimenet_http.ResponseWriter, r *kimenet_http.Request) (c *Conn, err error) {
+	h := r.Header
+	switch {
+	case r.Method != "GET":
+		return nil, u.reject(w, 405, "websocket: method not GET")
+	case r.ProtoMinor < 1:
+		return nil, u.reject(w, 400, "websocket: http/1.1 required")
+	case !h.HasToken("Connection", "upgrade") || !h.HasToken("Upgrade", "websocket"):
+		return nil, u.reject(w, 400, "websocket: not a websocket handshake")
+	case h.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.reject(w, 426, "websocket: unsupported version")
+	}
+	key := h.Get("Sec-WebSocket-Key")
+	if b, e := base64.StdEncoding.DecodeString(key); e != nil || len(b) != 16 {
+		return nil, u.reject(w, 400, "websocket: invalid Sec-WebSocket-Key")
+	}
+	if u.CheckOrigin != nil && !u.CheckOrigin(r) {
+		return nil, u.reject(w, 403, "websocket: origin not allowed")
+	}
+
+	c = &Conn{
+		u:           u,
+		req:         r,
+		subprotocol: u.selectSubprotocol(h.Values("Sec-WebSocket-Protocol")),
+		compress:    u.EnableCompression && negotiateDeflate(h.Values("Sec-WebSocket-Extensions")),
+		lastRead:    time.Now(),
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if c.subprotocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + c.subprotocol + "\r\n"
+	}
+	if c.compress {
+		resp += "Sec-WebSocket-Extensions: " + deflateResponse + "\r\n"
+	}
+	resp += "\r\n"
+
+	// 接管连接, ReadBuff中握手请求之后的帧由connHandler处理
+	c.conn = w.Hijack()
+	if _, err = c.conn.Write([]byte(resp)); err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+	c.conn.Context = c
+	c.conn.SetHandler(connHandler{c: c})
+	if u.PingInterval > 0 {
+		c.pingTimer = c.conn.Loop().AfterFunc(u.PingInterval, c.keepalive)
+	}
+	u.Handler.OnOpen(c)
+	return
+}
+
+func (u *Upgrader) reject(w *kimenet_http.ResponseWriter, code int, msg string) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(msg + "\n"))
+	return &kimenet_http.StatusError{Code: code, Msg: msg}
+}
+
+func (u *Upgrader) selectSubprotocol(values []string) string {
+	for _, v := range values {
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimSpace(p)
+			for _, s := range u.Subprotocols {
+				if p == s {
+					return s
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (u *Upgrader) maxMessageSize() int64 {
+	if u.MaxMessageSize > 0 {
+		return u.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (u *Upgrader) pongTimeout() time.Duration {
+	if u.PongTimeout > 0 {
+		return u.PongTimeout
+	}
+	return u.PingInterval
+}
+
+func (u *Upgrader) closeTimeout() time.Duration {
+	if u.CloseTimeout > 0 {
+		return u.CloseTimeout
+	}
+	return defaultCloseTimeout
+}
+
+func (u *Upgrader) compressionLevel() int {
+	if u.CompressionLevel < flate.BestSpeed || u.CompressionLevel > flate.BestCompression {
+		return flate.BestSpeed
+	}
+	return u.CompressionLevel
+}
+
+func (u *Upgrader) compressionThreshold() int {
+	if u.CompressionThreshold > 0 {
+		return u.CompressionThreshold
+	}
+	return defaultCompressionThreshold
+}
+
+// acceptKey Sec-WebSocket-Accept
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
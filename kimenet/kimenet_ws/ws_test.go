@@ -0,0 +1,466 @@
+package kimenet_ws
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aizsfgk/kimego/kimenet"
+	"github.com/aizsfgk/kimego/kimenet/kimenet_http"
+)
+
+type closeInfo struct {
+	code   int
+	reason string
+}
+
+// echoHandler 回显消息, 收到"close"时由服务端开始关闭握手
+type echoHandler struct {
+	closes chan closeInfo
+}
+
+func (h *echoHandler) OnOpen(c *Conn) {}
+
+func (h *echoHandler) OnMessage(c *Conn, op int, data []byte) {
+	if op == OpText && string(data) == "close" {
+		_ = c.Close(CloseNormal, "done")
+		return
+	}
+	_ = c.WriteMessage(op, data)
+}
+
+func (h *echoHandler) OnClose(c *Conn, code int, reason string) {
+	h.closes <- closeInfo{code, reason}
+}
+
+func startServer(t *testing.T, u *Upgrader) (*kimenet.Server, *echoHandler) {
+	h := &echoHandler{closes: make(chan closeInfo, 16)}
+	u.Handler = h
+	srv, err := kimenet.NewServer("127.0.0.1:0", kimenet_http.NewHandler(u, nil), &kimenet.Options{NumLoops: 1})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	return srv, h
+}
+
+// wsClient 测试用的客户端, 发送掩码帧
+type wsClient struct {
+	t  *testing.T
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func dial(t *testing.T, srv *kimenet.Server, header string) (*wsClient, *http.Response) {
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" + header + "\r\n"
+	if _, err = c.Write([]byte(req)); err != nil {
+		t.Fatal("write handshake: ", err)
+	}
+	wc := &wsClient{t: t, c: c, br: bufio.NewReader(c)}
+	resp, err := http.ReadResponse(wc.br, &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatal("read handshake: ", err)
+	}
+	return wc, resp
+}
+
+func (wc *wsClient) frame(fin, rsv1 bool, op int, payload []byte) []byte {
+	b0 := byte(op)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	b := []byte{b0}
+	switch n := len(payload); {
+	case n <= 125:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x80|126, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x80|127, 0, 0, 0, 0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	masked := append([]byte(nil), payload...)
+	maskBytes(key, masked)
+	return append(b, masked...)
+}
+
+func (wc *wsClient) send(fin, rsv1 bool, op int, payload []byte) {
+	if _, err := wc.c.Write(wc.frame(fin, rsv1, op, payload)); err != nil {
+		wc.t.Fatal("send: ", err)
+	}
+}
+
+func (wc *wsClient) read() (rsv1 bool, op int, payload []byte) {
+	var h [2]byte
+	if _, err := io.ReadFull(wc.br, h[:]); err != nil {
+		wc.t.Fatal("read frame: ", err)
+	}
+	if h[0]&0x80 == 0 || h[1]&0x80 != 0 {
+		wc.t.Fatalf("unexpected frame header %x", h)
+	}
+	n := int(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var l [2]byte
+		_, _ = io.ReadFull(wc.br, l[:])
+		n = int(binary.BigEndian.Uint16(l[:]))
+	case 127:
+		var l [8]byte
+		_, _ = io.ReadFull(wc.br, l[:])
+		n = int(binary.BigEndian.Uint64(l[:]))
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(wc.br, payload); err != nil {
+		wc.t.Fatal("read payload: ", err)
+	}
+	return h[0]&0x40 != 0, int(h[0] & 0x0f), payload
+}
+
+// expectClose 读到close帧, 然后服务端关闭连接
+func (wc *wsClient) expectClose(code int) {
+	_, op, payload := wc.read()
+	if op != OpClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		wc.t.Fatalf("expect close %d, got op %d payload %q", code, op, payload)
+	}
+	if _, err := wc.br.ReadByte(); err != io.EOF {
+		wc.t.Fatalf("expect EOF, got %v", err)
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, reason...)
+}
+
+func expectOnClose(t *testing.T, h *echoHandler, code int) closeInfo {
+	select {
+	case ci := <-h.closes:
+		if ci.code != code {
+			t.Fatalf("OnClose code %d %q, want %d", ci.code, ci.reason, code)
+		}
+		return ci
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+	return closeInfo{}
+}
+
+func TestWSEcho(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{Subprotocols: []string{"chat", "push"}})
+	defer srv.Stop()
+	wc, resp := dial(t, srv, "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Protocol: foo, push\r\n")
+	defer wc.c.Close()
+
+	// RFC 6455 1.3中的例子
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Sec-WebSocket-Protocol") != "push" || resp.Header.Get("Sec-WebSocket-Extensions") != "" {
+		t.Fatalf("negotiation %v", resp.Header)
+	}
+
+	wc.send(true, false, OpText, []byte("hello"))
+	if _, op, p := wc.read(); op != OpText || string(p) != "hello" {
+		t.Fatalf("echo %d %q", op, p)
+	}
+
+	// 126和127两种长度编码
+	for _, n := range []int{300, 70000} {
+		msg := bytes.Repeat([]byte{'x'}, n)
+		wc.send(true, false, OpBinary, msg)
+		if _, op, p := wc.read(); op != OpBinary || !bytes.Equal(p, msg) {
+			t.Fatalf("echo %d bytes: op %d len %d", n, op, len(p))
+		}
+	}
+
+	// 分片消息中间插入ping, 先收到pong
+	wc.send(false, false, OpText, []byte("frag"))
+	wc.send(true, false, OpPing, []byte("p"))
+	wc.send(false, false, OpContinuation, []byte("ment"))
+	wc.send(true, false, OpContinuation, []byte("ed"))
+	if _, op, p := wc.read(); op != OpPong || string(p) != "p" {
+		t.Fatalf("pong %d %q", op, p)
+	}
+	if _, op, p := wc.read(); op != OpText || string(p) != "fragmented" {
+		t.Fatalf("fragmented %d %q", op, p)
+	}
+
+	// 客户端开始关闭握手, 服务端回复相同的状态码
+	wc.send(true, false, OpClose, closePayload(CloseNormal, "bye"))
+	wc.expectClose(CloseNormal)
+	if ci := expectOnClose(t, h, CloseNormal); ci.reason != "bye" {
+		t.Fatalf("close reason %q", ci.reason)
+	}
+}
+
+func TestWSServerClose(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{})
+	defer srv.Stop()
+	wc, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+	defer wc.c.Close()
+
+	wc.send(true, false, OpText, []byte("close"))
+	if _, op, p := wc.read(); op != OpClose || string(p[2:]) != "done" {
+		t.Fatalf("close frame %d %q", op, p)
+	}
+	// 关闭握手期间的消息不再回调
+	wc.send(true, false, OpText, []byte("late"))
+	wc.send(true, false, OpClose, closePayload(CloseNormal, ""))
+	if _, err := wc.br.ReadByte(); err != io.EOF {
+		t.Fatalf("expect EOF, got %v", err)
+	}
+	expectOnClose(t, h, CloseNormal)
+}
+
+func TestWSProtocolErrors(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{MaxMessageSize: 1000})
+	defer srv.Stop()
+
+	cases := []struct {
+		name string
+		send func(wc *wsClient)
+		code int
+	}{
+		{"unmasked", func(wc *wsClient) { _, _ = wc.c.Write([]byte{0x81, 0x02, 'h', 'i'}) }, CloseProtocolError},
+		{"reserved opcode", func(wc *wsClient) { wc.send(true, false, 0x3, nil) }, CloseProtocolError},
+		{"rsv1 without deflate", func(wc *wsClient) { wc.send(true, true, OpText, []byte("x")) }, CloseProtocolError},
+		{"fragmented ping", func(wc *wsClient) { wc.send(false, false, OpPing, nil) }, CloseProtocolError},
+		{"bare continuation", func(wc *wsClient) { wc.send(true, false, OpContinuation, []byte("x")) }, CloseProtocolError},
+		{"interleaved message", func(wc *wsClient) {
+			wc.send(false, false, OpText, []byte("a"))
+			wc.send(true, false, OpText, []byte("b"))
+		}, CloseProtocolError},
+		{"invalid utf-8", func(wc *wsClient) { wc.send(true, false, OpText, []byte{0xff, 0xfe}) }, CloseInvalidPayload},
+		{"too big", func(wc *wsClient) { wc.send(true, false, OpBinary, make([]byte, 1001)) }, CloseMessageTooBig},
+		{"too big fragmented", func(wc *wsClient) {
+			wc.send(false, false, OpBinary, make([]byte, 600))
+			wc.send(true, false, OpContinuation, make([]byte, 600))
+		}, CloseMessageTooBig},
+		{"invalid close code", func(wc *wsClient) { wc.send(true, false, OpClose, closePayload(1005, "")) }, CloseProtocolError},
+	}
+	for _, tc := range cases {
+		wc, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+		tc.send(wc)
+		wc.expectClose(tc.code)
+		expectOnClose(t, h, tc.code)
+		wc.c.Close()
+	}
+}
+
+func TestWSBadHandshake(t *testing.T) {
+	srv, _ := startServer(t, &Upgrader{CheckOrigin: func(r *kimenet_http.Request) bool {
+		return r.Header.Get("Origin") != "http://evil"
+	}})
+	defer srv.Stop()
+
+	cases := []struct {
+		header string
+		code   int
+	}{
+		{"Sec-WebSocket-Version: 8\r\n", 426},
+		{"", 426},
+		{"Sec-WebSocket-Version: 13\r\nOrigin: http://evil\r\n", 403},
+	}
+	for _, tc := range cases {
+		wc, resp := dial(t, srv, tc.header)
+		if resp.StatusCode != tc.code {
+			t.Fatalf("%q: status %d, want %d", tc.header, resp.StatusCode, tc.code)
+		}
+		if tc.code == 426 && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Fatalf("missing Sec-WebSocket-Version %v", resp.Header)
+		}
+		wc.c.Close()
+	}
+
+	// 不是升级请求
+	c, _ := net.Dial("tcp", srv.Addr())
+	defer c.Close()
+	_, _ = c.Write([]byte("GET /ws HTTP/1.1\r\nHost: x\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: "GET"})
+	if err != nil || resp.StatusCode != 400 {
+		t.Fatalf("plain request %v %v", resp, err)
+	}
+}
+
+func TestWSKeepalive(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{PingInterval: 50 * time.Millisecond, PongTimeout: 100 * time.Millisecond})
+	defer srv.Stop()
+	wc, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+	defer wc.c.Close()
+
+	// 回复两次pong, 连接保持
+	for i := 0; i < 2; i++ {
+		if _, op, _ := wc.read(); op != OpPing {
+			t.Fatalf("expect ping, got %d", op)
+		}
+		wc.send(true, false, OpPong, nil)
+	}
+	select {
+	case ci := <-h.closes:
+		t.Fatalf("closed while answering pings: %v", ci)
+	default:
+	}
+
+	// 不再回复, PongTimeout后断开
+	if _, op, _ := wc.read(); op != OpPing {
+		t.Fatalf("expect ping, got %d", op)
+	}
+	if _, err := ioutil.ReadAll(wc.br); err != nil {
+		t.Fatal("expect EOF: ", err)
+	}
+	if ci := expectOnClose(t, h, CloseAbnormal); ci.reason != "ping timeout" {
+		t.Fatalf("close reason %q", ci.reason)
+	}
+}
+
+func TestWSDeflate(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{EnableCompression: true, CompressionThreshold: 16})
+	defer srv.Stop()
+
+	// 限制服务端窗口的提议跳过, 接受后一个
+	wc, resp := dial(t, srv, "Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=10, permessage-deflate; client_max_window_bits\r\n")
+	defer wc.c.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != deflateResponse {
+		t.Fatalf("extensions %q", ext)
+	}
+
+	msg := strings.Repeat("compressible text ", 100)
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	_, _ = fw.Write([]byte(msg))
+	_ = fw.Flush()
+	compressed := buf.Bytes()[:buf.Len()-4]
+
+	// 压缩的消息分两片发送, 只有第一片设置rsv1
+	half := len(compressed) / 2
+	wc.send(false, true, OpText, compressed[:half])
+	wc.send(true, false, OpContinuation, compressed[half:])
+	rsv1, op, p := wc.read()
+	if !rsv1 || op != OpText || len(p) >= len(msg) {
+		t.Fatalf("compressed echo rsv1 %v op %d len %d", rsv1, op, len(p))
+	}
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail)))
+	if got, err := ioutil.ReadAll(fr); err != nil || string(got) != msg {
+		t.Fatalf("decompress echo %v len %d", err, len(got))
+	}
+
+	// 短消息不压缩
+	wc.send(true, false, OpText, []byte("short"))
+	if rsv1, _, p = wc.read(); rsv1 || string(p) != "short" {
+		t.Fatalf("short echo rsv1 %v %q", rsv1, p)
+	}
+
+	// 不合法的压缩数据
+	wc.send(true, true, OpBinary, []byte{0xff, 0xff, 0xff})
+	wc.expectClose(CloseInvalidPayload)
+	expectOnClose(t, h, CloseInvalidPayload)
+}
+
+func TestWSShutdown(t *testing.T) {
+	srv, h := startServer(t, &Upgrader{})
+	wc, _ := dial(t, srv, "Sec-WebSocket-Version: 13\r\n")
+	defer wc.c.Close()
+	wc.send(true, false, OpText, []byte("hi"))
+	wc.read()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := srv.Shutdown(context.Background())
+		done <- err
+	}()
+	_, op, p := wc.read()
+	if op != OpClose || int(binary.BigEndian.Uint16(p)) != CloseGoingAway {
+		t.Fatalf("shutdown close frame %d %q", op, p)
+	}
+	wc.send(true, false, OpClose, p)
+	expectOnClose(t, h, CloseGoingAway)
+	if err := <-done; err != nil {
+		t.Fatal("Shutdown: ", err)
+	}
+}
+
+// nameContext 测试用的Conn.Context, 实现了kimenet.Session
+type nameContext string
+
+func (s nameContext) SessionType() string { return "kimenet_ws.test.name" }
+
+func (s nameContext) MarshalSession() ([]byte, error) { return []byte(s), nil }
+
+// sessionUpgrader 注册过名字的Upgrader, 升级的连接可以迁移
+var sessionUpgrader = &Upgrader{Handler: &echoHandler{}, EnableCompression: true}
+
+func init() {
+	kimenet.RegisterSession("kimenet_ws.test.name", func(conn *kimenet.Connection, data []byte) (kimenet.Session, error) {
+		return nameContext(data), nil
+	})
+	RegisterUpgrader("test.session", sessionUpgrader)
+}
+
+func TestWSSession(t *testing.T) {
+	u := sessionUpgrader
+	c := &Conn{
+		u:           &Upgrader{},
+		req:         &kimenet_http.Request{Method: "GET", Path: "/ws"},
+		subprotocol: "chat",
+		compress:    true,
+		msgOp:       OpText,
+		msg:         []byte("part"),
+	}
+	if c.Migratable() {
+		t.Fatal("upgrader not registered")
+	}
+	c.u = u
+	c.Context = struct{}{}
+	if c.Migratable() {
+		t.Fatal("Context is not a Session")
+	}
+	c.Context = nameContext("alice")
+	if !c.Migratable() {
+		t.Fatal("should be migratable")
+	}
+
+	data, err := c.MarshalSession()
+	if err != nil {
+		t.Fatal("MarshalSession: ", err)
+	}
+	conn, _ := kimenet.NewConnection(-1, "127.0.0.1:1")
+	s, err := kimenet.DecodeSession(conn, c.SessionType(), data)
+	if err != nil {
+		t.Fatal("DecodeSession: ", err)
+	}
+	r := s.(*Conn)
+	if r.conn != conn || r.u != u || r.req.Path != "/ws" || r.subprotocol != "chat" || !r.compress {
+		t.Fatalf("restored %+v", r)
+	}
+	if r.msgOp != OpText || string(r.msg) != "part" || r.Context != nameContext("alice") {
+		t.Fatalf("restored message %d %q %v", r.msgOp, r.msg, r.Context)
+	}
+
+	c.closeSent = true
+	if c.Migratable() {
+		t.Fatal("closing handshake started")
+	}
+}
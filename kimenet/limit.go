@@ -0,0 +1,204 @@
+package kimenet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RejectStats 被拒绝的连接数, 按原因分别统计
+type RejectStats struct {
+	MaxConns      uint64 // 超过Options.MaxConns
+	MaxConnsPerIP uint64 // 超过Options.MaxConnsPerIP
+	RateLimit     uint64 // 超过Options.AcceptRate
+	FdExhausted   uint64 // 进程或系统的文件描述符用完(EMFILE/ENFILE)
+}
+
+// Total 被拒绝的连接总数
+func (rs RejectStats) Total() uint64 {
+	return rs.MaxConns + rs.MaxConnsPerIP + rs.RateLimit + rs.FdExhausted
+}
+
+// connLimiter 限制accept的连接: 全局连接数, 单个IP的连接数, accept速率
+// 多个EventLoop可能同时accept(ReusePort), 连接在各自的EventLoop上关闭, 计数都是并发安全的
+type connLimiter struct {
+	rejects RejectStats // 放在开头, 保证32位平台上64位原子操作的对齐
+
+	maxConns      int32
+	maxConnsPerIP int
+	conns         int32 // 当前accept进来的连接数
+
+	mu    sync.Mutex
+	perIP map[string]int
+
+	// 令牌桶
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newConnLimiter(opts *Options) *connLimiter {
+	l := &connLimiter{
+		maxConns:      int32(opts.MaxConns),
+		maxConnsPerIP: opts.MaxConnsPerIP,
+		rate:          opts.AcceptRate,
+		burst:         float64(opts.AcceptBurst),
+	}
+	if l.maxConnsPerIP > 0 {
+		l.perIP = make(map[string]int)
+	}
+	if l.rate > 0 {
+		if l.burst < 1 {
+			l.burst = l.rate
+			if l.burst < 1 {
+				l.burst = 1
+			}
+		}
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+	return l
+}
+
+// admit 判断是否接受新连接, 接受时计入连接数; 返回拒绝的原因, nil表示接受
+func (l *connLimiter) admit(conn *Connection, sa syscall.Sockaddr, now time.Time) (reason *uint64) {
+	if l.rate > 0 && !l.take(now) {
+		return &l.rejects.RateLimit
+	}
+
+	if n := atomic.AddInt32(&l.conns, 1); l.maxConns > 0 && n > l.maxConns {
+		atomic.AddInt32(&l.conns, -1)
+		return &l.rejects.MaxConns
+	}
+
+	if l.perIP != nil {
+		if ip := sockAddrIP(sa); ip != nil {
+			key := string(net.IP(ip).To16())
+			l.mu.Lock()
+			if l.perIP[key] >= l.maxConnsPerIP {
+				l.mu.Unlock()
+				atomic.AddInt32(&l.conns, -1)
+				return &l.rejects.MaxConnsPerIP
+			}
+			l.perIP[key]++
+			l.mu.Unlock()
+			conn.limitKey = key
+		}
+	}
+	conn.admitted = true
+	return nil
+}
+
+// release 连接关闭时归还计数
+func (l *connLimiter) release(conn *Connection) {
+	if !conn.admitted {
+		return
+	}
+	conn.admitted = false
+	atomic.AddInt32(&l.conns, -1)
+	if conn.limitKey == "" {
+		return
+	}
+	l.mu.Lock()
+	if n := l.perIP[conn.limitKey] - 1; n > 0 {
+		l.perIP[conn.limitKey] = n
+	} else {
+		delete(l.perIP, conn.limitKey)
+	}
+	l.mu.Unlock()
+	conn.limitKey = ""
+}
+
+// adopt 平滑重启时子进程接手的连接直接计入连接数, 不受限制
+func (l *connLimiter) adopt(conn *Connection) {
+	atomic.AddInt32(&l.conns, 1)
+	conn.admitted = true
+	if l.perIP == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(conn.idx)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		key := string(ip.To16())
+		l.mu.Lock()
+		l.perIP[key]++
+		l.mu.Unlock()
+		conn.limitKey = key
+	}
+}
+
+// take 从令牌桶中取一个令牌
+func (l *connLimiter) take(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	l.last = now
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (l *connLimiter) stats() RejectStats {
+	return RejectStats{
+		MaxConns:      atomic.LoadUint64(&l.rejects.MaxConns),
+		MaxConnsPerIP: atomic.LoadUint64(&l.rejects.MaxConnsPerIP),
+		RateLimit:     atomic.LoadUint64(&l.rejects.RateLimit),
+		FdExhausted:   atomic.LoadUint64(&l.rejects.FdExhausted),
+	}
+}
+
+// Rejects 被拒绝的连接数
+func (srv *Server) Rejects() RejectStats {
+	return srv.limiter.stats()
+}
+
+// ActiveConns 当前accept进来还没有关闭的连接数, 不包括Dial发起的连接
+func (srv *Server) ActiveConns() int {
+	return int(atomic.LoadInt32(&srv.limiter.conns))
+}
+
+// reject 拒绝连接: 计数, 尽力发送RejectResponse后关闭
+func (srv *Server) reject(fd int, reason *uint64) {
+	atomic.AddUint64(reason, 1)
+	if resp := srv.opts.RejectResponse; len(resp) > 0 {
+		// 新连接的socket发送缓冲区是空的, 非阻塞写一次即可, 写不完就算了
+		_, _ = syscall.Write(fd, resp)
+	}
+	_ = syscall.Close(fd)
+}
+
+// openReserveFd 预留一个文件描述符, 文件描述符用完时先释放它来accept再关闭新连接
+// 否则监听socket一直可读, 水平触发下EventLoop会空转
+func openReserveFd() int {
+	fd, err := syscall.Open("/dev/null", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		fmt.Println("open reserve fd err: ", err.Error())
+		return -1
+	}
+	return fd
+}
+
+// acceptWithReserve accept返回EMFILE/ENFILE时调用: 释放预留的fd把排队的连接accept出来拒绝掉, 再重新预留
+func (srv *Server) acceptWithReserve(el *EventLoop, fd int) {
+	if el.reserveFd < 0 {
+		el.reserveFd = openReserveFd()
+		return
+	}
+	_ = syscall.Close(el.reserveFd)
+	nfd, _, err := syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+	if err == nil {
+		srv.reject(nfd, &srv.limiter.rejects.FdExhausted)
+	}
+	el.reserveFd = openReserveFd()
+}
@@ -0,0 +1,90 @@
+package kimenet
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func expectRejected(t *testing.T, addr string, resp string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	got, _ := ioutil.ReadAll(c)
+	if string(got) != resp {
+		t.Fatalf("rejected conn got %q, want %q", got, resp)
+	}
+}
+
+func dialOpen(t *testing.T, addr string) net.Conn {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	// 确认连接被接受: echo一次
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Write([]byte("x")); err != nil {
+		t.Fatal("Write: ", err)
+	}
+	b := make([]byte, 1)
+	if _, err = c.Read(b); err != nil {
+		t.Fatal("Read: ", err)
+	}
+	return c
+}
+
+func TestMaxConns(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 8)}
+	srv := startTestServer(t, h, &Options{NumLoops: 2, MaxConns: 2, RejectResponse: []byte("busy\n")})
+	defer srv.Stop()
+	addr := testAddr(srv)
+
+	c1 := dialOpen(t, addr)
+	c2 := dialOpen(t, addr)
+	expectRejected(t, addr, "busy\n")
+	if r := srv.Rejects(); r.MaxConns != 1 || r.Total() != 1 {
+		t.Fatalf("rejects %+v", r)
+	}
+	if n := srv.ActiveConns(); n != 2 {
+		t.Fatalf("active conns %d", n)
+	}
+
+	// 关闭一个连接后可以再接受新连接
+	c1.Close()
+	<-h.closed
+	c3 := dialOpen(t, addr)
+	c2.Close()
+	c3.Close()
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 8)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1, MaxConnsPerIP: 1})
+	defer srv.Stop()
+	addr := testAddr(srv)
+
+	c1 := dialOpen(t, addr)
+	defer c1.Close()
+	expectRejected(t, addr, "")
+	if r := srv.Rejects(); r.MaxConnsPerIP != 1 {
+		t.Fatalf("rejects %+v", r)
+	}
+}
+
+func TestAcceptRate(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 8)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1, AcceptRate: 0.5, AcceptBurst: 1, ListenBacklog: 16})
+	defer srv.Stop()
+	addr := testAddr(srv)
+
+	c1 := dialOpen(t, addr)
+	defer c1.Close()
+	expectRejected(t, addr, "")
+	if r := srv.Rejects(); r.RateLimit != 1 {
+		t.Fatalf("rejects %+v", r)
+	}
+}
@@ -0,0 +1,248 @@
+package kimenet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soReusePort           = 0xf        // SO_REUSEPORT, syscall包里没有定义
+	soAttachReusePortCBPF = 0x33       // SO_ATTACH_REUSEPORT_CBPF
+	bpfMod                = 0x90       // BPF_MOD
+	skfAdOff              = 0xfffff000 // SKF_AD_OFF(-0x1000)
+	skfAdCPU              = 36         // SKF_AD_CPU
+	defaultListenBacklog  = 128
+)
+
+// ListenAddr 解析后的监听地址
+// 支持的格式: "ip:port"(同tcp), "tcp://ip:port", "tcp4://ip:port", "tcp6://[ip]:port",
+// "udp://ip:port", "udp4://ip:port", "udp6://[ip]:port",
+// "unix:///run/app.sock", "unix://@name"(抽象命名空间)
+type ListenAddr struct {
+	Network string // tcp, tcp4, tcp6, udp, udp4, udp6, unix
+	IP      net.IP
+	Port    int
+	Path    string // unix socket路径, 以@开头表示抽象命名空间
+}
+
+func ParseListenAddr(addr string) (la *ListenAddr, err error) {
+	la = new(ListenAddr)
+	la.Network = "tcp"
+	if i := strings.Index(addr, "://"); i >= 0 {
+		la.Network = addr[:i]
+		addr = addr[i+3:]
+	}
+
+	switch la.Network {
+	case "unix":
+		if addr == "" {
+			return nil, fmt.Errorf("empty unix socket path")
+		}
+		la.Path = addr
+		return
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unknown network: %s", la.Network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	la.Port, err = strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if host == "" {
+		if la.only6() {
+			host = "::"
+		} else {
+			host = "0.0.0.0"
+		}
+	}
+	la.IP = net.ParseIP(host)
+	if la.IP == nil {
+		var ia *net.IPAddr
+		ia, err = net.ResolveIPAddr("ip"+la.Network[3:], host)
+		if err != nil {
+			return nil, err
+		}
+		la.IP = ia.IP
+	}
+
+	if la.only4() && la.IP.To4() == nil {
+		return nil, fmt.Errorf("not an ipv4 address: %s", host)
+	}
+	if la.only6() && la.IP.To4() != nil {
+		return nil, fmt.Errorf("not an ipv6 address: %s", host)
+	}
+	return
+}
+
+func (la *ListenAddr) only4() bool {
+	return la.Network == "tcp4" || la.Network == "udp4"
+}
+
+func (la *ListenAddr) only6() bool {
+	return la.Network == "tcp6" || la.Network == "udp6"
+}
+
+// IsPacket 是否是数据报(udp)地址
+func (la *ListenAddr) IsPacket() bool {
+	return strings.HasPrefix(la.Network, "udp")
+}
+
+func (la *ListenAddr) String() string {
+	if la.Network == "unix" {
+		return la.Path
+	}
+	return net.JoinHostPort(la.IP.String(), strconv.Itoa(la.Port))
+}
+
+func (la *ListenAddr) sockaddr() (family int, sa syscall.Sockaddr) {
+	if la.Network == "unix" {
+		return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: la.Path}
+	}
+	if ip4 := la.IP.To4(); ip4 != nil && !la.only6() {
+		sa4 := &syscall.SockaddrInet4{Port: la.Port}
+		copy(sa4.Addr[:], ip4)
+		return syscall.AF_INET, sa4
+	}
+	sa6 := &syscall.SockaddrInet6{Port: la.Port}
+	copy(sa6.Addr[:], la.IP.To16())
+	return syscall.AF_INET6, sa6
+}
+
+// listen 创建非阻塞的监听socket, 端口为0时把内核分配的端口写回la
+// tcp/udp总是设置SO_REUSEPORT: 平滑重启时子进程要绑定同一地址, ReusePort模式下每个EventLoop也要绑定同一地址
+// tcp6/udp6只监听IPv6; 监听IPv6地址时默认双栈, ipv6Only为true时只监听IPv6
+// so中的选项在bind之后listen之前设置, 有选项被拒绝时返回*SockoptError
+func listen(la *ListenAddr, ipv6Only bool, backlog int, so *SocketOptions) (socketFd int, err error) {
+	family, sa := la.sockaddr()
+	sotype := syscall.SOCK_STREAM
+	if la.IsPacket() {
+		sotype = syscall.SOCK_DGRAM
+	}
+
+	// 1. create socketfd
+	socketFd, err = syscall.Socket(family, sotype|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil || socketFd < 0 {
+		err = fmt.Errorf("syscall.Socket ERR")
+		return
+	}
+
+	// 2. bind addr and port
+	switch family {
+	case syscall.AF_UNIX:
+		// 清理上次进程退出留下的socket文件
+		if !strings.HasPrefix(la.Path, "@") {
+			if fi, e := os.Stat(la.Path); e == nil && fi.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(la.Path)
+			}
+		}
+	default:
+		if family == syscall.AF_INET6 {
+			v6only := 0
+			if ipv6Only || la.only6() {
+				v6only = 1
+			}
+			err = syscall.SetsockoptInt(socketFd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only)
+			if err != nil {
+				_ = syscall.Close(socketFd)
+				return
+			}
+		}
+
+		err = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if err != nil {
+			_ = syscall.Close(socketFd)
+			return
+		}
+		err = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, soReusePort, 1)
+		if err != nil {
+			_ = syscall.Close(socketFd)
+			return
+		}
+	}
+
+	err = syscall.Bind(socketFd, sa)
+	if err != nil {
+		_ = syscall.Close(socketFd)
+		err = fmt.Errorf("socket bind err: %s", err.Error())
+		return
+	}
+
+	err = so.apply(socketFd, sockoptTarget{family: family, stream: sotype == syscall.SOCK_STREAM, listener: true})
+	if err != nil {
+		_ = syscall.Close(socketFd)
+		return
+	}
+
+	// 3. listen, 数据报socket不需要
+	if sotype == syscall.SOCK_STREAM {
+		if backlog <= 0 {
+			backlog = defaultListenBacklog
+		}
+		err = syscall.Listen(socketFd, backlog)
+		if err != nil {
+			_ = syscall.Close(socketFd)
+			err = fmt.Errorf("socket listen err: %s", err)
+			return
+		}
+	}
+
+	la.fillPort(socketFd)
+	return
+}
+
+// fillPort 端口为0时由内核分配, 从socket取回实际端口
+func (la *ListenAddr) fillPort(fd int) {
+	if la.Network == "unix" || la.Port != 0 {
+		return
+	}
+	if lsa, e := syscall.Getsockname(fd); e == nil {
+		switch lsa := lsa.(type) {
+		case *syscall.SockaddrInet4:
+			la.Port = lsa.Port
+		case *syscall.SockaddrInet6:
+			la.Port = lsa.Port
+		}
+	}
+}
+
+// attachCPUSteering 给SO_REUSEPORT组挂载CBPF程序: 返回 当前CPU % n, 内核按返回值选择组内第几个socket
+// 配合每个EventLoop绑定到对应CPU, 新连接由哪个CPU处理软中断就交给哪个EventLoop
+func attachCPUSteering(fd int, n int) (err error) {
+	filter := []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: uint32(skfAdOff + skfAdCPU)},
+		{Code: syscall.BPF_ALU | bpfMod | syscall.BPF_K, K: uint32(n)},
+		{Code: syscall.BPF_RET | syscall.BPF_A},
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soAttachReusePortCBPF,
+		uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0)
+	if errno != 0 {
+		err = fmt.Errorf("attach reuseport cbpf err: %s", errno.Error())
+	}
+	return
+}
+
+// bindCPU 把当前线程绑定到指定CPU, 调用前需要 runtime.LockOSThread
+func bindCPU(cpu int) (err error) {
+	var mask [1024 / 64]uint64
+	mask[cpu/64] |= 1 << (uint(cpu) % 64)
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		err = errno
+	}
+	return
+}
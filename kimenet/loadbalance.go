@@ -0,0 +1,53 @@
+package kimenet
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+	"syscall"
+)
+
+// LoadBalance 新连接分配到子EventLoop的策略
+type LoadBalance int
+
+const (
+	RoundRobin       LoadBalance = iota // 轮询
+	LeastConnections                    // 连接数最少
+	SourceAddrHash                      // 按对端IP哈希, 同一客户端固定到同一个EventLoop
+)
+
+func (srv *Server) pickLoop(sa syscall.Sockaddr) *EventLoop {
+	n := len(srv.loops)
+	if n == 1 {
+		return srv.loops[0]
+	}
+
+	switch srv.opts.LoadBalance {
+	case LeastConnections:
+		el := srv.loops[0]
+		for _, l := range srv.loops[1:] {
+			if l.ConnCount() < el.ConnCount() {
+				el = l
+			}
+		}
+		return el
+	case SourceAddrHash:
+		if ip := sockAddrIP(sa); ip != nil {
+			h := fnv.New32a()
+			_, _ = h.Write(ip)
+			return srv.loops[h.Sum32()%uint32(n)]
+		}
+	}
+
+	idx := atomic.AddUint32(&srv.nextLoop, 1) - 1
+	return srv.loops[idx%uint32(n)]
+}
+
+func sockAddrIP(sa syscall.Sockaddr) []byte {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Addr[:]
+	case *syscall.SockaddrInet6:
+		return sa.Addr[:]
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package kimenet
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Handler回调, 用于统计回调耗时
+const (
+	cbOnOpen = iota
+	cbOnData
+	cbOnMessage
+	cbOnWritable
+	cbOnClose
+	numCallbacks
+)
+
+var callbackNames = [numCallbacks]string{"OnOpen", "OnData", "OnMessage", "OnWritable", "OnClose"}
+
+// 连接关闭的原因, 见closeReason
+const (
+	closeLocal = iota
+	closeEOF
+	closeSocketError
+	closeIdleTimeout
+	closeReadTimeout
+	closeWriteTimeout
+	closeConnectTimeout
+	closeTLSHandshakeTimeout
+	closeProxyTimeout
+	closeProxyError
+	closeCodecError
+	closeShutdown
+	closeKilled
+	closeOther
+	numCloseReasons
+)
+
+var closeReasonNames = [numCloseReasons]string{
+	"local", "eof", "socket_error", "idle_timeout", "read_timeout", "write_timeout", "connect_timeout",
+	"tls_handshake_timeout", "proxy_timeout", "proxy_error", "codec_error", "shutdown", "killed", "error",
+}
+
+// closeReason 按OnClose的err分类
+func closeReason(err error) int {
+	switch err {
+	case nil:
+		return closeLocal
+	case io.EOF:
+		return closeEOF
+	case ErrIdleTimeout:
+		return closeIdleTimeout
+	case ErrReadTimeout:
+		return closeReadTimeout
+	case ErrWriteTimeout:
+		return closeWriteTimeout
+	case ErrConnectTimeout:
+		return closeConnectTimeout
+	case ErrTLSHandshakeTimeout:
+		return closeTLSHandshakeTimeout
+	case ErrProxyTimeout:
+		return closeProxyTimeout
+	case ErrServerShutdown:
+		return closeShutdown
+	case ErrConnKilled:
+		return closeKilled
+	}
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+		return closeSocketError
+	case errors.Is(err, ErrProxyHeader) || errors.Is(err, ErrProxyUntrusted):
+		return closeProxyError
+	case errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrInvalidFrame):
+		return closeCodecError
+	}
+	return closeOther
+}
+
+// 直方图的桶, 上界
+var (
+	latencyBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1} // 秒
+	eventsBuckets  = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+)
+
+// histogram 只由一个EventLoop协程写, 其他协程可以同时读
+// 观测值是整数(纳秒、个数), 导出时乘以scale
+type histogram struct {
+	sum    uint64
+	bounds []uint64
+	counts []uint64 // 每个桶自己的数量, 不累计
+	scale  float64
+}
+
+func newHistogram(bounds []float64, scale float64) *histogram {
+	h := &histogram{
+		bounds: make([]uint64, len(bounds)),
+		counts: make([]uint64, len(bounds)+1), // 最后一个是+Inf
+		scale:  scale,
+	}
+	for i, b := range bounds {
+		h.bounds[i] = uint64(math.Round(b / scale))
+	}
+	return h
+}
+
+func (h *histogram) observe(v uint64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, v)
+}
+
+func (h *histogram) snapshot() (s HistogramSnapshot) {
+	s.Bounds = make([]float64, len(h.bounds))
+	s.Counts = make([]uint64, len(h.bounds))
+	var n uint64
+	for i, b := range h.bounds {
+		s.Bounds[i] = float64(b) * h.scale
+		n += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = n
+	}
+	// 总数按桶相加, 和同时进行的observe竞争时也不会小于最后一个桶
+	s.Count = n + atomic.LoadUint64(&h.counts[len(h.bounds)])
+	s.Sum = float64(atomic.LoadUint64(&h.sum)) * h.scale
+	return
+}
+
+// loopMetrics 一个EventLoop的统计, 只在本EventLoop协程中更新
+type loopMetrics struct {
+	accepts      uint64
+	acceptErrors uint64
+	pollErrors   uint64
+	wakeups      uint64
+	bytesIn      uint64
+	bytesOut     uint64
+	closes       [numCloseReasons]uint64
+
+	events    *histogram // 每次epoll_wait返回的事件数
+	iteration *histogram // 每轮事件循环的耗时
+	handler   [numCallbacks]*histogram
+}
+
+func newLoopMetrics() *loopMetrics {
+	m := &loopMetrics{
+		events:    newHistogram(eventsBuckets, 1),
+		iteration: newHistogram(latencyBuckets, 1e-9),
+	}
+	for i := range m.handler {
+		m.handler[i] = newHistogram(latencyBuckets, 1e-9)
+	}
+	return m
+}
+
+// countRead 记录从socket读到的字节数
+func (el *EventLoop) countRead(conn *Connection, n int) {
+	conn.bytesIn += uint64(n)
+	atomic.AddUint64(&el.metrics.bytesIn, uint64(n))
+}
+
+// countWrite 记录写到socket的字节数
+func (el *EventLoop) countWrite(conn *Connection, n int) {
+	conn.bytesOut += uint64(n)
+	atomic.AddUint64(&el.metrics.bytesOut, uint64(n))
+}
+
+// handlerStart 开始统计一次Handler回调的耗时, 没有打开Options.HandlerTiming时返回零值
+func (el *EventLoop) handlerStart() (t time.Time) {
+	if el.serv.opts.HandlerTiming {
+		t = time.Now()
+	}
+	return
+}
+
+func (el *EventLoop) handlerDone(cb int, start time.Time) {
+	if !start.IsZero() {
+		el.metrics.handler[cb].observe(uint64(time.Since(start)))
+	}
+}
+
+// callOpen 回调OnOpen
+func (el *EventLoop) callOpen(conn *Connection) {
+	start := el.handlerStart()
+	el.serv.handler.OnOpen(conn)
+	el.handlerDone(cbOnOpen, start)
+}
+
+// callClose 记录关闭原因并回调OnClose
+func (el *EventLoop) callClose(h Handler, conn *Connection, err error) {
+	atomic.AddUint64(&el.metrics.closes[closeReason(err)], 1)
+	start := el.handlerStart()
+	h.OnClose(conn, err)
+	el.handlerDone(cbOnClose, start)
+}
+
+// HistogramSnapshot 直方图的快照, 和Prometheus一样每个桶的数量是累计的(<=上界)
+type HistogramSnapshot struct {
+	Bounds []float64 // 每个桶的上界, 不包括+Inf
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// LoopMetrics 一个EventLoop的统计
+type LoopMetrics struct {
+	Loop         int // EventLoop的序号, 单独负责accept的主EventLoop为-1
+	Conns        int // 当前的连接数
+	Accepts      uint64
+	AcceptErrors uint64
+	PollErrors   uint64
+	Wakeups      uint64 // epoll_wait返回的次数
+	BytesIn      uint64
+	BytesOut     uint64
+
+	EventsPerWakeup  HistogramSnapshot
+	IterationSeconds HistogramSnapshot // 每轮事件循环处理事件、定时器和任务的耗时
+}
+
+// MetricsSnapshot 服务器的统计, 计数从NewServer开始累计
+type MetricsSnapshot struct {
+	Accepts      uint64 // accept成功的连接数, 包括之后被拒绝的
+	AcceptErrors uint64
+	Rejects      RejectStats
+	ActiveConns  int // 包括Dial发起的连接
+	BytesIn      uint64
+	BytesOut     uint64
+
+	Closes         map[string]uint64            // 按原因统计的连接关闭次数, 例如"eof"、"idle_timeout"
+	HandlerSeconds map[string]HistogramSnapshot // 按回调统计的耗时, 打开Options.HandlerTiming时才有数据
+	SockoptErrors  map[string]uint64            // 按选项统计连接上被拒绝的socket选项, 见Server.SockoptErrors
+
+	Loops []LoopMetrics
+}
+
+// Metrics 服务器的统计快照, 可以在任意协程调用
+func (srv *Server) Metrics() (s MetricsSnapshot) {
+	s.Rejects = srv.Rejects()
+	s.SockoptErrors = srv.SockoptErrors()
+	s.Closes = make(map[string]uint64, numCloseReasons)
+	for _, name := range closeReasonNames {
+		s.Closes[name] = 0
+	}
+	handler := make([]HistogramSnapshot, numCallbacks)
+	for _, el := range srv.allLoops() {
+		m := el.metrics
+		lm := LoopMetrics{
+			Loop:             el.idx,
+			Conns:            el.ConnCount(),
+			Accepts:          atomic.LoadUint64(&m.accepts),
+			AcceptErrors:     atomic.LoadUint64(&m.acceptErrors),
+			PollErrors:       atomic.LoadUint64(&m.pollErrors),
+			Wakeups:          atomic.LoadUint64(&m.wakeups),
+			BytesIn:          atomic.LoadUint64(&m.bytesIn),
+			BytesOut:         atomic.LoadUint64(&m.bytesOut),
+			EventsPerWakeup:  m.events.snapshot(),
+			IterationSeconds: m.iteration.snapshot(),
+		}
+		s.Loops = append(s.Loops, lm)
+		s.Accepts += lm.Accepts
+		s.AcceptErrors += lm.AcceptErrors
+		s.ActiveConns += lm.Conns
+		s.BytesIn += lm.BytesIn
+		s.BytesOut += lm.BytesOut
+		for i, name := range closeReasonNames {
+			s.Closes[name] += atomic.LoadUint64(&m.closes[i])
+		}
+		for i, h := range m.handler {
+			handler[i] = mergeHistogram(handler[i], h.snapshot())
+		}
+	}
+	s.HandlerSeconds = make(map[string]HistogramSnapshot, numCallbacks)
+	for i, name := range callbackNames {
+		s.HandlerSeconds[name] = handler[i]
+	}
+	return
+}
+
+func mergeHistogram(a, b HistogramSnapshot) HistogramSnapshot {
+	if a.Bounds == nil {
+		return b
+	}
+	for i := range a.Counts {
+		a.Counts[i] += b.Counts[i]
+	}
+	a.Count += b.Count
+	a.Sum += b.Sum
+	return a
+}
+
+// WriteMetrics 按Prometheus文本格式(text/plain; version=0.0.4)写出统计
+func (srv *Server) WriteMetrics(w io.Writer) error {
+	s := srv.Metrics()
+	bw := bufio.NewWriter(w)
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	perLoop := func(name, typ, help string, value func(lm *LoopMetrics) uint64) {
+		header(name, typ, help)
+		for i := range s.Loops {
+			fmt.Fprintf(bw, "%s{loop=\"%s\"} %d\n", name, loopLabel(s.Loops[i].Loop), value(&s.Loops[i]))
+		}
+	}
+
+	perLoop("kimenet_accepts_total", "counter", "Connections accepted, including rejected ones.",
+		func(lm *LoopMetrics) uint64 { return lm.Accepts })
+	perLoop("kimenet_accept_errors_total", "counter", "Failed accept calls.",
+		func(lm *LoopMetrics) uint64 { return lm.AcceptErrors })
+
+	header("kimenet_rejects_total", "counter", "Accepted connections closed by connection limits.")
+	rejects := []struct {
+		reason string
+		n      uint64
+	}{
+		{"max_conns", s.Rejects.MaxConns},
+		{"max_conns_per_ip", s.Rejects.MaxConnsPerIP},
+		{"rate_limit", s.Rejects.RateLimit},
+		{"fd_exhausted", s.Rejects.FdExhausted},
+	}
+	for _, r := range rejects {
+		fmt.Fprintf(bw, "kimenet_rejects_total{reason=\"%s\"} %d\n", r.reason, r.n)
+	}
+
+	perLoop("kimenet_connections", "gauge", "Open connections.",
+		func(lm *LoopMetrics) uint64 { return uint64(lm.Conns) })
+	perLoop("kimenet_read_bytes_total", "counter", "Bytes read from sockets.",
+		func(lm *LoopMetrics) uint64 { return lm.BytesIn })
+	perLoop("kimenet_written_bytes_total", "counter", "Bytes written to sockets.",
+		func(lm *LoopMetrics) uint64 { return lm.BytesOut })
+	perLoop("kimenet_epoll_wakeups_total", "counter", "epoll_wait returns.",
+		func(lm *LoopMetrics) uint64 { return lm.Wakeups })
+	perLoop("kimenet_epoll_errors_total", "counter", "Failed epoll_wait calls.",
+		func(lm *LoopMetrics) uint64 { return lm.PollErrors })
+
+	header("kimenet_epoll_events", "histogram", "Events returned by each epoll_wait.")
+	for i := range s.Loops {
+		writeHistogram(bw, "kimenet_epoll_events", "loop=\""+loopLabel(s.Loops[i].Loop)+"\"", s.Loops[i].EventsPerWakeup)
+	}
+	header("kimenet_loop_iteration_seconds", "histogram", "Time spent handling events, timers and tasks in one loop iteration.")
+	for i := range s.Loops {
+		writeHistogram(bw, "kimenet_loop_iteration_seconds", "loop=\""+loopLabel(s.Loops[i].Loop)+"\"", s.Loops[i].IterationSeconds)
+	}
+
+	header("kimenet_closes_total", "counter", "Closed connections by reason.")
+	for _, name := range closeReasonNames {
+		fmt.Fprintf(bw, "kimenet_closes_total{reason=\"%s\"} %d\n", name, s.Closes[name])
+	}
+
+	header("kimenet_sockopt_errors_total", "counter", "Socket options rejected by the kernel on connections.")
+	options := make([]string, 0, len(s.SockoptErrors))
+	for name := range s.SockoptErrors {
+		options = append(options, name)
+	}
+	sort.Strings(options)
+	for _, name := range options {
+		fmt.Fprintf(bw, "kimenet_sockopt_errors_total{option=\"%s\"} %d\n", name, s.SockoptErrors[name])
+	}
+
+	if srv.opts.HandlerTiming {
+		header("kimenet_handler_duration_seconds", "histogram", "Handler callback duration.")
+		for _, name := range callbackNames {
+			writeHistogram(bw, "kimenet_handler_duration_seconds", "callback=\""+name+"\"", s.HandlerSeconds[name])
+		}
+	}
+	return bw.Flush()
+}
+
+func loopLabel(idx int) string {
+	if idx < 0 {
+		return "main"
+	}
+	return strconv.Itoa(idx)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h HistogramSnapshot) {
+	for i, b := range h.Bounds {
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(b, 'g', -1, 64), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.Count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.Count)
+}
+
+// MetricsHandler 以Prometheus文本格式输出统计的http.Handler, 可以挂到已有的net/http服务上
+func (srv *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = srv.WriteMetrics(w)
+	})
+}
+
+// listenMetrics 监听Options.MetricsAddr; 设置SO_REUSEPORT, 平滑重启时子进程可以在父进程退出前监听同一个地址
+func (srv *Server) listenMetrics() (err error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	srv.metricsLn, err = lc.Listen(context.Background(), "tcp", srv.opts.MetricsAddr)
+	if err != nil {
+		err = fmt.Errorf("metrics listen: %w", err)
+	}
+	return
+}
+
+// serveMetrics 在metricsLn上提供/metrics, Start返回时关闭
+func (srv *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", srv.MetricsHandler())
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		_ = hs.Serve(srv.metricsLn)
+	}()
+	go func() {
+		<-srv.done
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = hs.Shutdown(ctx)
+	}()
+}
+
+// MetricsAddr Options.MetricsAddr实际监听的地址, 没有设置时为空
+func (srv *Server) MetricsAddr() string {
+	if srv.metricsLn == nil {
+		return ""
+	}
+	return srv.metricsLn.Addr().String()
+}
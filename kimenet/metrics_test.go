@@ -0,0 +1,108 @@
+package kimenet
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{.001, .01}, 1e-9)
+	for _, d := range []time.Duration{time.Millisecond, 2 * time.Millisecond, time.Second} {
+		h.observe(uint64(d))
+	}
+	s := h.snapshot()
+	if s.Count != 3 || s.Counts[0] != 1 || s.Counts[1] != 2 || s.Bounds[1] != .01 || s.Sum < 1.003 || s.Sum > 1.0031 {
+		t.Fatalf("snapshot %+v", s)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	cases := map[error]string{
+		nil:                                  "local",
+		io.EOF:                               "eof",
+		syscall.ECONNRESET:                   "socket_error",
+		ErrIdleTimeout:                       "idle_timeout",
+		ErrWriteTimeout:                      "write_timeout",
+		ErrConnKilled:                        "killed",
+		fmt.Errorf("%w: v1", ErrProxyHeader): "proxy_error",
+		ErrFrameTooLarge:                     "codec_error",
+		fmt.Errorf("tls handshake: bad"):     "error",
+	}
+	for err, want := range cases {
+		if got := closeReasonNames[closeReason(err)]; got != want {
+			t.Fatalf("closeReason(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 2)}
+	srv := startTestServer(t, h, &Options{
+		NumLoops:      2,
+		IdleTimeout:   100 * time.Millisecond,
+		HandlerTiming: true,
+		MetricsAddr:   "127.0.0.1:0",
+	})
+	defer srv.Stop()
+
+	// 一个连接对端关闭, 一个连接空闲超时
+	testEcho(t, "tcp", srv.Addr(), []byte("hello"))
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-h.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not closed")
+		}
+	}
+
+	m := srv.Metrics()
+	if m.Accepts != 2 || m.ActiveConns != 0 || m.BytesIn != 5 || m.BytesOut != 5 || len(m.Loops) != 3 {
+		t.Fatalf("metrics %+v", m)
+	}
+	if m.Closes["eof"] != 1 || m.Closes["idle_timeout"] != 1 {
+		t.Fatalf("closes %v", m.Closes)
+	}
+	if m.HandlerSeconds["OnData"].Count != 1 || m.HandlerSeconds["OnClose"].Count != 2 {
+		t.Fatalf("handler %+v", m.HandlerSeconds)
+	}
+	for _, lm := range m.Loops {
+		if lm.Wakeups == 0 || lm.EventsPerWakeup.Count != lm.Wakeups || lm.IterationSeconds.Count == 0 {
+			t.Fatalf("loop %+v", lm)
+		}
+	}
+
+	resp, err := http.Get("http://" + srv.MetricsAddr() + "/metrics")
+	if err != nil {
+		t.Fatal("GET /metrics: ", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		`kimenet_accepts_total{loop="main"} 2`,
+		`kimenet_rejects_total{reason="max_conns"} 0`,
+		`kimenet_connections{loop="0"} 0`,
+		`kimenet_closes_total{reason="idle_timeout"} 1`,
+		`# TYPE kimenet_loop_iteration_seconds histogram`,
+		`kimenet_handler_duration_seconds_count{callback="OnData"} 1`,
+		`kimenet_epoll_events_bucket{loop="1",le="+Inf"}`,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Fatalf("missing %q in\n%s", line, body)
+		}
+	}
+}
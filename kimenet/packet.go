@@ -0,0 +1,274 @@
+package kimenet
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	defaultPacketBatch   = 32
+	defaultMaxPacketSize = 8192
+	maxPacketQueue       = 1024 // 每个PacketConn最多缓存的待发送数据报
+	maxPacketReadRounds  = 8    // 每次读事件最多调用recvmmsg的次数, 避免一直处理udp饿死其他fd
+)
+
+var (
+	ErrPacketQueueFull = errors.New("kimenet: packet send queue is full")
+)
+
+// PacketHandler 数据报(udp)服务的Handler需要额外实现该接口
+type PacketHandler interface {
+	// 收到一个数据报; data只在回调期间有效, 需要保留时自己拷贝
+	OnPacket(pc *PacketConn, data []byte, from syscall.Sockaddr)
+}
+
+// PacketConn EventLoop上的udp socket
+type PacketConn struct {
+	Fd int
+
+	loop    *EventLoop
+	handler PacketHandler
+	writing bool
+	reading bool // 在handleRead中, 回调结束后统一发送
+
+	// recvmmsg 用的缓冲区, 创建时分配好重复使用
+	rmsgs  []mmsghdr
+	riovs  []syscall.Iovec
+	rnames []syscall.RawSockaddrAny
+	rbufs  [][]byte
+
+	// sendmmsg 用的缓冲区
+	out    []outPacket
+	smsgs  []mmsghdr
+	siovs  []syscall.Iovec
+	snames []syscall.RawSockaddrAny
+}
+
+type outPacket struct {
+	data    []byte
+	name    syscall.RawSockaddrAny
+	namelen uint32
+}
+
+type mmsghdr struct {
+	Hdr syscall.Msghdr
+	Len uint32
+}
+
+func newPacketConn(el *EventLoop, fd int, handler PacketHandler, batch int, maxSize int) *PacketConn {
+	if batch <= 0 {
+		batch = defaultPacketBatch
+	}
+	if maxSize <= 0 {
+		maxSize = defaultMaxPacketSize
+	}
+
+	pc := &PacketConn{
+		Fd:      fd,
+		loop:    el,
+		handler: handler,
+		rmsgs:   make([]mmsghdr, batch),
+		riovs:   make([]syscall.Iovec, batch),
+		rnames:  make([]syscall.RawSockaddrAny, batch),
+		rbufs:   make([][]byte, batch),
+		smsgs:   make([]mmsghdr, batch),
+		siovs:   make([]syscall.Iovec, batch),
+		snames:  make([]syscall.RawSockaddrAny, batch),
+	}
+
+	buf := make([]byte, batch*maxSize)
+	for i := 0; i < batch; i++ {
+		pc.rbufs[i] = buf[i*maxSize : (i+1)*maxSize]
+		pc.riovs[i].Base = &pc.rbufs[i][0]
+		pc.riovs[i].SetLen(maxSize)
+		pc.rmsgs[i].Hdr.Name = (*byte)(unsafe.Pointer(&pc.rnames[i]))
+		pc.rmsgs[i].Hdr.Iov = &pc.riovs[i]
+		pc.rmsgs[i].Hdr.Iovlen = 1
+
+		pc.smsgs[i].Hdr.Name = (*byte)(unsafe.Pointer(&pc.snames[i]))
+		pc.smsgs[i].Hdr.Iov = &pc.siovs[i]
+		pc.smsgs[i].Hdr.Iovlen = 1
+	}
+	return pc
+}
+
+// Loop PacketConn所属的EventLoop
+func (pc *PacketConn) Loop() *EventLoop {
+	return pc.loop
+}
+
+// WriteTo 把数据报放入发送队列, 用sendmmsg批量发送: 在OnPacket中调用时在本轮收取结束后发送,
+// 在定时器、Execute的任务等其他地方调用时监听写事件, 在socket可写时发送
+// 只能在EventLoop协程中调用
+func (pc *PacketConn) WriteTo(b []byte, to syscall.Sockaddr) (err error) {
+	if len(pc.out) >= maxPacketQueue {
+		return ErrPacketQueueFull
+	}
+	p := outPacket{data: make([]byte, len(b))}
+	copy(p.data, b)
+	p.namelen, err = sockaddrToRaw(to, &p.name)
+	if err != nil {
+		return
+	}
+	pc.out = append(pc.out, p)
+	if !pc.reading && !pc.writing {
+		pc.writing = true
+		_ = pc.loop.ModReadWrite(pc.Fd)
+	}
+	return
+}
+
+func (pc *PacketConn) handleRead() (err error) {
+	pc.reading = true
+	for round := 0; round < maxPacketReadRounds; round++ {
+		for i := range pc.rmsgs {
+			pc.rmsgs[i].Hdr.Namelen = syscall.SizeofSockaddrAny
+			pc.rmsgs[i].Hdr.Flags = 0
+			pc.rmsgs[i].Len = 0
+		}
+
+		var n int
+		n, err = mmsg(syscall.SYS_RECVMMSG, pc.Fd, pc.rmsgs)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				err = nil
+			} else {
+				fmt.Println("recvmmsg err: ", err.Error())
+			}
+			break
+		}
+
+		for i := 0; i < n; i++ {
+			m := &pc.rmsgs[i]
+			if m.Hdr.Flags&syscall.MSG_TRUNC != 0 {
+				// 超过MaxPacketSize的数据报已经被截断, 直接丢弃
+				continue
+			}
+			atomic.AddUint64(&pc.loop.metrics.bytesIn, uint64(m.Len))
+			from := rawToSockaddr(&pc.rnames[i])
+			pc.handler.OnPacket(pc, pc.rbufs[i][:m.Len], from)
+		}
+
+		if n < len(pc.rmsgs) {
+			break
+		}
+	}
+
+	pc.reading = false
+	pc.flush()
+	return
+}
+
+func (pc *PacketConn) handleWrite() (err error) {
+	if pc.writing {
+		pc.flush()
+	}
+	return
+}
+
+// flush 用sendmmsg发送队列中的数据报, socket发送缓冲区满时监听写事件
+func (pc *PacketConn) flush() {
+	sent := 0
+	for sent < len(pc.out) {
+		batch := pc.out[sent:]
+		if len(batch) > len(pc.smsgs) {
+			batch = batch[:len(pc.smsgs)]
+		}
+
+		for i := range batch {
+			p := &batch[i]
+			pc.snames[i] = p.name
+			m := &pc.smsgs[i]
+			m.Hdr.Namelen = p.namelen
+			m.Len = 0
+			if len(p.data) > 0 {
+				pc.siovs[i].Base = &p.data[0]
+			} else {
+				pc.siovs[i].Base = nil
+			}
+			pc.siovs[i].SetLen(len(p.data))
+		}
+
+		n, err := mmsg(sysSendmmsg, pc.Fd, pc.smsgs[:len(batch)])
+		if err != nil {
+			if err == syscall.EAGAIN {
+				break
+			}
+			if err == syscall.EINTR {
+				continue
+			}
+			// 第一个数据报发送失败(例如EMSGSIZE), 丢弃它继续发送后面的
+			fmt.Println("sendmmsg err: ", err.Error())
+			n = 1
+		}
+		sent += n
+	}
+
+	for i := 0; i < sent; i++ {
+		atomic.AddUint64(&pc.loop.metrics.bytesOut, uint64(len(pc.out[i].data)))
+		pc.out[i] = outPacket{}
+	}
+	pc.out = pc.out[:copy(pc.out, pc.out[sent:])]
+
+	if len(pc.out) > 0 && !pc.writing {
+		pc.writing = true
+		_ = pc.loop.ModReadWrite(pc.Fd)
+	} else if len(pc.out) == 0 && pc.writing {
+		pc.writing = false
+		_ = pc.loop.ModRead(pc.Fd)
+	}
+}
+
+func mmsg(trap uintptr, fd int, msgs []mmsghdr) (n int, err error) {
+	r, _, errno := syscall.Syscall6(trap, uintptr(fd), uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)),
+		syscall.MSG_DONTWAIT, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func rawToSockaddr(rsa *syscall.RawSockaddrAny) syscall.Sockaddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		p := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet4{Addr: p.Addr}
+		pp := (*[2]byte)(unsafe.Pointer(&p.Port))
+		sa.Port = int(pp[0])<<8 + int(pp[1])
+		return sa
+	case syscall.AF_INET6:
+		p := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		sa := &syscall.SockaddrInet6{Addr: p.Addr, ZoneId: p.Scope_id}
+		pp := (*[2]byte)(unsafe.Pointer(&p.Port))
+		sa.Port = int(pp[0])<<8 + int(pp[1])
+		return sa
+	}
+	return nil
+}
+
+func sockaddrToRaw(sa syscall.Sockaddr, rsa *syscall.RawSockaddrAny) (namelen uint32, err error) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		p := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p.Family = syscall.AF_INET
+		pp := (*[2]byte)(unsafe.Pointer(&p.Port))
+		pp[0] = byte(sa.Port >> 8)
+		pp[1] = byte(sa.Port)
+		p.Addr = sa.Addr
+		return syscall.SizeofSockaddrInet4, nil
+	case *syscall.SockaddrInet6:
+		p := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p.Family = syscall.AF_INET6
+		pp := (*[2]byte)(unsafe.Pointer(&p.Port))
+		pp[0] = byte(sa.Port >> 8)
+		pp[1] = byte(sa.Port)
+		p.Flowinfo = 0
+		p.Addr = sa.Addr
+		p.Scope_id = sa.ZoneId
+		return syscall.SizeofSockaddrInet6, nil
+	}
+	return 0, fmt.Errorf("unsupported sockaddr: %T", sa)
+}
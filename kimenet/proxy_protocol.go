@@ -0,0 +1,411 @@
+package kimenet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PROXY protocol(v1文本和v2二进制), 见haproxy的proxy-protocol.txt
+// 负载均衡在连接开头发送真实的客户端地址, 解析后替换连接的RemoteAddr
+
+var (
+	ErrProxyHeader    = errors.New("kimenet: invalid proxy protocol header")
+	ErrProxyUntrusted = errors.New("kimenet: proxy protocol header from untrusted source")
+	ErrProxyTimeout   = errors.New("kimenet: proxy protocol header timeout")
+)
+
+// v2的TLV类型
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02 // 客户端请求的主机名(SNI)
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20 // 客户端到负载均衡的TLS信息, 值中还有子TLV
+	ProxyTLVNetNS     = 0x30
+)
+
+const (
+	proxyV1MaxLen        = 107 // 包括结尾的CRLF
+	proxyV2HeaderLen     = 16
+	defaultProxyTimeout  = 5 * time.Second
+	proxyV1Prefix        = "PROXY "
+	proxyV2Signature     = "\r\n\r\n\x00\r\nQUIT\n"
+	proxyV2CmdLocal      = 0x0
+	proxyV2CmdProxy      = 0x1
+	proxyV2AddrLenInet   = 12
+	proxyV2AddrLenInet6  = 36
+	proxyV2AddrLenUnix   = 216
+	proxyV2UnixPathBytes = 108
+)
+
+// 连接上PROXY头部的处理状态
+const (
+	proxyNone      = iota // 不需要处理, 或者已经处理完
+	proxyRequired         // 可信来源, 必须先发送头部, 解析完之后再TLS握手/回调OnOpen
+	proxyForbidden        // 不可信来源, 已经正常打开, 开头是PROXY头部时拒绝
+)
+
+// ProxyTLV v2头部中的扩展字段
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader 连接开头的PROXY头部
+type ProxyHeader struct {
+	Version int // 1或2
+
+	// v2的LOCAL命令或v1的UNKNOWN, 没有客户端地址(例如负载均衡的健康检查), 连接的RemoteAddr不变
+	Local bool
+
+	// 客户端连接的协议: tcp4, tcp6, udp4, udp6, unix, unixgram; 不知道时为空
+	Network string
+
+	// 客户端地址和它连接的地址, ip:port或unix路径
+	SrcAddr string
+	DstAddr string
+
+	TLVs []ProxyTLV
+}
+
+// TLV 第一个类型为typ的TLV
+func (h *ProxyHeader) TLV(typ byte) (value []byte, ok bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ProxyHeader 连接开头的PROXY头部, 没有时返回nil
+func (conn *Connection) ProxyHeader() *ProxyHeader {
+	return conn.proxyHeader
+}
+
+// parseProxyAllowlist 解析Options.ProxyProtocolAllowlist, 每项是CIDR或者单个IP
+func parseProxyAllowlist(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy protocol allowlist entry %q", s)
+			}
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, e := net.ParseCIDR(s)
+		if e != nil {
+			return nil, fmt.Errorf("invalid proxy protocol allowlist entry %q", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return
+}
+
+// proxyState 按来源地址决定新连接是否必须有PROXY头部; Allowlist为空时所有来源都可信
+func (srv *Server) proxyState(sa syscall.Sockaddr) uint8 {
+	if !srv.opts.ProxyProtocol {
+		return proxyNone
+	}
+	if len(srv.proxyNets) == 0 {
+		return proxyRequired
+	}
+	if ip := sockAddrIP(sa); ip != nil {
+		for _, n := range srv.proxyNets {
+			if n.Contains(net.IP(ip)) {
+				return proxyRequired
+			}
+		}
+	}
+	return proxyForbidden
+}
+
+// startProxy 可信来源的连接等待PROXY头部, 超时关闭
+func (el *EventLoop) startProxy(conn *Connection) {
+	conn.pendingOpen = true
+	d := el.serv.opts.ProxyProtocolTimeout
+	if d <= 0 {
+		d = defaultProxyTimeout
+	}
+	conn.proxyTimer = el.AfterFunc(d, func() {
+		if conn.State == ESTABLISHED && conn.proxyState == proxyRequired {
+			_ = el.closeConn(conn, ErrProxyTimeout)
+		}
+	})
+}
+
+// proxyProcess 在交给TLS/Handler之前检查连接开头的数据, 返回false表示数据已经处理或者需要等待更多数据
+func (el *EventLoop) proxyProcess(conn *Connection) bool {
+	if conn.proxyState == proxyForbidden {
+		raw := conn.ReadBuff
+		if conn.tls != nil {
+			raw = conn.tls.in
+		}
+		switch proxySignature(raw.Bytes()) {
+		case sigPartial:
+			return false
+		case sigMatch:
+			_ = el.closeConn(conn, ErrProxyUntrusted)
+			return false
+		}
+		conn.proxyState = proxyNone
+		return true
+	}
+
+	// proxyRequired: 还没有开始TLS, 数据都在ReadBuff中
+	h, n, err := parseProxyHeader(conn.ReadBuff.Bytes())
+	if err != nil {
+		_ = el.closeConn(conn, err)
+		return false
+	}
+	if n == 0 {
+		return false
+	}
+	conn.ReadBuff.Discard(n)
+	conn.proxyState = proxyNone
+	conn.proxyTimer.Stop()
+	conn.proxyTimer = nil
+	conn.proxyHeader = h
+	if !h.Local && h.SrcAddr != "" {
+		conn.idx = h.SrcAddr
+	}
+	conn.pendingOpen = false
+
+	if el.serv.tlsConfig != nil {
+		// 头部之后的数据是TLS握手
+		el.startTLS(conn)
+		_, _ = conn.tls.in.Write(conn.ReadBuff.Bytes())
+		conn.ReadBuff.Reset()
+		if conn.tls.in.Len() > 0 {
+			el.tlsProcess(conn)
+		}
+		return false
+	}
+	el.callOpen(conn)
+	el.afterOpen(conn)
+	return conn.State == ESTABLISHED && conn.ReadBuff.Len() > 0
+}
+
+const (
+	sigNone = iota
+	sigPartial
+	sigMatch
+)
+
+// proxySignature data的开头是否是PROXY头部; 数据太短还不能确定时返回sigPartial
+func proxySignature(data []byte) int {
+	for _, sig := range []string{proxyV1Prefix, proxyV2Signature} {
+		n := len(data)
+		if n > len(sig) {
+			n = len(sig)
+		}
+		if string(data[:n]) != sig[:n] {
+			continue
+		}
+		if n == len(sig) {
+			return sigMatch
+		}
+		return sigPartial
+	}
+	return sigNone
+}
+
+func proxyError(msg string) error {
+	return fmt.Errorf("%w: %s", ErrProxyHeader, msg)
+}
+
+// parseProxyHeader 解析data开头的v1或v2头部, 数据不够时n为0
+func parseProxyHeader(data []byte) (h *ProxyHeader, n int, err error) {
+	switch proxySignature(data) {
+	case sigPartial:
+		return nil, 0, nil
+	case sigNone:
+		return nil, 0, proxyError("missing header")
+	}
+	if data[0] == 'P' {
+		return parseProxyV1(data)
+	}
+	return parseProxyV2(data)
+}
+
+// parseProxyV1 PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1(data []byte) (h *ProxyHeader, n int, err error) {
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		if len(data) >= proxyV1MaxLen {
+			return nil, 0, proxyError("v1 header too long")
+		}
+		return nil, 0, nil
+	}
+	if end+2 > proxyV1MaxLen {
+		return nil, 0, proxyError("v1 header too long")
+	}
+	h = &ProxyHeader{Version: 1}
+	fields := strings.Split(string(data[len(proxyV1Prefix):end]), " ")
+	if fields[0] == "UNKNOWN" {
+		// UNKNOWN之后的内容忽略
+		h.Local = true
+		return h, end + 2, nil
+	}
+	if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return nil, 0, proxyError("malformed v1 header")
+	}
+	src, dst := net.ParseIP(fields[1]), net.ParseIP(fields[2])
+	if src == nil || dst == nil {
+		return nil, 0, proxyError("invalid v1 address")
+	}
+	// 地址已经校验过, 没有冒号的是IPv4
+	if v4 := fields[0] == "TCP4"; strings.Contains(fields[1], ":") == v4 || strings.Contains(fields[2], ":") == v4 {
+		return nil, 0, proxyError("v1 address family mismatch")
+	}
+	for _, p := range fields[3:] {
+		port, e := strconv.Atoi(p)
+		if e != nil || p[0] == '+' || port < 0 || port > 65535 || len(p) > 1 && p[0] == '0' {
+			return nil, 0, proxyError("invalid v1 port")
+		}
+	}
+	h.Network = strings.ToLower(fields[0])
+	h.SrcAddr = net.JoinHostPort(src.String(), fields[3])
+	h.DstAddr = net.JoinHostPort(dst.String(), fields[4])
+	return h, end + 2, nil
+}
+
+// parseProxyV2 12字节签名, 版本和命令, 地址族和协议, 长度, 然后是地址和TLV
+func parseProxyV2(data []byte) (h *ProxyHeader, n int, err error) {
+	if len(data) < proxyV2HeaderLen {
+		return nil, 0, nil
+	}
+	verCmd, fam := data[12], data[13]
+	length := int(binary.BigEndian.Uint16(data[14:]))
+	if verCmd>>4 != 2 {
+		return nil, 0, proxyError("unsupported v2 version")
+	}
+	if len(data) < proxyV2HeaderLen+length {
+		return nil, 0, nil
+	}
+	n = proxyV2HeaderLen + length
+	body := data[proxyV2HeaderLen:n]
+
+	h = &ProxyHeader{Version: 2}
+	switch verCmd & 0x0f {
+	case proxyV2CmdLocal:
+		h.Local = true
+	case proxyV2CmdProxy:
+	default:
+		return nil, 0, proxyError("unsupported v2 command")
+	}
+
+	var addrLen int
+	switch fam >> 4 {
+	case 0x0: // AF_UNSPEC
+		h.Local = true
+	case 0x1:
+		addrLen = proxyV2AddrLenInet
+	case 0x2:
+		addrLen = proxyV2AddrLenInet6
+	case 0x3:
+		addrLen = proxyV2AddrLenUnix
+	default:
+		return nil, 0, proxyError("unsupported v2 address family")
+	}
+	if len(body) < addrLen {
+		return nil, 0, proxyError("v2 address too short")
+	}
+	if addrLen > 0 {
+		if err = h.parseV2Addr(fam, body[:addrLen]); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// 地址之后都是TLV
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, proxyError("truncated v2 tlv")
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+l {
+			return nil, 0, proxyError("truncated v2 tlv")
+		}
+		value := append([]byte(nil), tlvs[3:3+l]...)
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: value})
+		if tlvs[0] == ProxyTLVCRC32C && !proxyCRCValid(data[:n], n-len(tlvs)+3, value) {
+			return nil, 0, proxyError("v2 crc32c mismatch")
+		}
+		tlvs = tlvs[3+l:]
+	}
+	return h, n, nil
+}
+
+func (h *ProxyHeader) parseV2Addr(fam byte, addr []byte) error {
+	var network string
+	switch fam & 0x0f {
+	case 0x0:
+	case 0x1:
+		network = "tcp"
+	case 0x2:
+		network = "udp"
+	default:
+		return proxyError("unsupported v2 transport protocol")
+	}
+
+	switch fam >> 4 {
+	case 0x1, 0x2:
+		ipLen, suffix := 4, "4"
+		if fam>>4 == 0x2 {
+			ipLen, suffix = 16, "6"
+		}
+		src, dst := net.IP(addr[:ipLen]), net.IP(addr[ipLen:2*ipLen])
+		sport := strconv.Itoa(int(binary.BigEndian.Uint16(addr[2*ipLen:])))
+		dport := strconv.Itoa(int(binary.BigEndian.Uint16(addr[2*ipLen+2:])))
+		h.SrcAddr = net.JoinHostPort(src.String(), sport)
+		h.DstAddr = net.JoinHostPort(dst.String(), dport)
+		if network != "" {
+			network += suffix
+		}
+	case 0x3:
+		h.SrcAddr = unixPath(addr[:proxyV2UnixPathBytes])
+		h.DstAddr = unixPath(addr[proxyV2UnixPathBytes:])
+		switch network {
+		case "tcp":
+			network = "unix"
+		case "udp":
+			network = "unixgram"
+		}
+	}
+	h.Network = network
+	return nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func unixPath(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// proxyCRCValid 校验CRC32C TLV: 整个头部在CRC值为0时的校验和; at是CRC值在头部中的位置
+func proxyCRCValid(header []byte, at int, value []byte) bool {
+	if len(value) != 4 {
+		return false
+	}
+	buf := append([]byte(nil), header...)
+	copy(buf[at:at+4], []byte{0, 0, 0, 0})
+	return crc32.Checksum(buf, castagnoli) == binary.BigEndian.Uint32(value)
+}
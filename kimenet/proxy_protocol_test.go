@@ -0,0 +1,269 @@
+package kimenet
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 构造v2头部, crc为true时在最后加上CRC32C TLV
+func proxyV2(cmd, fam byte, addr []byte, tlvs []ProxyTLV, crc bool) []byte {
+	body := append([]byte(nil), addr...)
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+	if crc {
+		body = append(body, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+	b := append([]byte(proxyV2Signature), 0x20|cmd, fam, byte(len(body)>>8), byte(len(body)))
+	b = append(b, body...)
+	if crc {
+		binary.BigEndian.PutUint32(b[len(b)-4:], crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	return b
+}
+
+func inet4Addr(src, dst string, sport, dport uint16) []byte {
+	b := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	return append(b, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	inet6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	inet6 = append(inet6, 0x30, 0x39, 0x01, 0xbb)
+	unix := make([]byte, proxyV2AddrLenUnix)
+	copy(unix, "/tmp/client.sock")
+	copy(unix[proxyV2UnixPathBytes:], "/tmp/server.sock")
+	withCRC := proxyV2(1, 0x11, inet4Addr("10.1.2.3", "10.0.0.1", 40000, 443), []ProxyTLV{{ProxyTLVAuthority, []byte("example.com")}}, true)
+	badCRC := append([]byte(nil), withCRC...)
+	badCRC[len(badCRC)-1] ^= 1
+
+	cases := []struct {
+		name    string
+		data    string
+		n       int // 0表示数据不够
+		err     bool
+		src     string
+		dst     string
+		network string
+		local   bool
+		version int
+	}{
+		{name: "v1 tcp4", data: "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET", n: 47, src: "192.168.0.1:56324", dst: "192.168.0.11:443", network: "tcp4", version: 1},
+		{name: "v1 tcp6", data: "PROXY TCP6 2001:db8::1 ::1 1 2\r\n", n: 32, src: "[2001:db8::1]:1", dst: "[::1]:2", network: "tcp6", version: 1},
+		{name: "v1 unknown", data: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", n: 35, local: true, version: 1},
+		{name: "v1 partial", data: "PROXY TCP4 192.168"},
+		{name: "v1 prefix", data: "PRO"},
+		{name: "v1 family mismatch", data: "PROXY TCP4 ::1 ::1 1 2\r\n", err: true},
+		{name: "v1 bad port", data: "PROXY TCP4 1.1.1.1 2.2.2.2 65536 1\r\n", err: true},
+		{name: "v1 missing field", data: "PROXY TCP4 1.1.1.1 2.2.2.2 1\r\n", err: true},
+		{name: "v1 too long", data: "PROXY TCP4 " + strings.Repeat("1", 100), err: true},
+		{name: "no header", data: "GET / HTTP/1.1\r\n", err: true},
+		{name: "v2 inet crc", data: string(withCRC) + "rest", n: len(withCRC), src: "10.1.2.3:40000", dst: "10.0.0.1:443", network: "tcp4", version: 2},
+		{name: "v2 bad crc", data: string(badCRC), err: true},
+		{name: "v2 inet6 udp", data: string(proxyV2(1, 0x22, inet6, nil, false)), n: 16 + 36, src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:443", network: "udp6", version: 2},
+		{name: "v2 unix", data: string(proxyV2(1, 0x31, unix, nil, false)), n: 16 + 216, src: "/tmp/client.sock", dst: "/tmp/server.sock", network: "unix", version: 2},
+		{name: "v2 local", data: string(proxyV2(0, 0x00, nil, nil, false)), n: 16, local: true, version: 2},
+		{name: "v2 partial", data: string(withCRC[:20])},
+		{name: "v2 signature partial", data: "\r\n\r\n\x00"},
+		{name: "v2 bad version", data: string(append([]byte(proxyV2Signature), 0x11, 0x11, 0, 0)), err: true},
+		{name: "v2 short address", data: string(proxyV2(1, 0x11, []byte{1, 2, 3}, nil, false)), err: true},
+		{name: "v2 truncated tlv", data: string(proxyV2(1, 0x11, append(inet4Addr("1.1.1.1", "2.2.2.2", 1, 2), 0x04, 0, 9), nil, false)), err: true},
+	}
+	for _, tc := range cases {
+		h, n, err := parseProxyHeader([]byte(tc.data))
+		if tc.err {
+			if !errors.Is(err, ErrProxyHeader) {
+				t.Fatalf("%s: err %v, want ErrProxyHeader", tc.name, err)
+			}
+			continue
+		}
+		if err != nil || n != tc.n {
+			t.Fatalf("%s: n %d err %v, want %d", tc.name, n, err, tc.n)
+		}
+		if n == 0 {
+			continue
+		}
+		if h.SrcAddr != tc.src || h.DstAddr != tc.dst || h.Network != tc.network || h.Local != tc.local || h.Version != tc.version {
+			t.Fatalf("%s: header %+v", tc.name, h)
+		}
+	}
+
+	h, _, _ := parseProxyHeader(withCRC)
+	if v, ok := h.TLV(ProxyTLVAuthority); !ok || string(v) != "example.com" {
+		t.Fatalf("authority tlv %q %v", v, ok)
+	}
+}
+
+// addrHandler 连接打开时先发送RemoteAddr, 之后回显
+type addrHandler struct {
+	echoHandler
+}
+
+func (h *addrHandler) OnOpen(conn *Connection) {
+	_, _ = conn.Write([]byte(conn.RemoteAddr() + "\n"))
+}
+
+func readAddr(t *testing.T, br *bufio.Reader) string {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal("read addr: ", err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func dialProxy(t *testing.T, srv *Server) (net.Conn, *bufio.Reader) {
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+func expectEcho(t *testing.T, c net.Conn, br *bufio.Reader, msg string) {
+	_, _ = c.Write([]byte(msg))
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != msg {
+		t.Fatalf("echo %q %v", got, err)
+	}
+}
+
+func expectClosed(t *testing.T, h *addrHandler, br *bufio.Reader, want error) {
+	if b, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expect EOF, got %q %v", b, err)
+	}
+	if want == nil {
+		return
+	}
+	select {
+	case err := <-h.closed:
+		if err != want {
+			t.Fatalf("OnClose err %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	h := &addrHandler{echoHandler{closed: make(chan error, 4)}}
+	srv := startTestServer(t, h, &Options{
+		ProxyProtocol:          true,
+		ProxyProtocolAllowlist: []string{"10.0.0.0/8", "127.0.0.1"},
+		ProxyProtocolTimeout:   100 * time.Millisecond,
+	})
+	defer srv.Stop()
+
+	// v1头部和数据一起到达
+	c, br := dialProxy(t, srv)
+	_, _ = c.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\nhello"))
+	if addr := readAddr(t, br); addr != "203.0.113.7:5555" {
+		t.Fatalf("RemoteAddr %q", addr)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "hello" {
+		t.Fatalf("data after header %q %v", got, err)
+	}
+	c.Close()
+
+	// v2头部分多次到达
+	c, br = dialProxy(t, srv)
+	hdr := proxyV2(1, 0x11, inet4Addr("198.51.100.2", "10.0.0.1", 6000, 80), []ProxyTLV{{ProxyTLVUniqueID, []byte("id")}}, false)
+	for _, b := range hdr {
+		_, _ = c.Write([]byte{b})
+		time.Sleep(time.Millisecond)
+	}
+	if addr := readAddr(t, br); addr != "198.51.100.2:6000" {
+		t.Fatalf("RemoteAddr %q", addr)
+	}
+	expectEcho(t, c, br, "world")
+	c.Close()
+
+	// LOCAL命令保留原来的地址
+	c, br = dialProxy(t, srv)
+	_, _ = c.Write(proxyV2(0, 0, nil, nil, false))
+	if addr := readAddr(t, br); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("RemoteAddr %q", addr)
+	}
+	c.Close()
+
+	// 可信来源没有头部, 不回调OnOpen/OnClose
+	c, br = dialProxy(t, srv)
+	_, _ = c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	expectClosed(t, h, br, nil)
+	c.Close()
+
+	// 超时
+	c, br = dialProxy(t, srv)
+	expectClosed(t, h, br, nil)
+	c.Close()
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	h := &addrHandler{echoHandler{closed: make(chan error, 4)}}
+	srv := startTestServer(t, h, &Options{
+		ProxyProtocol:          true,
+		ProxyProtocolAllowlist: []string{"10.0.0.0/8"},
+	})
+	defer srv.Stop()
+
+	// 不可信来源按普通连接处理, 不等待数据
+	c, br := dialProxy(t, srv)
+	if addr := readAddr(t, br); !strings.HasPrefix(addr, "127.0.0.1:") {
+		t.Fatalf("RemoteAddr %q", addr)
+	}
+	expectEcho(t, c, br, "PUT")
+	expectEcho(t, c, br, "PROXY after first data")
+	c.Close()
+	<-h.closed
+
+	// 开头是PROXY头部时关闭
+	for _, hdr := range []string{"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\r\n", string(proxyV2(1, 0x11, inet4Addr("1.2.3.4", "5.6.7.8", 1, 2), nil, false))} {
+		c, br = dialProxy(t, srv)
+		readAddr(t, br)
+		// 分两次发送, 第一次还不能确定
+		_, _ = c.Write([]byte(hdr[:3]))
+		time.Sleep(10 * time.Millisecond)
+		_, _ = c.Write([]byte(hdr[3:]))
+		expectClosed(t, h, br, ErrProxyUntrusted)
+		c.Close()
+	}
+
+	if _, err := NewServer("127.0.0.1:0", h, &Options{ProxyProtocol: true, ProxyProtocolAllowlist: []string{"10.0.0.0/33"}}); err == nil {
+		t.Fatal("invalid allowlist accepted")
+	}
+}
+
+func TestProxyProtocolTLS(t *testing.T) {
+	cert, _, _ := testCert(t, "example.com")
+	h := &addrHandler{echoHandler{closed: make(chan error, 4)}}
+	srv := startTestServer(t, h, &Options{
+		ProxyProtocol: true,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = c.Write([]byte("PROXY TCP6 2001:db8::7 2001:db8::1 4000 443\r\n"))
+
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	br := bufio.NewReader(tc)
+	if addr := readAddr(t, br); addr != "[2001:db8::7]:4000" {
+		t.Fatalf("RemoteAddr %q", addr)
+	}
+	expectEcho(t, tc, br, "secret")
+}
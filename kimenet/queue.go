@@ -0,0 +1,45 @@
+package kimenet
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// taskQueue 无锁的多生产者单消费者队列(Vyukov MPSC)
+// 任意协程都可以push, 只有EventLoop协程pop
+type taskQueue struct {
+	head unsafe.Pointer // *task, 生产者从这里加入
+	tail *task          // 消费者从这里取出, 总是指向一个已经取出的哨兵节点
+	stub task
+}
+
+type task struct {
+	f    func()
+	next unsafe.Pointer // *task
+}
+
+func newTaskQueue() *taskQueue {
+	q := new(taskQueue)
+	q.head = unsafe.Pointer(&q.stub)
+	q.tail = &q.stub
+	return q
+}
+
+func (q *taskQueue) push(f func()) {
+	t := &task{f: f}
+	prev := (*task)(atomic.SwapPointer(&q.head, unsafe.Pointer(t)))
+	// prev和t之间短暂断开, 消费者此时会认为队列为空, 等下一次唤醒再取
+	atomic.StorePointer(&prev.next, unsafe.Pointer(t))
+}
+
+// pop 取出一个任务, 队列为空时返回nil
+func (q *taskQueue) pop() func() {
+	next := (*task)(atomic.LoadPointer(&q.tail.next))
+	if next == nil {
+		return nil
+	}
+	q.tail = next
+	f := next.f
+	next.f = nil
+	return f
+}
@@ -0,0 +1,238 @@
+package kimenet
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrConnNotFound = errors.New("kimenet: connection not found")
+	ErrConnKilled   = errors.New("kimenet: connection killed") // CloseConn关闭连接时OnClose的err
+)
+
+// 连接的状态, 见ConnInfo.State
+const (
+	ConnConnecting  = "connecting"  // Dial发起的连接还未完成
+	ConnProxy       = "proxy"       // 等待PROXY头部
+	ConnHandshaking = "handshaking" // TLS握手中
+	ConnOpen        = "open"
+	ConnHalfClosed  = "half-closed" // 调用了CloseWrite
+	ConnClosing     = "closing"     // 调用了Close, 写缓冲区发送完毕后关闭
+	ConnClosed      = "closed"
+)
+
+// lastConnID 进程内最后分配的连接ID, 从1开始递增, fd复用时ID也不会重复
+var lastConnID uint64
+
+// ConnInfo 连接在某一时刻的快照, 可以在任意协程使用
+type ConnInfo struct {
+	ID         uint64
+	Fd         int
+	Loop       int // 所属EventLoop的序号
+	State      string
+	RemoteAddr string
+	LocalAddr  string
+	Outbound   bool
+	TLS        bool
+
+	Created    time.Time
+	LastActive time.Time // 最后一次读到或者发送数据的时间, 没有设置超时时可能为零值
+
+	BytesIn     uint64 // 从socket读到的字节数, TLS连接为密文
+	BytesOut    uint64 // 写到socket的字节数
+	MessagesIn  uint64 // 回调OnMessage的次数
+	MessagesOut uint64 // WriteMessage的次数
+
+	ReadBuffered  int // ReadBuff中还没有处理的字节数
+	WriteBuffered int // WriteBuff中还没有发送的字节数
+	ReadPaused    bool
+}
+
+// ID 连接的唯一ID
+func (conn *Connection) ID() uint64 {
+	return conn.id
+}
+
+// Created 连接创建的时间
+func (conn *Connection) Created() time.Time {
+	return conn.created
+}
+
+// LocalAddr 本端地址, 每次调用getsockname
+func (conn *Connection) LocalAddr() string {
+	if conn.State != ESTABLISHED {
+		return ""
+	}
+	sa, err := syscall.Getsockname(conn.Fd)
+	if err != nil {
+		return ""
+	}
+	return sockAddrToString(sa)
+}
+
+// register 分配ID和创建时间, 在连接通过准入检查或者发起Dial之后调用, 被拒绝的连接不占用ID
+func (conn *Connection) register() {
+	conn.id = atomic.AddUint64(&lastConnID, 1)
+	conn.created = time.Now()
+}
+
+// connRef ID对应的连接所在的EventLoop和fd
+type connRef struct {
+	loop *EventLoop
+	fd   int
+}
+
+// trackConn 连接加入EventLoop时记录ID的位置, CloseConn用它找到连接
+func (srv *Server) trackConn(el *EventLoop, conn *Connection) {
+	srv.connIDsMu.Lock()
+	srv.connIDs[conn.id] = connRef{loop: el, fd: conn.Fd}
+	srv.connIDsMu.Unlock()
+}
+
+// untrackConn 连接离开EventLoop(关闭或者交给子进程)时删除ID的位置
+func (srv *Server) untrackConn(conn *Connection) {
+	srv.connIDsMu.Lock()
+	delete(srv.connIDs, conn.id)
+	srv.connIDsMu.Unlock()
+}
+
+// stateName 连接当前的状态
+func (conn *Connection) stateName() string {
+	switch {
+	case conn.State != ESTABLISHED:
+		return ConnClosed
+	case conn.connecting:
+		return ConnConnecting
+	case conn.proxyState == proxyRequired:
+		return ConnProxy
+	case conn.tls != nil && !conn.tls.ready:
+		return ConnHandshaking
+	case conn.closing:
+		return ConnClosing
+	case conn.halfClosing || conn.writeShut:
+		return ConnHalfClosed
+	}
+	return ConnOpen
+}
+
+// Info 连接的快照; 只能在EventLoop协程中调用, 其他协程使用Server.Conns
+func (conn *Connection) Info() (info ConnInfo) {
+	info = ConnInfo{
+		ID:            conn.id,
+		Fd:            conn.Fd,
+		State:         conn.stateName(),
+		RemoteAddr:    conn.idx,
+		LocalAddr:     conn.LocalAddr(),
+		Outbound:      conn.Outbound,
+		TLS:           conn.tls != nil,
+		Created:       conn.created,
+		LastActive:    conn.lastActive,
+		BytesIn:       conn.bytesIn,
+		BytesOut:      conn.bytesOut,
+		MessagesIn:    conn.msgsIn,
+		MessagesOut:   conn.msgsOut,
+		ReadBuffered:  conn.ReadBuff.Len(),
+		WriteBuffered: conn.WriteBuff.Len(),
+		ReadPaused:    conn.readPaused,
+	}
+	if conn.loop != nil {
+		info.Loop = conn.loop.idx
+	}
+	return
+}
+
+// Conns 所有连接的快照, 按ID排序; 可以在任意协程调用, 在各个EventLoop协程中收集
+// ctx结束时返回已经收集到的连接和ctx.Err(), 例如有EventLoop卡在Handler中
+func (srv *Server) Conns(ctx context.Context) (infos []ConnInfo, err error) {
+	var (
+		mu  sync.Mutex
+		all []ConnInfo
+	)
+	err = srv.runOnLoopsCtx(ctx, func(el *EventLoop) {
+		part := make([]ConnInfo, 0, len(el.conns))
+		for _, conn := range el.conns {
+			part = append(part, conn.Info())
+		}
+		mu.Lock()
+		all = append(all, part...)
+		mu.Unlock()
+	})
+	mu.Lock()
+	infos = append([]ConnInfo(nil), all...)
+	mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return
+}
+
+// RangeConns 按ID顺序对每个连接的快照调用f, f返回false时停止; f在调用者的协程中执行
+func (srv *Server) RangeConns(ctx context.Context, f func(info ConnInfo) bool) (err error) {
+	infos, err := srv.Conns(ctx)
+	for _, info := range infos {
+		if !f(info) {
+			break
+		}
+	}
+	return
+}
+
+// CloseConn 立即关闭ID对应的连接, 不等待写缓冲区发送, OnClose的err为ErrConnKilled
+// 可以在任意协程调用; 连接不存在或者已经关闭时返回ErrConnNotFound
+func (srv *Server) CloseConn(ctx context.Context, id uint64) (err error) {
+	if atomic.LoadInt32(&srv.started) == 0 {
+		return ErrServerNotStarted
+	}
+	srv.connIDsMu.Lock()
+	ref, ok := srv.connIDs[id]
+	srv.connIDsMu.Unlock()
+	if !ok {
+		return ErrConnNotFound
+	}
+
+	var found int32
+	err = srv.runOnCtx(ctx, []*EventLoop{ref.loop}, func(el *EventLoop) {
+		// 在EventLoop协程中再确认一次, 期间连接可能已经关闭、fd被复用
+		if conn, ok := el.conns[ref.fd]; ok && conn.id == id {
+			atomic.StoreInt32(&found, 1)
+			_ = el.closeConn(conn, ErrConnKilled)
+		}
+	})
+	if err == nil && atomic.LoadInt32(&found) == 0 {
+		err = ErrConnNotFound
+	}
+	return
+}
+
+// runOnLoopsCtx 同runOnLoops, 但最多等到ctx结束或者服务器停止, 可以从任意协程调用
+func (srv *Server) runOnLoopsCtx(ctx context.Context, f func(el *EventLoop)) (err error) {
+	return srv.runOnCtx(ctx, srv.loops, f)
+}
+
+// runOnCtx 在loops的各个EventLoop协程中执行f, 见runOnLoopsCtx
+func (srv *Server) runOnCtx(ctx context.Context, loops []*EventLoop, f func(el *EventLoop)) (err error) {
+	if atomic.LoadInt32(&srv.started) == 0 {
+		return ErrServerNotStarted
+	}
+	done := make(chan struct{}, len(loops))
+	for _, el := range loops {
+		el := el
+		el.Execute(func() {
+			f(el)
+			done <- struct{}{}
+		})
+	}
+	for range loops {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-srv.done:
+			return ErrServerShutdown
+		}
+	}
+	return
+}
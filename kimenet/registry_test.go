@@ -0,0 +1,165 @@
+package kimenet
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type registryHandler struct {
+	msgEchoHandler
+	closed chan error
+}
+
+func (h *registryHandler) OnClose(conn *Connection, err error) {
+	h.closed <- err
+}
+
+func TestConnRegistry(t *testing.T) {
+	h := &registryHandler{closed: make(chan error, 2)}
+	srv := startTestServer(t, h, &Options{NumLoops: 2, Codec: &LineCodec{}})
+	defer srv.Stop()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatal("Dial: ", err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = c.Write([]byte("ab\ncd\n"))
+		got := make([]byte, 6)
+		if _, err = io.ReadFull(c, got); err != nil || string(got) != "AB\nCD\n" {
+			t.Fatalf("echo %q %v", got, err)
+		}
+		clients = append(clients, c)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	infos, err := srv.Conns(ctx)
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("Conns %v %v", infos, err)
+	}
+	if infos[0].ID >= infos[1].ID || infos[0].Loop == infos[1].Loop {
+		t.Fatalf("ids %d %d loops %d %d", infos[0].ID, infos[1].ID, infos[0].Loop, infos[1].Loop)
+	}
+	for i, info := range infos {
+		if info.RemoteAddr != clients[i].LocalAddr().String() || info.LocalAddr != srv.Addr() {
+			t.Fatalf("addr %+v", info)
+		}
+		if info.State != ConnOpen || info.Created.IsZero() || info.Outbound || info.TLS {
+			t.Fatalf("info %+v", info)
+		}
+		if info.BytesIn != 6 || info.BytesOut != 6 || info.MessagesIn != 2 || info.MessagesOut != 2 {
+			t.Fatalf("counters %+v", info)
+		}
+	}
+
+	n := 0
+	err = srv.RangeConns(ctx, func(info ConnInfo) bool {
+		n++
+		return false
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("RangeConns %d %v", n, err)
+	}
+
+	// 从其他协程关闭第一个连接
+	if err = srv.CloseConn(ctx, infos[0].ID); err != nil {
+		t.Fatal("CloseConn: ", err)
+	}
+	if err = <-h.closed; err != ErrConnKilled {
+		t.Fatalf("OnClose %v", err)
+	}
+	if _, err = clients[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read %v", err)
+	}
+	if err = srv.CloseConn(ctx, infos[0].ID); err != ErrConnNotFound {
+		t.Fatalf("CloseConn again %v", err)
+	}
+	if infos, _ = srv.Conns(ctx); len(infos) != 1 || infos[0].RemoteAddr != clients[1].LocalAddr().String() {
+		t.Fatalf("Conns after close %v", infos)
+	}
+}
+
+func TestConnRegistryStuckLoop(t *testing.T) {
+	srv, err := NewServer("127.0.0.1:0", &echoHandler{closed: make(chan error, 4)}, &Options{NumLoops: 1})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	if _, err = srv.Conns(context.Background()); err != ErrServerNotStarted {
+		t.Fatalf("Conns before Start %v", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	testEcho(t, "tcp", srv.Addr(), []byte("hi"))
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var infos []ConnInfo
+	for len(infos) == 0 {
+		if infos, err = srv.Conns(ctx); err != nil {
+			t.Fatal("Conns: ", err)
+		}
+	}
+
+	// EventLoop卡住时在ctx结束后返回
+	release := make(chan struct{})
+	defer close(release)
+	srv.loops[0].Execute(func() {
+		<-release
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = srv.Conns(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Conns %v", err)
+	}
+	if err = srv.CloseConn(ctx, infos[0].ID); err != context.DeadlineExceeded {
+		t.Fatalf("CloseConn %v", err)
+	}
+	// 不存在的ID不需要等EventLoop
+	if err = srv.CloseConn(ctx, infos[0].ID+1000); err != ErrConnNotFound {
+		t.Fatalf("CloseConn unknown %v", err)
+	}
+}
+
+// 超过MaxConns被拒绝的连接不分配ID
+func TestConnRegistryRejected(t *testing.T) {
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 4)}, &Options{NumLoops: 1, MaxConns: 1})
+	defer srv.Stop()
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = c.Write([]byte("a"))
+	if _, err = io.ReadFull(c, make([]byte, 1)); err != nil {
+		t.Fatal("echo: ", err)
+	}
+
+	last := atomic.LoadUint64(&lastConnID)
+	c2, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c2.Close()
+	_ = c2.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("second connection should be rejected")
+	}
+	if id := atomic.LoadUint64(&lastConnID); id != last {
+		t.Fatalf("lastConnID %d, want %d", id, last)
+	}
+}
@@ -0,0 +1,324 @@
+package kimenet
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	minRingSize   = 1 << 10 // 最小的底层数组, 1KB
+	maxPooledSize = 1 << 24 // 超过16MB的底层数组不放回池中
+)
+
+// ringPools 按2的幂次分级的底层数组池, ringPools[i]中数组的长度为1<<i
+var ringPools [bits.UintSize]sync.Pool
+
+func getRingBuf(size int) []byte {
+	if size < minRingSize {
+		size = minRingSize
+	}
+	class := bits.Len(uint(size - 1))
+	size = 1 << class
+	if size <= maxPooledSize {
+		if b, ok := ringPools[class].Get().([]byte); ok {
+			return b
+		}
+	}
+	return make([]byte, size)
+}
+
+func putRingBuf(b []byte) {
+	size := len(b)
+	if size < minRingSize || size > maxPooledSize || size&(size-1) != 0 {
+		return
+	}
+	ringPools[bits.Len(uint(size-1))].Put(b)
+}
+
+// RingBuffer 可增长的环形缓冲区, 连接的ReadBuff和WriteBuff
+// 底层数组从池中获取, 容量总是2的幂次; 数据读完后读写位置归零, 连接关闭后底层数组放回池中
+// Peek/Next/Bytes返回的切片直接引用底层数组, 只在下一次修改缓冲区之前有效
+// 只能在EventLoop协程中使用
+type RingBuffer struct {
+	buf []byte
+	r   int // 读位置
+	n   int // 数据长度
+
+	scanned int // 开头已经查找过分隔符的字节数, 见decodeDelimited; 读走数据时相应减少
+}
+
+// NewRingBuffer 创建环形缓冲区, size为初始容量, 为0时在第一次写入时才分配
+func NewRingBuffer(size int) *RingBuffer {
+	rb := new(RingBuffer)
+	if size > 0 {
+		rb.buf = getRingBuf(size)
+	}
+	return rb
+}
+
+// Len 可读数据的长度
+func (rb *RingBuffer) Len() int {
+	return rb.n
+}
+
+// Cap 底层数组的容量
+func (rb *RingBuffer) Cap() int {
+	return len(rb.buf)
+}
+
+// Free 不扩容还能写入的长度
+func (rb *RingBuffer) Free() int {
+	return len(rb.buf) - rb.n
+}
+
+// data 可读数据所在的两段, 没有回绕时tail为空
+func (rb *RingBuffer) data(n int) (head, tail []byte) {
+	if n <= 0 || n > rb.n {
+		n = rb.n
+	}
+	if n == 0 {
+		return
+	}
+	if end := rb.r + n; end <= len(rb.buf) {
+		return rb.buf[rb.r:end], nil
+	}
+	return rb.buf[rb.r:], rb.buf[:rb.r+n-len(rb.buf)]
+}
+
+// space 空闲空间所在的两段
+func (rb *RingBuffer) space() (head, tail []byte) {
+	if rb.n == len(rb.buf) {
+		return
+	}
+	w := rb.r + rb.n
+	if w >= len(rb.buf) {
+		return rb.buf[w-len(rb.buf) : rb.r], nil
+	}
+	return rb.buf[w:], rb.buf[:rb.r]
+}
+
+// Peek 查看前n个字节但不移动读位置, n<=0或超过Len时返回全部数据
+// 数据回绕时分成head和tail两段返回, 不拷贝
+func (rb *RingBuffer) Peek(n int) (head, tail []byte) {
+	return rb.data(n)
+}
+
+// Discard 丢弃前n个字节, 返回实际丢弃的长度
+func (rb *RingBuffer) Discard(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	if n >= rb.n {
+		n = rb.n
+		rb.r, rb.n, rb.scanned = 0, 0, 0
+		return n
+	}
+	rb.advance(n)
+	return n
+}
+
+// advance 读位置后移n个字节, 到达数组末尾时回到开头, 保证rb.r总是小于len(rb.buf)
+func (rb *RingBuffer) advance(n int) {
+	rb.r += n
+	if rb.r >= len(rb.buf) {
+		rb.r -= len(rb.buf)
+	}
+	rb.n -= n
+	if rb.scanned -= n; rb.scanned < 0 {
+		rb.scanned = 0
+	}
+}
+
+// Next 返回前n个字节并移动读位置, 超过Len时返回全部数据
+// 数据没有回绕时不拷贝; 回绕时先把数据整理成连续的
+func (rb *RingBuffer) Next(n int) []byte {
+	if n > rb.n || n < 0 {
+		n = rb.n
+	}
+	if n == 0 {
+		return nil
+	}
+	head, tail := rb.data(n)
+	if len(tail) > 0 {
+		rb.linearize()
+		head = rb.buf[:n]
+	}
+	// 不归零读位置, 返回的切片在下一次写入前保持有效
+	rb.advance(n)
+	return head
+}
+
+// Bytes 返回全部可读数据, 不移动读位置; 数据回绕时先整理成连续的
+func (rb *RingBuffer) Bytes() []byte {
+	head, tail := rb.data(0)
+	if len(tail) == 0 {
+		return head
+	}
+	rb.linearize()
+	return rb.buf[:rb.n]
+}
+
+// String 以字符串返回全部可读数据
+func (rb *RingBuffer) String() string {
+	head, tail := rb.data(0)
+	return string(head) + string(tail)
+}
+
+// Reset 清空数据, 保留底层数组
+func (rb *RingBuffer) Reset() {
+	rb.r, rb.n, rb.scanned = 0, 0, 0
+}
+
+// Read 实现io.Reader, 没有数据时返回io.EOF
+func (rb *RingBuffer) Read(p []byte) (n int, err error) {
+	if rb.n == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	head, tail := rb.data(len(p))
+	n = copy(p, head)
+	n += copy(p[n:], tail)
+	rb.Discard(n)
+	return
+}
+
+// ReadByte 读取一个字节
+func (rb *RingBuffer) ReadByte() (c byte, err error) {
+	if rb.n == 0 {
+		return 0, io.EOF
+	}
+	c = rb.buf[rb.r]
+	rb.Discard(1)
+	return
+}
+
+// Write 实现io.Writer, 空间不足时扩容, 总是写入全部数据
+func (rb *RingBuffer) Write(p []byte) (n int, err error) {
+	rb.grow(len(p))
+	head, tail := rb.space()
+	n = copy(head, p)
+	n += copy(tail, p[n:])
+	rb.n += n
+	return
+}
+
+// WriteString 写入字符串
+func (rb *RingBuffer) WriteString(s string) (n int, err error) {
+	rb.grow(len(s))
+	head, tail := rb.space()
+	n = copy(head, s)
+	n += copy(tail, s[n:])
+	rb.n += n
+	return
+}
+
+// WriteByte 写入一个字节
+func (rb *RingBuffer) WriteByte(c byte) error {
+	rb.grow(1)
+	w := rb.r + rb.n
+	if w >= len(rb.buf) {
+		w -= len(rb.buf)
+	}
+	rb.buf[w] = c
+	rb.n++
+	return nil
+}
+
+// grow 保证至少还能写入need个字节
+func (rb *RingBuffer) grow(need int) {
+	if need <= rb.Free() {
+		return
+	}
+	size := len(rb.buf) * 2
+	if size < rb.n+need {
+		size = rb.n + need
+	}
+	rb.realloc(getRingBuf(size))
+}
+
+// linearize 把回绕的数据整理到底层数组开头
+func (rb *RingBuffer) linearize() {
+	rb.realloc(getRingBuf(len(rb.buf)))
+}
+
+func (rb *RingBuffer) realloc(buf []byte) {
+	head, tail := rb.data(0)
+	n := copy(buf, head)
+	copy(buf[n:], tail)
+	if rb.buf != nil {
+		putRingBuf(rb.buf)
+	}
+	rb.buf = buf
+	rb.r = 0
+}
+
+// release 把底层数组放回池中, 连接关闭时调用
+func (rb *RingBuffer) release() {
+	if rb.buf != nil {
+		putRingBuf(rb.buf)
+	}
+	rb.buf = nil
+	rb.r, rb.n, rb.scanned = 0, 0, 0
+}
+
+// readFd 用readv把fd中的数据读到空闲空间, 空闲空间不够时先读到extra再追加
+func (rb *RingBuffer) readFd(fd int, extra []byte) (n int, err error) {
+	var iovs [3]syscall.Iovec
+	head, tail := rb.space()
+	cnt := 0
+	for _, b := range [][]byte{head, tail, extra} {
+		if len(b) > 0 {
+			iovs[cnt].Base = &b[0]
+			iovs[cnt].SetLen(len(b))
+			cnt++
+		}
+	}
+	if cnt == 0 {
+		return 0, nil
+	}
+
+	r, _, errno := syscall.Syscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(cnt))
+	if errno != 0 {
+		return 0, errno
+	}
+	n = int(r)
+
+	free := len(head) + len(tail)
+	if n <= free {
+		rb.n += n
+		return
+	}
+	rb.n += free
+	_, _ = rb.Write(extra[:n-free])
+	return
+}
+
+// writeFd 用writev把数据写到fd, 并丢弃已经写出的部分
+func (rb *RingBuffer) writeFd(fd int) (n int, err error) {
+	var iovs [2]syscall.Iovec
+	head, tail := rb.data(0)
+	if len(head) == 0 {
+		return 0, nil
+	}
+	iovs[0].Base = &head[0]
+	iovs[0].SetLen(len(head))
+	cnt := 1
+	if len(tail) > 0 {
+		iovs[1].Base = &tail[0]
+		iovs[1].SetLen(len(tail))
+		cnt = 2
+	}
+
+	r, _, errno := syscall.Syscall(syscall.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(cnt))
+	if errno != 0 {
+		return 0, errno
+	}
+	n = int(r)
+	rb.Discard(n)
+	return
+}
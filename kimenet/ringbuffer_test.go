@@ -0,0 +1,150 @@
+package kimenet
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func TestRingBufferWrap(t *testing.T) {
+	rb := NewRingBuffer(minRingSize)
+	if rb.Cap() != minRingSize {
+		t.Fatalf("cap %d", rb.Cap())
+	}
+
+	// 让数据回绕到底层数组开头
+	_, _ = rb.Write(bytes.Repeat([]byte("a"), minRingSize-10))
+	rb.Discard(minRingSize - 20)
+	_, _ = rb.Write([]byte("0123456789abcdefghij"))
+	if rb.Len() != 30 || rb.Cap() != minRingSize {
+		t.Fatalf("len %d cap %d", rb.Len(), rb.Cap())
+	}
+
+	head, tail := rb.Peek(0)
+	if len(head) != 20 || len(tail) != 10 {
+		t.Fatalf("peek head %d tail %d", len(head), len(tail))
+	}
+	if got := string(head) + string(tail); got != rb.String() || rb.Len() != 30 {
+		t.Fatalf("peek %q", got)
+	}
+
+	if got := string(rb.Next(25)); got != "aaaaaaaaaa0123456789abcde" {
+		t.Fatalf("next %q", got)
+	}
+	if got := string(rb.Bytes()); got != "fghij" {
+		t.Fatalf("bytes %q", got)
+	}
+
+	b, err := rb.ReadByte()
+	if err != nil || b != 'f' {
+		t.Fatalf("ReadByte %q %v", b, err)
+	}
+	p := make([]byte, 10)
+	n, _ := rb.Read(p)
+	if string(p[:n]) != "ghij" {
+		t.Fatalf("read %q", p[:n])
+	}
+	if _, err = rb.Read(p); err != io.EOF {
+		t.Fatalf("read empty: %v", err)
+	}
+}
+
+// Next正好读到底层数组末尾而数据还有剩余时, 读位置要回到开头
+func TestRingBufferNextToEnd(t *testing.T) {
+	rb := NewRingBuffer(1024)
+	_, _ = rb.Write(bytes.Repeat([]byte("a"), 1000))
+	rb.Discard(900)
+	_, _ = rb.Write(bytes.Repeat([]byte("b"), 100))
+	if got := rb.Next(124); len(got) != 124 || got[123] != 'b' {
+		t.Fatalf("next %q", got)
+	}
+	head, tail := rb.Peek(0)
+	if len(head) != 76 || len(tail) != 0 {
+		t.Fatalf("peek head %d tail %d", len(head), len(tail))
+	}
+	if b, err := rb.ReadByte(); err != nil || b != 'b' {
+		t.Fatalf("ReadByte %q %v", b, err)
+	}
+
+	// writeFd要能写出剩下的数据
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal("Socketpair: ", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if n, err := rb.writeFd(fds[0]); n != 75 || err != nil || rb.Len() != 0 {
+		t.Fatalf("writeFd %d %v len %d", n, err, rb.Len())
+	}
+}
+
+func TestRingBufferGrow(t *testing.T) {
+	rb := NewRingBuffer(0)
+	if rb.Cap() != 0 {
+		t.Fatalf("cap %d", rb.Cap())
+	}
+
+	var want bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		msg := bytes.Repeat([]byte{byte('a' + i%26)}, i%37+1)
+		_, _ = rb.Write(msg)
+		want.Write(msg)
+		if i%3 == 0 {
+			got := rb.Next(i % 11)
+			if !bytes.Equal(got, want.Next(len(got))) {
+				t.Fatalf("round %d mismatch", i)
+			}
+		}
+	}
+	if !bytes.Equal(rb.Bytes(), want.Bytes()) {
+		t.Fatal("content mismatch after grow")
+	}
+	if c := rb.Cap(); c&(c-1) != 0 {
+		t.Fatalf("cap %d is not power of two", c)
+	}
+	rb.release()
+	if rb.Len() != 0 || rb.Cap() != 0 {
+		t.Fatal("release")
+	}
+}
+
+func TestRingBufferReadvWritev(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal("Socketpair: ", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// 写缓冲区数据回绕, writev一次写出两段
+	wb := NewRingBuffer(minRingSize)
+	_, _ = wb.Write(make([]byte, minRingSize-8))
+	_, _ = wb.WriteString("abcd")
+	wb.Discard(minRingSize - 8)
+	_, _ = wb.WriteString("hello, ring buffer")
+	if _, tail := wb.Peek(0); len(tail) == 0 {
+		t.Fatal("expect wrapped data")
+	}
+	n, err := wb.writeFd(fds[0])
+	if err != nil || n != 22 || wb.Len() != 0 {
+		t.Fatalf("writeFd n %d err %v len %d", n, err, wb.Len())
+	}
+
+	// 读缓冲区空间不够, 多出来的数据经过extra追加
+	rb := NewRingBuffer(minRingSize)
+	_, _ = rb.Write(make([]byte, minRingSize-5))
+	extra := make([]byte, 64)
+	n, err = rb.readFd(fds[1], extra)
+	if err != nil || n != 22 {
+		t.Fatalf("readFd n %d err %v", n, err)
+	}
+	rb.Discard(minRingSize - 5)
+	if got := rb.String(); got != "abcdhello, ring buffer" {
+		t.Fatalf("readFd got %q", got)
+	}
+
+	if _, err = rb.readFd(fds[1], extra); err != syscall.EAGAIN {
+		t.Fatalf("readFd on empty socket: %v", err)
+	}
+}
@@ -1,8 +1,15 @@
-package main
+package kimenet
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -10,200 +17,472 @@ const (
 	Start   = 0
 	Stop    = 1
 	Gracing = 2
+
+	ShuttingDown = 3 // Shutdown中, 不再accept新连接
+)
+
+var (
+	ErrConnClosed = errors.New("kimenet: connection closed")
 )
 
 type Server struct {
-	State        int
+	State        int32
+	Network      string
 	Ip           string
 	Port         int
 	ListenFd     int
 	UnixListener *net.UnixListener
 	UnixServer   *net.UnixConn
-	evloop       *EventLoop
-	Conns        map[int]*Connection
-}
 
-func NewServer(ip string, port int) (srv *Server, err error) {
-	srv = new(Server)
-	// 1. create socketfd
-	socketFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
-	if err != nil || socketFd < 0 {
-		err = fmt.Errorf("syscall.Socket ERR")
-		return
-	}
+	mainLoop *EventLoop   // 负责accept的主EventLoop
+	loops    []*EventLoop // 负责连接读写的子EventLoop
+	nextLoop uint32
 
-	// 2. bind addr and port
-	ip4 := net.ParseIP(ip).To4()
-	if ip4 == nil {
-		err = fmt.Errorf("net.ParseIP err")
-		return
-	}
-	sa := &syscall.SockaddrInet4{Port: port}
-	copy(sa.Addr[:], ip4)
+	laddr            *ListenAddr
+	handler          Handler
+	packetHandler    PacketHandler
+	msgHandler       MessageHandler
+	watermarkHandler WatermarkHandler
+	limiter          *connLimiter
+
+	started      int32         // Start已经调用
+	listenClosed int32         // ListenFd已经关闭
+	done         chan struct{} // Start返回时关闭
+
+	graceChild   *graceChan // 平滑重启的子进程与父进程的交接通道, Start时接收连接
+	inheritedFds []int      // 从父进程接收的其他监听socket
 
-	err = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	tlsMu      sync.Mutex
+	tlsConfig  *tls.Config // 开启TLS时新连接使用的配置
+	ticketKeys [][32]byte  // session ticket密钥, 第一个用于加密
+	handshakes handshakeLimiter
+
+	proxyNets []*net.IPNet // 可以发送PROXY头部的来源
+
+	metricsLn net.Listener // Options.MetricsAddr的监听socket, 见metrics.go
+
+	connIDsMu sync.Mutex
+	connIDs   map[uint64]connRef // 连接ID所在的EventLoop和fd, 见registry.go
+
+	sockoptMu     sync.Mutex
+	sockoptErrors map[string]uint64 // 连接上被内核拒绝的socket选项的次数, 见sockopt.go
+
+	opts Options
+}
+
+// Serve 在addr上启动服务, 阻塞直到服务器停止; addr格式见ParseListenAddr
+func Serve(addr string, handler Handler, opts *Options) (err error) {
+	srv, err := NewServer(addr, handler, opts)
 	if err != nil {
 		return
 	}
-	err = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, 0xf, 1)
+	return srv.Start()
+}
+
+func NewServer(addr string, handler Handler, opts *Options) (srv *Server, err error) {
+	// 平滑重启启动的子进程先连上父进程, 使用父进程的监听socket
+	gc, err := graceDial(opts)
 	if err != nil {
 		return
 	}
+	srv, err = newServer(addr, handler, opts, gc)
+	if err != nil && gc != nil {
+		gc.close()
+	}
+	return
+}
 
-	err = syscall.Bind(socketFd, sa)
-	if err != nil {
-		err = fmt.Errorf("socket bind err: %s", err.Error())
+func newServer(addr string, handler Handler, opts *Options, gc *graceChan) (srv *Server, err error) {
+	if handler == nil {
+		err = fmt.Errorf("handler is nil")
 		return
 	}
 
-	// 3. listen
-	err = syscall.Listen(socketFd, 128)
+	la, err := ParseListenAddr(addr)
 	if err != nil {
-		err = fmt.Errorf("socket listen err: %s", err)
 		return
 	}
 
-	srv.Ip = ip
-	srv.Port = port
-	srv.ListenFd = socketFd
-	srv.Conns = make(map[int]*Connection, 1<<5)
+	srv = new(Server)
+	srv.handler = handler
+	srv.done = make(chan struct{})
+	if opts != nil {
+		srv.opts = *opts
+	}
 
-	return
-}
+	if la.IsPacket() {
+		var ok bool
+		if srv.packetHandler, ok = handler.(PacketHandler); !ok {
+			err = fmt.Errorf("handler of %s server must implement PacketHandler", la.Network)
+			return
+		}
+	}
 
-func (srv *Server) EventLoopCallback(fd int, event Event) (err error) {
+	if srv.opts.Codec != nil {
+		var ok bool
+		if srv.msgHandler, ok = handler.(MessageHandler); !ok {
+			err = fmt.Errorf("handler must implement MessageHandler when Codec is set")
+			return
+		}
+	} else {
+		srv.msgHandler, _ = handler.(MessageHandler)
+	}
 
-	fmt.Println("fd: ", fd)
-	fmt.Println("ListenFd: ", srv.ListenFd)
+	srv.watermarkHandler, _ = handler.(WatermarkHandler)
 
-	if fd == srv.ListenFd {
-		return srv.HandleAccept(fd)
+	if srv.opts.TLSConfig != nil {
+		if la.IsPacket() {
+			err = fmt.Errorf("TLS is not supported on %s", la.Network)
+			return
+		}
+		if srv.tlsConfig, err = newServerTLSConfig(srv.opts.TLSConfig); err != nil {
+			return
+		}
+		srv.handshakes.max = srv.opts.TLSMaxHandshakes
+		if srv.handshakes.max == 0 {
+			srv.handshakes.max = defaultTLSMaxHandshakes
+		}
+		if srv.opts.TLSTicketKeyRotation > 0 {
+			if err = srv.RotateTicketKeys(); err != nil {
+				return
+			}
+		}
 	}
-
-	if (event & READ_EVENT) != 0 {
-		err = srv.HandleRead(fd)
+	if srv.opts.ProxyProtocol {
+		if la.IsPacket() {
+			err = fmt.Errorf("proxy protocol is not supported on %s", la.Network)
+			return
+		}
+		if srv.proxyNets, err = parseProxyAllowlist(srv.opts.ProxyProtocolAllowlist); err != nil {
+			return
+		}
 	}
+	srv.limiter = newConnLimiter(&srv.opts)
+	srv.connIDs = make(map[uint64]connRef)
 
-	if (event & WRITE_EVNET) != 0 {
-		err = srv.HandleWrite(fd)
+	if srv.opts.ReusePort && la.Network == "unix" {
+		err = fmt.Errorf("ReusePort is not supported on unix socket")
+		return
 	}
 
-	return
-}
-
-func (srv *Server) HandleAccept(fd int) (err error) {
-	var (
-		acceptedFd int
-		sa         syscall.Sockaddr
-		conn       *Connection
-	)
-	fmt.Println("开始接收FD")
-	acceptedFd, sa, err = syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC) // syscall.SOCK_CLOEXEC 这里不能有这个
-	if err != nil {
-		if err == syscall.EAGAIN {
+	socketFd := -1
+	if gc != nil {
+		socketFd, err = srv.adoptListeners(gc, la)
+		if err != nil {
 			return
 		}
+		srv.graceChild = gc
+	} else if srv.opts.SystemdSocket {
+		var fds []int
+		fds, err = systemdListeners(la, srv.opts.SystemdSocketName)
+		if err != nil {
+			return
+		}
+		if len(fds) > 0 {
+			socketFd, srv.inheritedFds = fds[0], fds[1:]
+		}
+	}
+	if socketFd < 0 {
+		socketFd, err = listen(la, srv.opts.IPv6Only, srv.opts.ListenBacklog, srv.opts.SocketOptions)
+		if err != nil {
+			return
+		}
+	}
 
-		fmt.Println("accept err: ", err.Error())
-		return
+	srv.Network = la.Network
+	if la.IP != nil {
+		srv.Ip = la.IP.String()
 	}
+	srv.Port = la.Port
+	srv.ListenFd = socketFd
+	srv.laddr = la
 
-	conn, err = NewConnection(acceptedFd, sockAddrToString(sa))
+	err = srv.initLoops()
+	closeFds(srv.inheritedFds)
+	srv.inheritedFds = nil
 	if err != nil {
+		_ = syscall.Close(socketFd)
 		return
 	}
-	fmt.Println("新建连接成功")
-	srv.Conns[acceptedFd] = conn
-	err = srv.evloop.AddRead(acceptedFd)
 
+	if srv.opts.MetricsAddr != "" {
+		if err = srv.listenMetrics(); err != nil {
+			srv.closeListenFd()
+			srv.closeLoops()
+			return
+		}
+	}
 	return
 }
 
-func (srv *Server) HandleRead(fd int) (err error) {
-	var (
-		buf       = make([]byte, 1024)
-		readN     int
-		bufWriteN int
-	)
+// initLoops 创建EventLoop; 只有一个EventLoop时它同时负责accept和读写
+func (srv *Server) initLoops() (err error) {
+	num := srv.opts.NumLoops
+	if num <= 0 {
+		num = runtime.GOMAXPROCS(0)
+	}
+
+	for i := 0; i < num; i++ {
+		var el *EventLoop
+		el, err = NewEventLoop()
+		if err != nil {
+			srv.closeLoops()
+			return fmt.Errorf("NewEventLoop err: %s", err.Error())
+		}
+		el.serv = srv
+		el.idx = i
+		if srv.opts.ReadBudget > 0 {
+			el.readBudget = srv.opts.ReadBudget
+		}
+		if srv.opts.WriteBudget > 0 {
+			el.writeBudget = srv.opts.WriteBudget
+		}
+		srv.loops = append(srv.loops, el)
+	}
+
+	if srv.opts.ReusePort {
+		return srv.initReusePortListeners()
+	}
 
-	if conn, ok := srv.Conns[fd]; ok {
-		readN, err = syscall.Read(conn.Fd, buf)
+	// udp没有accept, 数据报socket直接由第一个EventLoop处理
+	if num == 1 || srv.laddr.IsPacket() {
+		srv.mainLoop = srv.loops[0]
+	} else {
+		srv.mainLoop, err = NewEventLoop()
 		if err != nil {
-			if err == syscall.EAGAIN {
-				err = nil
-				fmt.Println("READ EAGIN")
+			srv.closeLoops()
+			return fmt.Errorf("NewEventLoop err: %s", err.Error())
+		}
+		srv.mainLoop.serv = srv
+		srv.mainLoop.idx = -1
+	}
+
+	err = srv.mainLoop.attachListener(srv.ListenFd)
+	if err != nil {
+		srv.closeLoops()
+		return fmt.Errorf("add ListenFd err: %s", err.Error())
+	}
+	return
+}
+
+// initReusePortListeners 每个EventLoop绑定自己的SO_REUSEPORT监听socket, 由内核在它们之间分配新连接
+// 第一个EventLoop使用NewServer创建的socket, 同时它也是主EventLoop
+func (srv *Server) initReusePortListeners() (err error) {
+	srv.mainLoop = srv.loops[0]
+	for i, el := range srv.loops {
+		fd := srv.ListenFd
+		if i > 0 && len(srv.inheritedFds) > 0 {
+			// 平滑重启时使用父进程同一SO_REUSEPORT组中的socket
+			fd, srv.inheritedFds = srv.inheritedFds[0], srv.inheritedFds[1:]
+		} else if i > 0 {
+			fd, err = listen(srv.laddr, srv.opts.IPv6Only, srv.opts.ListenBacklog, srv.opts.SocketOptions)
+			if err != nil {
+				srv.closeLoops()
 				return
 			}
-			fmt.Println("Read err: ", err.Error())
-			_ = srv.CloseFd(fd)
-			return
 		}
+		err = el.attachListener(fd)
+		if err != nil {
+			srv.closeLoops()
+			return fmt.Errorf("add ListenFd err: %s", err.Error())
+		}
+	}
 
-		if readN == 0 {
-			fmt.Println("Read EOL")
-			_ = srv.CloseFd(fd)
+	if srv.opts.ReusePortCPUSteering {
+		err = attachCPUSteering(srv.ListenFd, len(srv.loops))
+		if err != nil {
+			srv.closeLoops()
 			return
 		}
+	}
+	return
+}
+
+func (srv *Server) closeLoops() {
+	for _, el := range srv.loops {
+		if el.listenFd >= 0 && el.listenFd != srv.ListenFd {
+			_ = syscall.Close(el.listenFd)
+			el.listenFd = -1
+		}
+		if e := el.Close(); e != nil {
+			fmt.Println("EventLoop.Close() err: ", e.Error())
+		}
+	}
+	if srv.mainLoop != nil && srv.mainLoop.idx < 0 {
+		if e := srv.mainLoop.Close(); e != nil {
+			fmt.Println("EventLoop.Close() err: ", e.Error())
+		}
+	}
+}
+
+// Addr 实际监听的地址
+func (srv *Server) Addr() string {
+	return srv.laddr.String()
+}
+
+// Loops 返回负责连接读写的EventLoop
+func (srv *Server) Loops() []*EventLoop {
+	return srv.loops
+}
 
-		if readN > 0 {
-			conn.ReadBuff.Write(buf[:readN])
+// Start 开始处理事件, 阻塞直到服务器停止
+func (srv *Server) Start() (err error) {
+	if !atomic.CompareAndSwapInt32(&srv.started, 0, 1) {
+		return fmt.Errorf("server already started")
+	}
+	defer close(srv.done)
+
+	if srv.opts.HandleSignal {
+		go srv.handleSignal()
+	}
+
+	graceChild := srv.graceChild != nil
+	if graceChild {
+		err = srv.ChildReceiveFds()
+		if err != nil {
+			srv.closeListenFd()
+			srv.closeLoops()
+			return
 		}
+	}
 
-		// 业务逻辑处理
-		if conn.ReadBuff.Len() > 0 {
-			bufWriteN, _ = conn.WriteBuff.Write(conn.ReadBuff.Bytes())
-			if bufWriteN > 0 {
-				_ = srv.evloop.ModReadWrite(conn.Fd) // 修改为监听写事件
-				conn.ReadBuff.Reset()
-			}
+	sdNotifyReady(graceChild)
+	if interval := watchdogInterval(graceChild); interval > 0 {
+		go srv.watchdog(interval)
+	}
+	if srv.tlsConfig != nil && srv.opts.TLSTicketKeyRotation > 0 {
+		go srv.rotateTicketKeysLoop(srv.opts.TLSTicketKeyRotation)
+	}
+	if srv.metricsLn != nil {
+		srv.serveMetrics()
+	}
+
+	fmt.Println(os.Getpid(), "开始处理主服务器任务")
+
+	var wg sync.WaitGroup
+	for _, el := range srv.loops {
+		if el == srv.mainLoop {
+			continue
 		}
+		wg.Add(1)
+		go func(el *EventLoop) {
+			defer wg.Done()
+			if e := el.Poll(el.handleEvent); e != nil {
+				fmt.Println("Poll err: ", e.Error())
+			}
+		}(el)
 	}
 
+	err = srv.mainLoop.Poll(srv.mainLoop.handleEvent)
+	if err != nil {
+		fmt.Println("Poll err: ", err.Error())
+	}
+	wg.Wait()
+
+	srv.closeListenFd()
+	srv.closeLoops()
+	fmt.Println("服务器停止")
 	return
 }
 
-func (srv *Server) HandleWrite(fd int) (err error) {
+// Stop 停止服务器, 唤醒所有EventLoop退出
+func (srv *Server) Stop() {
+	sdNotifyStopping(atomic.SwapInt32(&srv.State, Stop))
+	for _, el := range srv.allLoops() {
+		el.wake()
+	}
+}
+
+// runOnLoops 在每个EventLoop协程中执行f, 等待全部执行完毕; EventLoop必须在运行中
+func (srv *Server) runOnLoops(f func(el *EventLoop)) {
+	srv.runOn(srv.loops, f)
+}
+
+// runOnAllLoops 同runOnLoops, 包括单独负责accept的主EventLoop
+func (srv *Server) runOnAllLoops(f func(el *EventLoop)) {
+	srv.runOn(srv.allLoops(), f)
+}
+
+func (srv *Server) runOn(loops []*EventLoop, f func(el *EventLoop)) {
+	var wg sync.WaitGroup
+	for _, el := range loops {
+		wg.Add(1)
+		el := el
+		el.Execute(func() {
+			defer wg.Done()
+			f(el)
+		})
+	}
+	wg.Wait()
+}
+
+func (srv *Server) state() int32 {
+	return atomic.LoadInt32(&srv.State)
+}
 
+// HandleAccept 在el上accept新连接
+func (srv *Server) HandleAccept(el *EventLoop, fd int) (err error) {
 	var (
-		writeN int
+		acceptedFd int
+		sa         syscall.Sockaddr
+		conn       *Connection
 	)
-	if conn, ok := srv.Conns[fd]; ok {
-		if conn.WriteBuff.Len() > 0 {
-			writeN, err = syscall.Write(fd, conn.WriteBuff.Bytes())
-			if err != nil {
-				if err == syscall.EAGAIN {
-					err = nil
-					fmt.Println("WRITE EAGIN")
-					return
-				}
-				fmt.Println("Write err: ", err.Error())
-				_ = srv.CloseFd(fd)
-				return
-			}
+	switch srv.state() {
+	case Gracing, ShuttingDown, Stop:
+		// 平滑重启中由子进程accept
+		return
+	}
 
-			if writeN < 0 {
-				fmt.Println("Write 0")
-				return
-			}
+	acceptedFd, sa, err = syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC) // syscall.SOCK_CLOEXEC 这里不能有这个
+	if err != nil {
+		if err == syscall.EAGAIN {
+			err = nil
+			return
+		}
+		atomic.AddUint64(&el.metrics.acceptErrors, 1)
+		if err == syscall.EMFILE || err == syscall.ENFILE {
+			srv.acceptWithReserve(el, fd)
+		}
+		return
+	}
+	atomic.AddUint64(&el.metrics.accepts, 1)
 
-			if writeN == conn.WriteBuff.Len() {
-				conn.WriteBuff.Reset()
-				_ = srv.evloop.ModRead(conn.Fd)
-			}
+	conn, err = NewConnection(acceptedFd, sockAddrToString(sa))
+	if err != nil {
+		_ = syscall.Close(acceptedFd)
+		return
+	}
+	conn.proxyState = srv.proxyState(sa)
 
-			if writeN < conn.WriteBuff.Len() {
-				conn.WriteBuff.Truncate(writeN)
-				srv.evloop.ModReadWrite(conn.Fd)
-			}
-		}
+	if reason := srv.limiter.admit(conn, sa, el.now); reason != nil {
+		srv.reject(acceptedFd, reason)
+		return
 	}
+	conn.register()
 
+	// SO_REUSEPORT模式下由accept的EventLoop自己处理, 否则按负载均衡策略选择一个EventLoop
+	target := el
+	if !srv.opts.ReusePort {
+		target = srv.pickLoop(sa)
+	}
+	if target == el {
+		atomic.AddInt32(&el.connCount, 1)
+		return el.openConn(conn)
+	}
+
+	target.register(conn)
 	return
 }
 
-func (srv *Server) CloseFd(fd int) (err error) {
-	err = syscall.Close(fd)
-	err = srv.evloop.Remove(fd)
-	delete(srv.Conns, fd)
-	return
+func sockAddrToString(sa syscall.Sockaddr) string {
+	switch sa := (sa).(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrUnix:
+		return sa.Name
+	default:
+		return fmt.Sprintf("(unknow - %T)", sa)
+	}
 }
@@ -0,0 +1,382 @@
+package kimenet
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type echoHandler struct {
+	BaseHandler
+	closed chan error
+}
+
+func (h *echoHandler) OnData(conn *Connection) {
+	_, _ = conn.Write(conn.ReadBuff.Bytes())
+	conn.ReadBuff.Reset()
+}
+
+func (h *echoHandler) OnClose(conn *Connection, err error) {
+	h.closed <- err
+}
+
+func startTestServer(t *testing.T, h Handler, opts *Options, addr ...string) *Server {
+	listenAddr := "127.0.0.1:0"
+	if len(addr) > 0 {
+		listenAddr = addr[0]
+	}
+	srv, err := NewServer(listenAddr, h, opts)
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	return srv
+}
+
+func testAddr(srv *Server) string {
+	return srv.Addr()
+}
+
+func testEcho(t *testing.T, network, addr string, msg []byte) {
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal("Write: ", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("echo mismatch %q", got)
+	}
+}
+
+func TestServerEcho(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 1)}
+	srv := startTestServer(t, h, nil)
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	msg := bytes.Repeat([]byte("kimenet"), 1000)
+	if _, err = c.Write(msg); err != nil {
+		t.Fatal("Write: ", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err = io.ReadFull(c, got); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("echo mismatch")
+	}
+
+	_ = c.Close()
+	select {
+	case err = <-h.closed:
+		if err != io.EOF {
+			t.Error("OnClose err: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("OnClose not called")
+	}
+}
+
+func TestServerMultiLoop(t *testing.T) {
+	for _, lb := range []LoadBalance{RoundRobin, LeastConnections, SourceAddrHash} {
+		h := &echoHandler{closed: make(chan error, 8)}
+		srv := startTestServer(t, h, &Options{NumLoops: 4, LoadBalance: lb})
+
+		var conns []net.Conn
+		for i := 0; i < 8; i++ {
+			c, err := net.Dial("tcp", testAddr(srv))
+			if err != nil {
+				t.Fatal("Dial: ", err)
+			}
+			_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+			conns = append(conns, c)
+		}
+
+		for i, c := range conns {
+			msg := []byte("hello " + strconv.Itoa(i))
+			if _, err := c.Write(msg); err != nil {
+				t.Fatal("Write: ", err)
+			}
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal("ReadFull: ", err)
+			}
+			if !bytes.Equal(got, msg) {
+				t.Fatalf("lb %d: echo mismatch %q", lb, got)
+			}
+		}
+
+		total := 0
+		for _, el := range srv.Loops() {
+			total += el.ConnCount()
+		}
+		if total != len(conns) {
+			t.Errorf("lb %d: ConnCount total %d, want %d", lb, total, len(conns))
+		}
+		if lb == RoundRobin {
+			for _, el := range srv.Loops() {
+				if el.ConnCount() != 2 {
+					t.Errorf("round robin: loop %d has %d conns", el.idx, el.ConnCount())
+				}
+			}
+		}
+
+		for _, c := range conns {
+			_ = c.Close()
+		}
+		srv.Stop()
+	}
+}
+
+func TestServerReusePort(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 16)}
+	srv := startTestServer(t, h, &Options{NumLoops: 4, ReusePort: true})
+	defer srv.Stop()
+
+	for _, el := range srv.Loops() {
+		if el.listenFd < 0 {
+			t.Fatalf("loop %d has no listener", el.idx)
+		}
+	}
+
+	for i := 0; i < 16; i++ {
+		testEcho(t, "tcp", testAddr(srv), []byte("reuseport "+strconv.Itoa(i)))
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	cases := []struct {
+		addr    string
+		network string
+		str     string
+		bad     bool
+	}{
+		{addr: "127.0.0.1:9192", network: "tcp", str: "127.0.0.1:9192"},
+		{addr: ":9192", network: "tcp", str: "0.0.0.0:9192"},
+		{addr: "tcp4://0.0.0.0:80", network: "tcp4", str: "0.0.0.0:80"},
+		{addr: "tcp6://[::]:9192", network: "tcp6", str: "[::]:9192"},
+		{addr: "tcp6://:9192", network: "tcp6", str: "[::]:9192"},
+		{addr: "tcp://[::1]:9192", network: "tcp", str: "[::1]:9192"},
+		{addr: "udp://127.0.0.1:53", network: "udp", str: "127.0.0.1:53"},
+		{addr: "udp6://[::1]:53", network: "udp6", str: "[::1]:53"},
+		{addr: "unix:///run/app.sock", network: "unix", str: "/run/app.sock"},
+		{addr: "unix://@kimenet", network: "unix", str: "@kimenet"},
+		{addr: "tcp4://[::1]:80", bad: true},
+		{addr: "tcp6://127.0.0.1:80", bad: true},
+		{addr: "udp7://127.0.0.1:80", bad: true},
+		{addr: "unix://", bad: true},
+		{addr: "127.0.0.1", bad: true},
+	}
+
+	for _, c := range cases {
+		la, err := ParseListenAddr(c.addr)
+		if c.bad {
+			if err == nil {
+				t.Errorf("%s: expect error", c.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.addr, err)
+			continue
+		}
+		if la.Network != c.network || la.String() != c.str {
+			t.Errorf("%s: got %s %s", c.addr, la.Network, la.String())
+		}
+	}
+}
+
+func TestServerIPv6DualStack(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 4)}
+	srv, err := NewServer("tcp://[::]:0", h, &Options{NumLoops: 1})
+	if err != nil {
+		t.Skip("ipv6 not available: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	port := strconv.Itoa(srv.Port)
+	testEcho(t, "tcp6", "[::1]:"+port, []byte("over ipv6"))
+	testEcho(t, "tcp4", "127.0.0.1:"+port, []byte("over ipv4"))
+}
+
+func TestServerUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kimenet.sock")
+	for _, addr := range []string{path, "@kimenet-test-" + strconv.Itoa(os.Getpid())} {
+		h := &echoHandler{closed: make(chan error, 4)}
+		srv := startTestServer(t, h, &Options{NumLoops: 2}, "unix://"+addr)
+		testEcho(t, "unix", addr, []byte("over unix socket"))
+		srv.Stop()
+	}
+}
+
+type udpEchoHandler struct {
+	BaseHandler
+}
+
+func (h *udpEchoHandler) OnPacket(pc *PacketConn, data []byte, from syscall.Sockaddr) {
+	_ = pc.WriteTo(data, from)
+}
+
+func TestServerUDP(t *testing.T) {
+	cases := []struct {
+		addr string
+		opts *Options
+	}{
+		{addr: "udp://127.0.0.1:0", opts: &Options{NumLoops: 2}},
+		{addr: "udp://127.0.0.1:0", opts: &Options{NumLoops: 2, ReusePort: true, PacketBatch: 4}},
+		{addr: "udp6://[::1]:0", opts: &Options{NumLoops: 1}},
+	}
+	for _, cs := range cases {
+		srv, err := NewServer(cs.addr, &udpEchoHandler{}, cs.opts)
+		if err != nil {
+			t.Log("NewServer: ", err)
+			continue
+		}
+		go func() {
+			_ = srv.Start()
+		}()
+
+		c, err := net.Dial("udp", srv.Addr())
+		if err != nil {
+			t.Fatal("Dial: ", err)
+		}
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// 一次发出多个数据报, 验证recvmmsg/sendmmsg批量收发
+		for i := 0; i < 10; i++ {
+			if _, err = c.Write([]byte("packet " + strconv.Itoa(i))); err != nil {
+				t.Fatal("Write: ", err)
+			}
+		}
+		got := make(map[string]bool)
+		buf := make([]byte, 1024)
+		for i := 0; i < 10; i++ {
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatal("Read: ", err)
+			}
+			got[string(buf[:n])] = true
+		}
+		for i := 0; i < 10; i++ {
+			if !got["packet "+strconv.Itoa(i)] {
+				t.Errorf("packet %d not echoed", i)
+			}
+		}
+
+		_ = c.Close()
+		srv.Stop()
+	}
+}
+
+func TestServerUDPNeedPacketHandler(t *testing.T) {
+	if _, err := NewServer("udp://127.0.0.1:0", &echoHandler{}, nil); err == nil {
+		t.Error("expect error for handler without OnPacket")
+	}
+}
+
+func TestServerEdgeTriggered(t *testing.T) {
+	for _, opts := range []*Options{
+		{NumLoops: 2, ReadBudget: 4096, WriteBudget: 4096},
+		{NumLoops: 2, EdgeTriggered: true},
+		{NumLoops: 2, EdgeTriggered: true, ReadBudget: 4096, WriteBudget: 4096},
+	} {
+		h := &echoHandler{closed: make(chan error, 4)}
+		srv := startTestServer(t, h, opts)
+
+		c, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatal("Dial: ", err)
+		}
+		_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+
+		// 大于socket缓冲区的数据, 需要多轮读写才能完成
+		msg := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+		go func() {
+			_, _ = c.Write(msg)
+		}()
+		got := make([]byte, len(msg))
+		if _, err = io.ReadFull(c, got); err != nil {
+			t.Fatal("ReadFull: ", err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("%+v: echo mismatch", *opts)
+		}
+
+		_ = c.Close()
+		select {
+		case err = <-h.closed:
+			if err != io.EOF {
+				t.Errorf("%+v: OnClose err: %v", *opts, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%+v: OnClose not called", *opts)
+		}
+		srv.Stop()
+	}
+}
+
+// udpDelayHandler 在定时器中回复, 不在OnPacket的收取流程中
+type udpDelayHandler struct {
+	BaseHandler
+}
+
+func (h *udpDelayHandler) OnPacket(pc *PacketConn, data []byte, from syscall.Sockaddr) {
+	b := append([]byte(nil), data...)
+	pc.Loop().AfterFunc(10*time.Millisecond, func() {
+		_ = pc.WriteTo(b, from)
+	})
+}
+
+func TestServerUDPWriteFromTimer(t *testing.T) {
+	srv, err := NewServer("udp://127.0.0.1:0", &udpDelayHandler{}, &Options{NumLoops: 1})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+
+	c, err := net.Dial("udp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for i := 0; i < 3; i++ {
+		msg := "delayed " + strconv.Itoa(i)
+		if _, err = c.Write([]byte(msg)); err != nil {
+			t.Fatal("Write: ", err)
+		}
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("Read %q %v", buf[:n], err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package kimenet
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Session 平滑重启时需要迁移到子进程的连接状态, 例如认证信息、协议解析的位置
+// 放在Connection.Context中的值实现了Session时, 父进程把它编码后和连接一起交给子进程
+// 用SetHandler/SetCodec单独设置过Handler或Codec的连接, Context必须是Session才会迁移, 由SessionDecoder重新设置它们
+type Session interface {
+	// SessionType 类型名, 子进程用它在注册表中找到解码函数
+	SessionType() string
+
+	// MarshalSession 编码状态
+	MarshalSession() ([]byte, error)
+}
+
+// Migratable Connection.Context可以选择实现它, 返回false时连接这次不迁移, 留在父进程中按Shutdown的流程关闭
+// 用于协议处理到一半、状态没法交给子进程的连接, 例如正在处理请求
+type Migratable interface {
+	Migratable() bool
+}
+
+// SessionDecoder 子进程中用编码后的状态恢复Connection.Context
+// 调用时连接还没有加入EventLoop, 不能读写, 可以调用SetHandler和SetCodec
+type SessionDecoder func(conn *Connection, data []byte) (Session, error)
+
+// RestoreHandler Handler可以选择实现它, 子进程接手父进程的连接后在连接所属的EventLoop协程中回调
+// 迁移过来的连接不会回调OnOpen
+type RestoreHandler interface {
+	OnRestore(conn *Connection)
+}
+
+var (
+	sessionMu       sync.RWMutex
+	sessionDecoders = make(map[string]SessionDecoder)
+)
+
+// RegisterSession 注册Session类型的解码函数, 一般在init中调用, 父子进程都要注册
+// 同一个类型名重复注册时panic
+func RegisterSession(typ string, dec SessionDecoder) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if dec == nil {
+		panic("kimenet: RegisterSession decoder is nil")
+	}
+	if _, dup := sessionDecoders[typ]; dup {
+		panic("kimenet: RegisterSession called twice for " + typ)
+	}
+	sessionDecoders[typ] = dec
+}
+
+// marshalSession 编码连接的Session, Context没有实现Session时返回空类型名
+func marshalSession(conn *Connection) (typ string, data []byte, err error) {
+	s, ok := conn.Context.(Session)
+	if !ok {
+		return
+	}
+	typ = s.SessionType()
+	data, err = s.MarshalSession()
+	if err != nil {
+		err = fmt.Errorf("marshal session %s: %s", typ, err.Error())
+	}
+	return
+}
+
+// DecodeSession 用注册的解码函数解码Session, 用于协议层的Session中嵌套使用者自己的Session
+func DecodeSession(conn *Connection, typ string, data []byte) (s Session, err error) {
+	sessionMu.RLock()
+	dec := sessionDecoders[typ]
+	sessionMu.RUnlock()
+	if dec == nil {
+		return nil, fmt.Errorf("session type %s not registered", typ)
+	}
+	if s, err = dec(conn, data); err != nil {
+		err = fmt.Errorf("restore session %s: %s", typ, err.Error())
+	}
+	return
+}
+
+// restoreSession 用注册的解码函数恢复连接的Context
+func restoreSession(conn *Connection, typ string, data []byte) (err error) {
+	if typ == "" {
+		return
+	}
+	s, err := DecodeSession(conn, typ, data)
+	if err != nil {
+		return
+	}
+	conn.Context = s
+	return
+}
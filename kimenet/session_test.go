@@ -0,0 +1,130 @@
+package kimenet
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// counterSession 记录连接上收到的请求数
+type counterSession struct {
+	typ string
+	n   int
+}
+
+func (s *counterSession) SessionType() string { return s.typ }
+
+func (s *counterSession) MarshalSession() ([]byte, error) {
+	return []byte(strconv.Itoa(s.n)), nil
+}
+
+func init() {
+	RegisterSession("test.counter", func(conn *Connection, data []byte) (Session, error) {
+		n, err := strconv.Atoi(string(data))
+		if err != nil {
+			return nil, err
+		}
+		return &counterSession{typ: "test.counter", n: n}, nil
+	})
+}
+
+// counterHandler 每收到一个请求回复连接上的请求序号
+type counterHandler struct {
+	BaseHandler
+	typ      string
+	restored chan int
+}
+
+func (h *counterHandler) OnOpen(conn *Connection) {
+	conn.Context = &counterSession{typ: h.typ}
+}
+
+func (h *counterHandler) OnData(conn *Connection) {
+	s := conn.Context.(*counterSession)
+	s.n++
+	conn.ReadBuff.Reset()
+	_, _ = conn.Write([]byte(strconv.Itoa(s.n)))
+}
+
+func (h *counterHandler) OnRestore(conn *Connection) {
+	h.restored <- conn.Context.(*counterSession).n
+}
+
+func TestGraceSession(t *testing.T) {
+	srvA := startTestServer(t, &counterHandler{typ: "test.counter"}, &Options{NumLoops: 1})
+	addr := testAddr(srvA)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	expectReply(t, c, "x", "1")
+	expectReply(t, c, "x", "2")
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	hB := &counterHandler{typ: "test.counter", restored: make(chan int, 1)}
+	srvB, err := newServer(addr, hB, &Options{NumLoops: 1}, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	defer srvB.Stop()
+	go func() {
+		_ = srvB.Start()
+	}()
+	if err = <-errCh; err != nil {
+		t.Fatal("handoff: ", err)
+	}
+
+	select {
+	case n := <-hB.restored:
+		if n != 2 {
+			t.Fatalf("restored session n=%d, want 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnRestore not called")
+	}
+	expectReply(t, c, "x", "3")
+}
+
+func TestGraceSessionNotRegistered(t *testing.T) {
+	srvA := startTestServer(t, &counterHandler{typ: "test.unknown"}, &Options{NumLoops: 1})
+	defer srvA.Stop()
+	addr := testAddr(srvA)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	expectReply(t, c, "x", "1")
+
+	pc, cc := gracePair(t)
+	defer pc.close()
+	srvA.pauseListeners()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srvA.handoff(pc)
+	}()
+
+	srvB, err := newServer(addr, &counterHandler{typ: "test.unknown"}, &Options{NumLoops: 1}, cc)
+	if err != nil {
+		t.Fatal("newServer: ", err)
+	}
+	if err = srvB.Start(); err == nil {
+		t.Fatal("child Start should fail")
+	}
+	if err = <-errCh; err == nil {
+		t.Fatal("handoff should fail")
+	}
+	srvA.resumeListeners()
+
+	// 连接和状态都留在父进程
+	expectReply(t, c, "x", "2")
+}
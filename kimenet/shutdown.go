@@ -0,0 +1,161 @@
+package kimenet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrServerShutdown   = errors.New("kimenet: server shutdown")
+	ErrServerNotStarted = errors.New("kimenet: server not started")
+)
+
+// ShutdownHandler Handler可以选择实现它, 在Shutdown开始时对每个连接回调
+// 处理完正在进行的请求后调用Close或CloseWrite; 没有实现时Shutdown直接对连接调用CloseWrite
+type ShutdownHandler interface {
+	OnShutdown(conn *Connection)
+}
+
+// ShutdownStats Shutdown的结果
+type ShutdownStats struct {
+	Drained int // 在ctx结束前正常关闭的连接数
+	Killed  int // ctx结束时被强制关闭的连接数, OnClose的err为ErrServerShutdown
+}
+
+// killTimeout ctx结束后强制关闭连接最多等待的时间, EventLoop卡在Handler中时不再等待
+const killTimeout = time.Second
+
+// Shutdown 平滑关闭服务器: 停止accept, 让连接发送完写缓冲区的数据后半关闭, 等对端关闭后关闭连接,
+// ctx结束时强制关闭剩下的连接; 返回时EventLoop都已经退出, 有连接被强制关闭时err为ctx.Err()
+// 服务器已经Stop或者正在Shutdown时直接返回ErrServerShutdown
+func (srv *Server) Shutdown(ctx context.Context) (stats ShutdownStats, err error) {
+	if atomic.LoadInt32(&srv.started) == 0 {
+		return stats, ErrServerNotStarted
+	}
+	for {
+		prev := srv.state()
+		if prev == ShuttingDown || prev == Stop {
+			return stats, ErrServerShutdown
+		}
+		if atomic.CompareAndSwapInt32(&srv.State, prev, ShuttingDown) {
+			sdNotifyStopping(prev)
+			break
+		}
+	}
+	select {
+	case <-srv.done:
+		return stats, ErrServerShutdown
+	default:
+	}
+
+	var total int32
+	err = srv.closeListeners(ctx)
+	if err == nil {
+		err = srv.runOnCtx(ctx, srv.loops, func(el *EventLoop) {
+			for _, conn := range el.conns {
+				if conn.connecting {
+					_ = el.closeConn(conn, ErrServerShutdown)
+					continue
+				}
+				atomic.AddInt32(&total, 1)
+				if sh, ok := conn.getHandler().(ShutdownHandler); ok {
+					sh.OnShutdown(conn)
+				} else {
+					_ = conn.CloseWrite()
+				}
+			}
+		})
+	}
+	if err == ErrServerShutdown {
+		// EventLoop已经退出, 例如期间调用了Stop
+		return
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for err == nil && srv.connCount() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-srv.done:
+			return stats, ErrServerShutdown
+		}
+	}
+	if err != nil {
+		stats.Killed = srv.killConns()
+	}
+	stats.Drained = int(total) - stats.Killed
+	if stats.Drained < 0 {
+		// 强制关闭的连接包括Shutdown开始之后Dial的连接
+		stats.Drained = 0
+	}
+
+	srv.Stop()
+	<-srv.done
+	fmt.Println("服务器平滑关闭: ", stats.Drained, "个连接正常关闭, ", stats.Killed, "个连接强制关闭")
+	return
+}
+
+// killConns 强制关闭所有连接, 返回关闭的连接数; 最多等待killTimeout或者EventLoop退出
+func (srv *Server) killConns() int {
+	ctx, cancel := context.WithTimeout(context.Background(), killTimeout)
+	defer cancel()
+	var killed int32
+	_ = srv.runOnCtx(ctx, srv.loops, func(el *EventLoop) {
+		for _, conn := range el.conns {
+			_ = el.closeConn(conn, ErrServerShutdown)
+			atomic.AddInt32(&killed, 1)
+		}
+	})
+	return int(atomic.LoadInt32(&killed))
+}
+
+// closeListeners 在各自的EventLoop协程中停止监听并关闭监听socket, 新连接会被内核拒绝
+// 最多等到ctx结束或者EventLoop退出
+func (srv *Server) closeListeners(ctx context.Context) (err error) {
+	if srv.laddr.IsPacket() {
+		return
+	}
+	return srv.runOnCtx(ctx, srv.allLoops(), func(el *EventLoop) {
+		if el.listenFd < 0 {
+			return
+		}
+		_ = el.Remove(el.listenFd)
+		if el.listenFd == srv.ListenFd {
+			srv.closeListenFd()
+		} else {
+			_ = syscall.Close(el.listenFd)
+		}
+		el.listenFd = -1
+	})
+}
+
+// closeListenFd 关闭NewServer创建的监听socket, 只关闭一次
+func (srv *Server) closeListenFd() {
+	if !atomic.CompareAndSwapInt32(&srv.listenClosed, 0, 1) {
+		return
+	}
+	if e := syscall.Close(srv.ListenFd); e != nil { // 必须关闭这个FD; 要不底层还能监听
+		fmt.Println("syscall.Close err: ", e.Error())
+	}
+}
+
+// allLoops 包括单独负责accept的主EventLoop
+func (srv *Server) allLoops() []*EventLoop {
+	if srv.mainLoop != nil && srv.mainLoop.idx < 0 {
+		return append([]*EventLoop{srv.mainLoop}, srv.loops...)
+	}
+	return srv.loops
+}
+
+func (srv *Server) connCount() (n int) {
+	for _, el := range srv.loops {
+		n += el.ConnCount()
+	}
+	return
+}
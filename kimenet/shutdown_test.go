@@ -0,0 +1,121 @@
+package kimenet
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+type shutdownHandler struct {
+	echoHandler
+	pending map[*Connection]bool
+}
+
+// OnData 收到"wait"的连接模拟还有请求在处理, Shutdown时不关闭
+func (h *shutdownHandler) OnData(conn *Connection) {
+	if conn.ReadBuff.String() == "wait" {
+		h.pending[conn] = true
+	}
+	h.echoHandler.OnData(conn)
+}
+
+func (h *shutdownHandler) OnShutdown(conn *Connection) {
+	if !h.pending[conn] {
+		_, _ = conn.Write([]byte("bye"))
+		_ = conn.CloseWrite()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	h := &shutdownHandler{echoHandler: echoHandler{closed: make(chan error, 8)}, pending: make(map[*Connection]bool)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1})
+	addr := testAddr(srv)
+
+	// c1收到bye和EOF后关闭, 正常排空; c2一直不关闭, 最后被强制关闭
+	c1 := dialOpen(t, addr)
+	defer c1.Close()
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c2.Close()
+	_ = c2.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = c2.Write([]byte("wait"))
+	if _, err = io.ReadFull(c2, make([]byte, 4)); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+
+	go func() {
+		got, _ := ioutil.ReadAll(c1)
+		if string(got) == "bye" {
+			c1.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	stats, err := srv.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown err: %v", err)
+	}
+	if stats.Drained != 1 || stats.Killed != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// 监听socket已经关闭
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Fatal("dial after Shutdown should fail")
+	}
+}
+
+func TestShutdownIdle(t *testing.T) {
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 1)}, &Options{NumLoops: 2})
+	time.Sleep(20 * time.Millisecond)
+	stats, err := srv.Shutdown(context.Background())
+	if err != nil || stats.Drained != 0 || stats.Killed != 0 {
+		t.Fatalf("Shutdown %+v %v", stats, err)
+	}
+}
+
+// shutdownWithin 在d内返回Shutdown的结果, 卡住时测试失败
+func shutdownWithin(t *testing.T, srv *Server, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := srv.Shutdown(ctx)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(d):
+		t.Fatal("Shutdown hangs")
+	}
+	return nil
+}
+
+func TestShutdownAfterStop(t *testing.T) {
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 1)}, &Options{NumLoops: 2})
+	testEcho(t, "tcp", srv.Addr(), []byte("hi"))
+	srv.Stop()
+	<-srv.done
+	if err := shutdownWithin(t, srv, 2*time.Second); err != ErrServerShutdown {
+		t.Fatalf("Shutdown after Stop %v", err)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 1)}, &Options{NumLoops: 2})
+	testEcho(t, "tcp", srv.Addr(), []byte("hi"))
+	if err := shutdownWithin(t, srv, 2*time.Second); err != nil {
+		t.Fatalf("first Shutdown %v", err)
+	}
+	if err := shutdownWithin(t, srv, 2*time.Second); err != ErrServerShutdown {
+		t.Fatalf("second Shutdown %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package kimenet
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// syscall包里没有定义的选项
+const (
+	tcpFastOpen    = 23 // TCP_FASTOPEN
+	tcpUserTimeout = 18 // TCP_USER_TIMEOUT
+)
+
+// SocketOptions socket选项, 零值的字段不设置, 使用内核默认值
+// 用于Options.SocketOptions(监听socket和每个连接)和Connection.SetSocketOptions(单个连接)
+type SocketOptions struct {
+	// TCP_NODELAY, 关闭Nagle算法
+	NoDelay bool
+
+	// SO_KEEPALIVE, 以及空闲多久开始探测(TCP_KEEPIDLE)、探测间隔(TCP_KEEPINTVL)、探测次数(TCP_KEEPCNT)
+	// 设置了Idle/Interval/Count任意一个时也会打开KeepAlive; 时间按秒设置, 不足1秒按1秒
+	KeepAlive         bool
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// SO_RCVBUF/SO_SNDBUF(字节), 内核实际使用两倍, 并且不超过net.core.rmem_max/wmem_max
+	// 在监听socket上设置时accept的连接继承, 窗口扩大因子在握手时就确定了
+	RecvBuffer int
+	SendBuffer int
+
+	// TCP_DEFER_ACCEPT, 连接收到数据后才accept, 只用于监听socket
+	DeferAccept time.Duration
+
+	// TCP_FASTOPEN的队列长度, 只用于监听socket; 还需要net.ipv4.tcp_fastopen打开服务端支持
+	FastOpen int
+
+	// TCP_USER_TIMEOUT, 发送的数据超过这个时间没有被确认就断开连接
+	UserTimeout time.Duration
+
+	// SO_LINGER: >0时close最多等待这么久把数据发完(按秒); <0时close直接发送RST; 0不设置
+	Linger time.Duration
+
+	// IP_TOS(IPv6为IPV6_TCLASS); DSCP(0-63)设置时替换TOS的高6位
+	TOS  int
+	DSCP int
+
+	// TCP_CONGESTION拥塞控制算法, 例如"bbr", 需要内核已经加载
+	Congestion string
+}
+
+// SockoptFailure 内核拒绝的一个选项
+type SockoptFailure struct {
+	Option string // 例如"TCP_CONGESTION"
+	Err    error
+}
+
+// SockoptError 设置socket选项时被内核拒绝的选项, 其他选项已经设置
+type SockoptError struct {
+	Failures []SockoptFailure
+}
+
+func (e *SockoptError) Error() string {
+	s := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		s = append(s, f.Option+": "+f.Err.Error())
+	}
+	return "kimenet: socket options rejected: " + strings.Join(s, ", ")
+}
+
+// sockoptTarget 设置选项的socket类型, 不适用的选项跳过
+type sockoptTarget struct {
+	family   int
+	stream   bool
+	listener bool
+}
+
+func targetOf(fd int, listener bool) (t sockoptTarget) {
+	t.listener = listener
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		switch sa.(type) {
+		case *syscall.SockaddrInet4:
+			t.family = syscall.AF_INET
+		case *syscall.SockaddrInet6:
+			t.family = syscall.AF_INET6
+		case *syscall.SockaddrUnix:
+			t.family = syscall.AF_UNIX
+		}
+	}
+	if typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE); err == nil {
+		t.stream = typ == syscall.SOCK_STREAM
+	}
+	return
+}
+
+// apply 设置所有非零的选项, 被拒绝的继续设置其他选项, 最后一起返回
+func (so *SocketOptions) apply(fd int, t sockoptTarget) error {
+	if so == nil {
+		return nil
+	}
+	var failures []SockoptFailure
+	set := func(name string, err error) {
+		if err != nil {
+			failures = append(failures, SockoptFailure{Option: name, Err: err})
+		}
+	}
+	setInt := func(name string, level, opt, value int) {
+		set(name, syscall.SetsockoptInt(fd, level, opt, value))
+	}
+
+	if so.RecvBuffer > 0 {
+		setInt("SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, so.RecvBuffer)
+	}
+	if so.SendBuffer > 0 {
+		setInt("SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, so.SendBuffer)
+	}
+
+	if t.family == syscall.AF_INET || t.family == syscall.AF_INET6 {
+		if tos := so.tos(); tos > 0 {
+			if t.family == syscall.AF_INET6 {
+				setInt("IPV6_TCLASS", syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			} else {
+				setInt("IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			}
+		}
+	}
+
+	// 以下只用于TCP
+	if !t.stream || t.family == syscall.AF_UNIX {
+		return sockoptError(failures)
+	}
+	if so.NoDelay {
+		setInt("TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+	}
+	if so.KeepAlive || so.KeepAliveIdle > 0 || so.KeepAliveInterval > 0 || so.KeepAliveCount > 0 {
+		setInt("SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1)
+	}
+	if so.KeepAliveIdle > 0 {
+		setInt("TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, seconds(so.KeepAliveIdle))
+	}
+	if so.KeepAliveInterval > 0 {
+		setInt("TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, seconds(so.KeepAliveInterval))
+	}
+	if so.KeepAliveCount > 0 {
+		setInt("TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, so.KeepAliveCount)
+	}
+	if so.UserTimeout > 0 {
+		setInt("TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, int(so.UserTimeout/time.Millisecond))
+	}
+	if so.Linger != 0 {
+		l := &syscall.Linger{Onoff: 1}
+		if so.Linger > 0 {
+			l.Linger = int32(seconds(so.Linger))
+		}
+		set("SO_LINGER", syscall.SetsockoptLinger(fd, syscall.SOL_SOCKET, syscall.SO_LINGER, l))
+	}
+	if so.Congestion != "" {
+		set("TCP_CONGESTION", syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, so.Congestion))
+	}
+	if t.listener {
+		if so.DeferAccept > 0 {
+			setInt("TCP_DEFER_ACCEPT", syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, seconds(so.DeferAccept))
+		}
+		if so.FastOpen > 0 {
+			setInt("TCP_FASTOPEN", syscall.IPPROTO_TCP, tcpFastOpen, so.FastOpen)
+		}
+	}
+	return sockoptError(failures)
+}
+
+func (so *SocketOptions) tos() int {
+	if so.DSCP > 0 {
+		return so.DSCP<<2 | so.TOS&0x3
+	}
+	return so.TOS
+}
+
+func sockoptError(failures []SockoptFailure) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	return &SockoptError{Failures: failures}
+}
+
+func seconds(d time.Duration) int {
+	if s := int((d + time.Second - 1) / time.Second); s > 0 {
+		return s
+	}
+	return 1
+}
+
+// SetSocketOptions 设置这个连接的socket选项, 例如在OnOpen中按客户端设置TOS; 只用于监听socket的选项(DeferAccept、FastOpen)忽略
+// 返回*SockoptError时其他选项已经设置; 只能在EventLoop协程中调用
+func (conn *Connection) SetSocketOptions(so *SocketOptions) error {
+	if conn.State != ESTABLISHED {
+		return ErrConnClosed
+	}
+	return so.apply(conn.Fd, targetOf(conn.Fd, false))
+}
+
+// applyConnSockopts 新连接使用Options.SocketOptions, 被拒绝的选项不影响连接
+// 按选项计数, 见SockoptErrors; 同样的配置在每个连接上的结果一样, 每个Server中每种选项只打印一次日志
+func (srv *Server) applyConnSockopts(fd int) {
+	if srv.opts.SocketOptions == nil {
+		return
+	}
+	err := srv.opts.SocketOptions.apply(fd, targetOf(fd, false))
+	if err == nil {
+		return
+	}
+	srv.sockoptMu.Lock()
+	defer srv.sockoptMu.Unlock()
+	if srv.sockoptErrors == nil {
+		srv.sockoptErrors = make(map[string]uint64)
+	}
+	for _, f := range err.(*SockoptError).Failures {
+		srv.sockoptErrors[f.Option]++
+		if srv.sockoptErrors[f.Option] == 1 {
+			fmt.Println("连接的socket选项设置失败: ", f.Option, f.Err.Error())
+		}
+	}
+}
+
+// SockoptErrors 按选项统计accept/Dial的连接上被内核拒绝的Options.SocketOptions次数, 例如"TCP_CONGESTION"
+func (srv *Server) SockoptErrors() map[string]uint64 {
+	srv.sockoptMu.Lock()
+	defer srv.sockoptMu.Unlock()
+	m := make(map[string]uint64, len(srv.sockoptErrors))
+	for k, v := range srv.sockoptErrors {
+		m[k] = v
+	}
+	return m
+}
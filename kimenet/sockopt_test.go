@@ -0,0 +1,166 @@
+package kimenet
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockoptHandler 在OnOpen中读取连接的socket选项
+type sockoptHandler struct {
+	echoHandler
+	extra  *SocketOptions
+	opened chan map[string]int
+	setErr chan error
+}
+
+func (h *sockoptHandler) OnOpen(conn *Connection) {
+	h.setErr <- conn.SetSocketOptions(h.extra)
+	h.opened <- readSockopts(conn.Fd)
+}
+
+func readSockopts(fd int) map[string]int {
+	opts := map[string]int{
+		"TCP_NODELAY":      0,
+		"SO_KEEPALIVE":     0,
+		"TCP_KEEPIDLE":     0,
+		"TCP_KEEPINTVL":    0,
+		"TCP_KEEPCNT":      0,
+		"TCP_USER_TIMEOUT": 0,
+		"IP_TOS":           0,
+		"TCP_DEFER_ACCEPT": 0,
+	}
+	get := func(name string, level, opt int) {
+		opts[name], _ = syscall.GetsockoptInt(fd, level, opt)
+	}
+	get("TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	get("SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	get("TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	get("TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+	get("TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT)
+	get("TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout)
+	get("IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS)
+	get("TCP_DEFER_ACCEPT", syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT)
+	return opts
+}
+
+func TestSocketOptions(t *testing.T) {
+	so := &SocketOptions{
+		NoDelay:           true,
+		KeepAliveIdle:     30 * time.Second,
+		KeepAliveInterval: 1500 * time.Millisecond,
+		KeepAliveCount:    3,
+		RecvBuffer:        64 * 1024,
+		DeferAccept:       2 * time.Second,
+		UserTimeout:       10 * time.Second,
+		DSCP:              46,
+		Congestion:        "reno", // 内核总是支持, 被拒绝时NewServer失败
+	}
+	h := &sockoptHandler{
+		echoHandler: echoHandler{closed: make(chan error, 1)},
+		extra:       &SocketOptions{TOS: 0x10, Linger: -1, FastOpen: 10},
+		opened:      make(chan map[string]int, 1),
+		setErr:      make(chan error, 1),
+	}
+	srv := startTestServer(t, h, &Options{SocketOptions: so})
+	defer srv.Stop()
+
+	// 监听socket
+	lopts := readSockopts(srv.ListenFd)
+	if lopts["TCP_DEFER_ACCEPT"] == 0 || lopts["TCP_NODELAY"] != 1 || lopts["IP_TOS"] != 46<<2 {
+		t.Fatalf("listener options %v", lopts)
+	}
+
+	// 使用DeferAccept时连接收到数据后才accept
+	testEcho(t, "tcp", srv.Addr(), []byte("hi"))
+	if err := <-h.setErr; err != nil {
+		t.Fatal("SetSocketOptions: ", err)
+	}
+	copts := <-h.opened
+	want := map[string]int{
+		"TCP_NODELAY":      1,
+		"SO_KEEPALIVE":     1,
+		"TCP_KEEPIDLE":     30,
+		"TCP_KEEPINTVL":    2,
+		"TCP_KEEPCNT":      3,
+		"TCP_USER_TIMEOUT": 10000,
+		"IP_TOS":           0x10, // SetSocketOptions修改了
+	}
+	for k, v := range want {
+		if copts[k] != v {
+			t.Fatalf("conn option %s = %d, want %d (%v)", k, copts[k], v, copts)
+		}
+	}
+}
+
+func TestSocketOptionsRejected(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 1)}
+	_, err := NewServer("127.0.0.1:0", h, &Options{SocketOptions: &SocketOptions{
+		NoDelay:    true,
+		Congestion: "no-such-algorithm",
+		DSCP:       46,
+	}})
+	se, ok := err.(*SockoptError)
+	if !ok || len(se.Failures) != 1 || se.Failures[0].Option != "TCP_CONGESTION" {
+		t.Fatalf("NewServer err %v", err)
+	}
+
+	// 连接上被拒绝的选项不影响连接
+	srv := startTestServer(t, h, nil)
+	defer srv.Stop()
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	fd, _ := c.(*net.TCPConn).File()
+	defer fd.Close()
+	conn := &Connection{Fd: int(fd.Fd()), State: ESTABLISHED}
+	err = conn.SetSocketOptions(&SocketOptions{Congestion: "no-such-algorithm", KeepAliveCount: 5})
+	if se, ok = err.(*SockoptError); !ok || len(se.Failures) != 1 {
+		t.Fatalf("SetSocketOptions err %v", err)
+	}
+	if n, _ := syscall.GetsockoptInt(conn.Fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); n != 5 {
+		t.Fatalf("TCP_KEEPCNT %d", n)
+	}
+}
+
+// 连接上被拒绝的选项按Server计数, 在Metrics和Prometheus输出中可以看到
+func TestSockoptErrorsMetrics(t *testing.T) {
+	h := &echoHandler{closed: make(chan error, 4)}
+	srv, err := NewServer("127.0.0.1:0", h, &Options{NumLoops: 1, SocketOptions: &SocketOptions{NoDelay: true}})
+	if err != nil {
+		t.Fatal("NewServer: ", err)
+	}
+	// 监听socket的选项已经设置, 之后的连接使用内核不支持的拥塞控制算法
+	srv.opts.SocketOptions = &SocketOptions{NoDelay: true, Congestion: "no-such-algorithm"}
+	go func() {
+		_ = srv.Start()
+	}()
+	defer srv.Stop()
+	for i := 0; i < 2; i++ {
+		testEcho(t, "tcp", srv.Addr(), []byte("hi"))
+	}
+
+	if n := srv.Metrics().SockoptErrors["TCP_CONGESTION"]; n != 2 {
+		t.Fatalf("SockoptErrors %d", n)
+	}
+	var buf bytes.Buffer
+	if err = srv.WriteMetrics(&buf); err != nil {
+		t.Fatal("WriteMetrics: ", err)
+	}
+	if want := `kimenet_sockopt_errors_total{option="TCP_CONGESTION"} 2`; !strings.Contains(buf.String(), want) {
+		t.Fatalf("metrics missing %q:\n%s", want, buf.String())
+	}
+
+	// 其他Server单独计数
+	other := startTestServer(t, h, nil)
+	defer other.Stop()
+	testEcho(t, "tcp", other.Addr(), []byte("hi"))
+	if m := other.SockoptErrors(); len(m) != 0 {
+		t.Fatalf("other server SockoptErrors %v", m)
+	}
+}
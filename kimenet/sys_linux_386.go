@@ -0,0 +1,4 @@
+package kimenet
+
+// syscall包在386上没有定义SYS_SENDMMSG
+const sysSendmmsg = 345
@@ -0,0 +1,233 @@
+package kimenet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// systemd socket activation传入的fd从3开始, 见sd_listen_fds(3); 测试中可以修改
+var sdListenFdsStart = 3
+
+// sdFd systemd传入的一个socket
+type sdFd struct {
+	fd      int
+	name    string // LISTEN_FDNAMES中的名字, 即unit文件中的FileDescriptorName, 默认"unknown"
+	claimed bool   // 已经被某个Server使用
+}
+
+// systemd传入的socket只能从环境变量读取一次, 读取后清除环境变量, 避免子进程误用
+var sdListeners struct {
+	sync.Mutex
+	loaded bool
+	fds    []*sdFd
+}
+
+// loadSystemdFds 读取LISTEN_PID/LISTEN_FDS/LISTEN_FDNAMES, 调用前需要持有sdListeners的锁
+func loadSystemdFds() (err error) {
+	if sdListeners.loaded {
+		return
+	}
+	sdListeners.loaded = true
+
+	pidStr := os.Getenv("LISTEN_PID")
+	nStr := os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+	if nStr == "" {
+		return
+	}
+
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil || pid != os.Getpid() {
+		// 传给其他进程的socket
+		return nil
+	}
+	n, err := strconv.Atoi(nStr)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS: %s", nStr)
+	}
+	for i := 0; i < n; i++ {
+		fd := sdListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		if err = syscall.SetNonblock(fd, true); err != nil {
+			return fmt.Errorf("systemd fd %d: %s", fd, err.Error())
+		}
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		sdListeners.fds = append(sdListeners.fds, &sdFd{fd: fd, name: name})
+	}
+	return
+}
+
+// systemdListeners 从systemd传入的socket中选出监听la的socket
+// name不为空时选出所有同名的socket(ReusePort时每个EventLoop一个), 否则选出第一个类型相同的socket
+// 不是由systemd socket activation启动时返回nil
+func systemdListeners(la *ListenAddr, name string) (fds []int, err error) {
+	sdListeners.Lock()
+	defer sdListeners.Unlock()
+	if err = loadSystemdFds(); err != nil || len(sdListeners.fds) == 0 {
+		return
+	}
+
+	for _, sf := range sdListeners.fds {
+		if sf.claimed || (name != "" && sf.name != name) || !la.matchSocket(sf.fd) {
+			continue
+		}
+		sf.claimed = true
+		fds = append(fds, sf.fd)
+		if name == "" {
+			break
+		}
+	}
+	if len(fds) == 0 {
+		err = fmt.Errorf("no systemd socket for %s://%s (name %q)", la.Network, la.String(), name)
+		return
+	}
+	la.fillFrom(fds[0])
+	return
+}
+
+// matchSocket socket的类型和协议族与监听地址是否相同
+func (la *ListenAddr) matchSocket(fd int) bool {
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false
+	}
+	if la.IsPacket() != (sotype == syscall.SOCK_DGRAM) {
+		return false
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return false
+	}
+	switch sa.(type) {
+	case *syscall.SockaddrUnix:
+		return la.Network == "unix"
+	case *syscall.SockaddrInet4:
+		return la.Network != "unix" && !la.only6()
+	case *syscall.SockaddrInet6:
+		return la.Network != "unix" && !la.only4()
+	}
+	return false
+}
+
+// fillFrom 使用socket实际绑定的地址
+func (la *ListenAddr) fillFrom(fd int) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return
+	}
+	switch sa := sa.(type) {
+	case *syscall.SockaddrUnix:
+		la.Path = sa.Name
+	case *syscall.SockaddrInet4:
+		la.IP = net.IP(append([]byte(nil), sa.Addr[:]...))
+		la.Port = sa.Port
+	case *syscall.SockaddrInet6:
+		la.IP = net.IP(append([]byte(nil), sa.Addr[:]...))
+		la.Port = sa.Port
+	}
+}
+
+// SdNotify 给systemd发送状态通知, 见sd_notify(3), 例如"READY=1", "STATUS=..."
+// 没有设置NOTIFY_SOCKET(不是由systemd启动或者unit文件中不是Type=notify)时什么都不做, 返回false
+func SdNotify(state string) (sent bool, err error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return
+	}
+	return true, nil
+}
+
+func sdNotify(state string) {
+	if _, err := SdNotify(state); err != nil {
+		fmt.Println("sd_notify err: ", err.Error())
+	}
+}
+
+// sdNotifyReloading 开始平滑重启, Type=notify-reload要求同时发送MONOTONIC_USEC
+func sdNotifyReloading() {
+	var ts syscall.Timespec
+	_, _, _ = syscall.RawSyscall(syscall.SYS_CLOCK_GETTIME, 1 /* CLOCK_MONOTONIC */, uintptr(unsafe.Pointer(&ts)), 0)
+	sdNotify(fmt.Sprintf("RELOADING=1\nMONOTONIC_USEC=%d", ts.Nano()/1000))
+}
+
+// sdNotifyReady 服务器开始处理事件; 平滑重启的子进程同时告诉systemd自己是新的主进程(需要NotifyAccess=all)
+func sdNotifyReady(graceChild bool) {
+	if graceChild {
+		sdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid()))
+		return
+	}
+	sdNotify("READY=1")
+}
+
+// sdNotifyStopping 服务器开始停止; 平滑重启完成后父进程的停止不通知, 服务由子进程继续
+func sdNotifyStopping(prevState int32) {
+	if prevState == Gracing || prevState == ShuttingDown || prevState == Stop {
+		return
+	}
+	sdNotify("STOPPING=1")
+}
+
+// watchdogInterval WATCHDOG_USEC的一半, 没有开启systemd watchdog时返回0
+// 平滑重启的子进程继承了父进程的WATCHDOG_PID, 不检查
+func watchdogInterval(graceChild bool) time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" && !graceChild {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdog 定时发送WATCHDOG=1; 每次发送前确认所有EventLoop都能执行任务, 有EventLoop卡住时停止发送, 由systemd重启服务
+func (srv *Server) watchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.done:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&srv.State) == Stop {
+			return
+		}
+
+		alive := make(chan struct{})
+		go func() {
+			srv.runOnAllLoops(func(el *EventLoop) {})
+			close(alive)
+		}()
+		select {
+		case <-alive:
+			sdNotify("WATCHDOG=1")
+		case <-srv.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package kimenet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// notifySocket 模拟systemd的NOTIFY_SOCKET
+func notifySocket(t *testing.T) *net.UnixConn {
+	path := filepath.Join(os.TempDir(), "kimenet-notify-"+strconv.Itoa(os.Getpid())+".sock")
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal("ListenUnixgram: ", err)
+	}
+	_ = os.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func expectNotify(t *testing.T, conn *net.UnixConn, want string) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 256)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("read notify %q: %v", want, err)
+	}
+	if string(b[:n]) != want {
+		t.Fatalf("notify %q, want %q", b[:n], want)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Fatalf("SdNotify without NOTIFY_SOCKET: %v %v", sent, err)
+	}
+
+	conn := notifySocket(t)
+	defer func() {
+		_ = os.Unsetenv("NOTIFY_SOCKET")
+		_ = os.Unsetenv("WATCHDOG_USEC")
+		_ = os.Unsetenv("WATCHDOG_PID")
+		_ = os.Remove(conn.LocalAddr().String())
+		conn.Close()
+	}()
+	_ = os.Setenv("WATCHDOG_USEC", "40000")
+	_ = os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 1)}, &Options{NumLoops: 2})
+	expectNotify(t, conn, "READY=1")
+	expectNotify(t, conn, "WATCHDOG=1")
+	srv.Stop()
+	<-srv.done
+
+	// 读完停止前剩下的WATCHDOG=1
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 256)
+		n, err := conn.Read(b)
+		if err != nil {
+			t.Fatal("read notify: ", err)
+		}
+		if string(b[:n]) == "STOPPING=1" {
+			break
+		}
+		if string(b[:n]) != "WATCHDOG=1" {
+			t.Fatalf("unexpected notify %q", b[:n])
+		}
+	}
+}
+
+func TestSystemdSocket(t *testing.T) {
+	la, _ := ParseListenAddr("127.0.0.1:0")
+	fd, err := listen(la, false, 0, nil)
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+
+	// 模拟systemd传入一个名为web的socket
+	sdListeners.loaded = false
+	sdListeners.fds = nil
+	oldStart := sdListenFdsStart
+	sdListenFdsStart = fd
+	defer func() { sdListenFdsStart = oldStart }()
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	_ = os.Setenv("LISTEN_FDS", "1")
+	_ = os.Setenv("LISTEN_FDNAMES", "web")
+
+	h := &echoHandler{closed: make(chan error, 1)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1, SystemdSocket: true, SystemdSocketName: "web"}, "127.0.0.1:0")
+	defer srv.Stop()
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("LISTEN_FDS not cleared")
+	}
+	if srv.ListenFd != fd || srv.Port != la.Port {
+		t.Fatalf("server fd %d port %d, want fd %d port %d", srv.ListenFd, srv.Port, fd, la.Port)
+	}
+	testEcho(t, "tcp", testAddr(srv), []byte("hello systemd"))
+
+	// socket已经被使用
+	if _, err = NewServer("127.0.0.1:0", h, &Options{SystemdSocket: true, SystemdSocketName: "web"}); err == nil {
+		t.Fatal("NewServer should fail without systemd socket")
+	}
+}
@@ -0,0 +1,71 @@
+package kimenet
+
+import (
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	efdCloexec  = 0x80000 // EFD_CLOEXEC
+	efdNonblock = 0x800   // EFD_NONBLOCK
+)
+
+func eventfd() (fd int, err error) {
+	r, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, efdCloexec|efdNonblock, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// Execute 把f交给EventLoop协程执行, 可以在任意协程调用
+// 其他协程要访问连接、定时器时都通过它转到EventLoop协程
+func (el *EventLoop) Execute(f func()) {
+	el.tasks.push(f)
+	el.wake()
+}
+
+// wake 唤醒阻塞在EpollWait中的EventLoop
+func (el *EventLoop) wake() {
+	if !atomic.CompareAndSwapInt32(&el.notified, 0, 1) {
+		return
+	}
+	var one uint64 = 1
+	_, err := syscall.Write(el.wakeFd, (*[8]byte)(unsafe.Pointer(&one))[:])
+	if err != nil && err != syscall.EAGAIN {
+		atomic.StoreInt32(&el.notified, 0)
+	}
+}
+
+func (el *EventLoop) runTasks() {
+	var buf [8]byte
+	_, _ = syscall.Read(el.wakeFd, buf[:])
+	// 先清除标记再取任务, 取任务期间新加入的任务会再次唤醒
+	atomic.StoreInt32(&el.notified, 0)
+	for {
+		f := el.tasks.pop()
+		if f == nil {
+			return
+		}
+		f()
+	}
+}
+
+// AsyncWrite 在任意协程中向连接写数据, 数据会被拷贝后交给EventLoop协程写入
+func (conn *Connection) AsyncWrite(b []byte) {
+	data := make([]byte, len(b))
+	copy(data, b)
+	conn.loop.Execute(func() {
+		if conn.State == ESTABLISHED {
+			_, _ = conn.Write(data)
+		}
+	})
+}
+
+// AsyncClose 在任意协程中关闭连接, 写缓冲区中的数据发送完毕后关闭
+func (conn *Connection) AsyncClose() {
+	conn.loop.Execute(func() {
+		_ = conn.Close()
+	})
+}
@@ -0,0 +1,107 @@
+package kimenet
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskQueue(t *testing.T) {
+	q := newTaskQueue()
+	if q.pop() != nil {
+		t.Fatal("pop from empty queue")
+	}
+
+	const producers, per = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < per; j++ {
+				q.push(func() {})
+			}
+		}()
+	}
+	wg.Wait()
+
+	n := 0
+	for f := q.pop(); f != nil; f = q.pop() {
+		f()
+		n++
+	}
+	if n != producers*per {
+		t.Fatalf("popped %d tasks, want %d", n, producers*per)
+	}
+}
+
+type asyncHandler struct {
+	BaseHandler
+	opened chan *Connection
+}
+
+func (h *asyncHandler) OnOpen(conn *Connection) {
+	h.opened <- conn
+}
+
+func TestAsyncWrite(t *testing.T) {
+	h := &asyncHandler{opened: make(chan *Connection, 1)}
+	srv := startTestServer(t, h, &Options{NumLoops: 2})
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var conn *Connection
+	select {
+	case conn = <-h.opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnOpen not called")
+	}
+
+	// 多个协程并发写, 每个协程写一个字节
+	const writers = 100
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.AsyncWrite([]byte{'x'})
+		}()
+	}
+	wg.Wait()
+	conn.AsyncClose()
+
+	got, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal("ReadAll: ", err)
+	}
+	if len(got) != writers {
+		t.Fatalf("got %d bytes, want %d", len(got), writers)
+	}
+}
+
+func TestExecuteWakesLoop(t *testing.T) {
+	srv := startTestServer(t, &echoHandler{closed: make(chan error, 1)}, &Options{NumLoops: 1})
+	defer srv.Stop()
+
+	// 空闲的EventLoop阻塞在EpollWait中, Execute应该立即唤醒它
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	done := make(chan struct{})
+	srv.Loops()[0].Execute(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not executed")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("task executed after %v", d)
+	}
+}
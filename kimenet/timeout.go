@@ -0,0 +1,140 @@
+package kimenet
+
+import (
+	"errors"
+	"time"
+)
+
+// 超时关闭连接时传给OnClose的错误, 可以用来分别统计
+var (
+	ErrIdleTimeout  = errors.New("kimenet: idle timeout")
+	ErrReadTimeout  = errors.New("kimenet: read timeout")
+	ErrWriteTimeout = errors.New("kimenet: write timeout")
+)
+
+// 连接的超时都用懒惰的定时器实现: 读写时只更新时间戳, 定时器到期时再检查是否真的超时, 没有超时就按剩余时间重新设置
+
+// initTimeouts 按Options设置新连接的超时, 在OnOpen之前调用, OnOpen里可以再修改
+func (el *EventLoop) initTimeouts(conn *Connection) {
+	opts := &el.serv.opts
+	conn.lastActive = el.now
+	conn.idleTimeout = opts.IdleTimeout
+	conn.writeTimeout = opts.WriteTimeout
+	if conn.idleTimeout > 0 {
+		conn.idleTimer = el.AfterFunc(conn.idleTimeout, func() { el.checkIdle(conn) })
+	}
+}
+
+// initReadHeaderTimeout 按ReadHeaderTimeout设置接受的新连接的读超时, 由协议层读完请求头后清除
+// Dial发起的连接和平滑重启迁移过来的连接不设置
+func (el *EventLoop) initReadHeaderTimeout(conn *Connection) {
+	if d := el.serv.opts.ReadHeaderTimeout; d > 0 && !conn.Outbound {
+		conn.SetReadDeadline(el.now.Add(d))
+	}
+}
+
+// SetIdleTimeout 设置连接的空闲超时, 超过d时间没有读写就关闭连接, d<=0表示不限制
+// 只能在EventLoop协程中调用
+func (conn *Connection) SetIdleTimeout(d time.Duration) {
+	conn.idleTimeout = d
+	if d <= 0 {
+		conn.idleTimer.Stop()
+		conn.idleTimer = nil
+		return
+	}
+	el := conn.loop
+	if conn.idleTimer == nil {
+		conn.idleTimer = el.AfterFunc(d, func() { el.checkIdle(conn) })
+	} else {
+		conn.idleTimer.Reset(conn.lastActive.Add(d).Sub(time.Now()))
+	}
+}
+
+// SetReadDeadline 设置读超时: 到t时不管期间有没有收到数据都关闭连接, OnClose的err为ErrReadTimeout; t为零值表示清除
+// 例如协议层在开始读取请求头时设置, 读完请求头后清除; 只能在EventLoop协程中调用
+func (conn *Connection) SetReadDeadline(t time.Time) {
+	conn.readDeadline = t
+	if t.IsZero() {
+		conn.readTimer.Stop()
+		conn.readTimer = nil
+		return
+	}
+	if conn.readTimer == nil {
+		el := conn.loop
+		conn.readTimer = el.AfterFunc(time.Until(t), func() {
+			conn.readTimer = nil
+			conn.readDeadline = time.Time{}
+			if conn.State == ESTABLISHED {
+				_ = el.closeConn(conn, ErrReadTimeout)
+			}
+		})
+	} else {
+		conn.readTimer.Reset(time.Until(t))
+	}
+}
+
+// SetWriteTimeout 设置写超时: 写缓冲区有数据但超过d时间没有任何发送进展就关闭连接, d<=0表示不限制
+// 只能在EventLoop协程中调用
+func (conn *Connection) SetWriteTimeout(d time.Duration) {
+	conn.writeTimeout = d
+	if d <= 0 {
+		conn.writeTimer.Stop()
+		conn.writeTimer = nil
+		return
+	}
+	if conn.writing {
+		conn.loop.armWriteTimer(conn)
+	}
+}
+
+func (el *EventLoop) checkIdle(conn *Connection) {
+	if conn.State != ESTABLISHED || conn.idleTimeout <= 0 {
+		return
+	}
+	left := conn.lastActive.Add(conn.idleTimeout).Sub(el.now)
+	if left <= 0 {
+		_ = el.closeConn(conn, ErrIdleTimeout)
+		return
+	}
+	conn.idleTimer.Reset(left)
+}
+
+func (el *EventLoop) armWriteTimer(conn *Connection) {
+	if conn.writeTimeout <= 0 {
+		return
+	}
+	if conn.writeTimer == nil {
+		conn.writeTimer = el.AfterFunc(conn.writeTimeout, func() { el.checkWriteStall(conn) })
+	} else if conn.writeTimer.index < 0 {
+		conn.writeTimer.Reset(conn.writeTimeout)
+	}
+}
+
+func (el *EventLoop) checkWriteStall(conn *Connection) {
+	if conn.State != ESTABLISHED || !conn.writing || conn.writeTimeout <= 0 {
+		return
+	}
+	left := conn.lastWrite.Add(conn.writeTimeout).Sub(el.now)
+	if left <= 0 {
+		_ = el.closeConn(conn, ErrWriteTimeout)
+		return
+	}
+	conn.writeTimer.Reset(left)
+}
+
+// onRead 收到数据后更新活跃时间
+func (el *EventLoop) onRead(conn *Connection) {
+	conn.lastActive = el.now
+}
+
+// onWrite 有发送进展时更新活跃时间
+func (el *EventLoop) onWrite(conn *Connection) {
+	conn.lastActive = el.now
+	conn.lastWrite = el.now
+}
+
+func (el *EventLoop) stopTimeouts(conn *Connection) {
+	conn.idleTimer.Stop()
+	conn.readTimer.Stop()
+	conn.writeTimer.Stop()
+}
@@ -0,0 +1,75 @@
+package kimenet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type timeoutHandler struct {
+	BaseHandler
+	flood  bool
+	clear  bool // 收到数据后清除读超时, 相当于读完了请求头
+	closed chan error
+}
+
+func (h *timeoutHandler) OnOpen(conn *Connection) {
+	if h.flood {
+		// 对端不读, 写缓冲区一直发不完
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), 16<<20))
+	}
+}
+
+func (h *timeoutHandler) OnData(conn *Connection) {
+	conn.ReadBuff.Reset()
+	if h.clear {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (h *timeoutHandler) OnClose(conn *Connection, err error) {
+	h.closed <- err
+}
+
+func TestConnTimeouts(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  *Options
+		flood bool
+		send  bool
+		clear bool
+		want  error
+	}{
+		{name: "idle", opts: &Options{IdleTimeout: 100 * time.Millisecond}, want: ErrIdleTimeout},
+		{name: "read header", opts: &Options{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: time.Minute}, want: ErrReadTimeout},
+		{name: "slow header", opts: &Options{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: time.Minute}, send: true, want: ErrReadTimeout},
+		{name: "idle after header", opts: &Options{ReadHeaderTimeout: 100 * time.Millisecond, IdleTimeout: 300 * time.Millisecond}, send: true, clear: true, want: ErrIdleTimeout},
+		{name: "write stall", opts: &Options{WriteTimeout: 100 * time.Millisecond, IdleTimeout: time.Minute}, flood: true, want: ErrWriteTimeout},
+	}
+
+	for _, cs := range cases {
+		h := &timeoutHandler{flood: cs.flood, clear: cs.clear, closed: make(chan error, 1)}
+		cs.opts.NumLoops = 1
+		srv := startTestServer(t, h, cs.opts)
+
+		c, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatal("Dial: ", err)
+		}
+		if cs.send {
+			_, _ = c.Write([]byte("hello"))
+		}
+
+		select {
+		case err = <-h.closed:
+			if err != cs.want {
+				t.Errorf("%s: OnClose err %v, want %v", cs.name, err, cs.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: connection not closed", cs.name)
+		}
+		_ = c.Close()
+		srv.Stop()
+	}
+}
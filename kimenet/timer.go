@@ -0,0 +1,121 @@
+package kimenet
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Timer EventLoop上的定时器, 回调总是在EventLoop协程中执行
+type Timer struct {
+	when   time.Time
+	period time.Duration // 大于0时为周期定时器
+	f      func()
+	index  int // 在堆中的位置, -1表示不在堆中
+	loop   *EventLoop
+}
+
+// AfterFunc d时间后在EventLoop协程中执行f, 只能在EventLoop协程中调用, 其他协程通过Execute调用
+func (el *EventLoop) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{f: f, index: -1, loop: el}
+	t.when = time.Now().Add(d)
+	heap.Push(&el.timers, t)
+	return t
+}
+
+// Every 每隔d时间在EventLoop协程中执行一次f, 只能在EventLoop协程中调用
+func (el *EventLoop) Every(d time.Duration, f func()) *Timer {
+	if d <= 0 {
+		panic("kimenet: non-positive interval for EventLoop.Every")
+	}
+	t := &Timer{f: f, period: d, index: -1, loop: el}
+	t.when = time.Now().Add(d)
+	heap.Push(&el.timers, t)
+	return t
+}
+
+// Stop 取消定时器, 返回定时器是否还未触发; 只能在EventLoop协程中调用
+func (t *Timer) Stop() bool {
+	if t == nil || t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.loop.timers, t.index)
+	return true
+}
+
+// Reset 把定时器改为d时间后触发, 周期定时器之后仍按原周期执行; 只能在EventLoop协程中调用
+func (t *Timer) Reset(d time.Duration) bool {
+	active := t.index >= 0
+	t.when = time.Now().Add(d)
+	if active {
+		heap.Fix(&t.loop.timers, t.index)
+	} else {
+		heap.Push(&t.loop.timers, t)
+	}
+	return active
+}
+
+// runTimers 执行所有到期的定时器
+func (el *EventLoop) runTimers(now time.Time) {
+	for len(el.timers) > 0 {
+		t := el.timers[0]
+		if t.when.After(now) {
+			return
+		}
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			if !t.when.After(now) {
+				// 回调执行太慢错过了多个周期, 从现在开始重新计算
+				t.when = now.Add(t.period)
+			}
+			heap.Fix(&el.timers, 0)
+		} else {
+			heap.Pop(&el.timers)
+		}
+		t.f()
+	}
+}
+
+// nextTimeout EpollWait的超时时间(毫秒), 不超过max
+func (el *EventLoop) nextTimeout(now time.Time, max int) int {
+	if len(el.timers) == 0 {
+		return max
+	}
+	d := el.timers[0].when.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	msec := int((d + time.Millisecond - 1) / time.Millisecond)
+	if msec > max {
+		return max
+	}
+	return msec
+}
+
+// timerHeap 按触发时间排序的最小堆
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,104 @@
+package kimenet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimerHeap(t *testing.T) {
+	el := &EventLoop{}
+	var fired []int
+
+	el.AfterFunc(30*time.Millisecond, func() { fired = append(fired, 3) })
+	el.AfterFunc(10*time.Millisecond, func() { fired = append(fired, 1) })
+	t2 := el.AfterFunc(20*time.Millisecond, func() { fired = append(fired, 2) })
+	t4 := el.AfterFunc(40*time.Millisecond, func() { fired = append(fired, 4) })
+
+	if !t2.Stop() {
+		t.Error("Stop of pending timer should return true")
+	}
+	if t2.Stop() {
+		t.Error("second Stop should return false")
+	}
+	t4.Reset(5 * time.Millisecond)
+
+	now := time.Now()
+	if msec := el.nextTimeout(now, 1000); msec < 1 || msec > 5 {
+		t.Errorf("nextTimeout = %d", msec)
+	}
+
+	el.runTimers(now.Add(time.Second))
+	want := []int{4, 1, 3}
+	if len(fired) != len(want) {
+		t.Fatalf("fired %v, want %v", fired, want)
+	}
+	for i := range want {
+		if fired[i] != want[i] {
+			t.Fatalf("fired %v, want %v", fired, want)
+		}
+	}
+	if len(el.timers) != 0 {
+		t.Errorf("%d timers left", len(el.timers))
+	}
+	if msec := el.nextTimeout(now, 1000); msec != 1000 {
+		t.Errorf("nextTimeout without timers = %d", msec)
+	}
+}
+
+func TestTimerEvery(t *testing.T) {
+	el := &EventLoop{}
+	count := 0
+	var tm *Timer
+	tm = el.Every(10*time.Millisecond, func() {
+		count++
+		if count == 3 {
+			tm.Stop()
+		}
+	})
+
+	now := time.Now()
+	for i := 1; i <= 5; i++ {
+		el.runTimers(now.Add(time.Duration(i) * 10 * time.Millisecond))
+	}
+	if count != 3 {
+		t.Errorf("periodic timer fired %d times, want 3", count)
+	}
+	if len(el.timers) != 0 {
+		t.Errorf("%d timers left", len(el.timers))
+	}
+}
+
+type timerHandler struct {
+	BaseHandler
+	fired chan time.Duration
+}
+
+func (h *timerHandler) OnOpen(conn *Connection) {
+	start := time.Now()
+	conn.Loop().AfterFunc(50*time.Millisecond, func() {
+		h.fired <- time.Since(start)
+		_ = conn.Close()
+	})
+}
+
+func TestTimerOnLoop(t *testing.T) {
+	h := &timerHandler{fired: make(chan time.Duration, 1)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1})
+	defer srv.Stop()
+
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+
+	select {
+	case d := <-h.fired:
+		if d < 50*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("timer fired after %s", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timer not fired")
+	}
+}
@@ -0,0 +1,419 @@
+package kimenet
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+   TLS终止: 使用crypto/tls, socket的读写仍然由EventLoop负责, crypto/tls只读写内存中的密文
+     1. 握手阶段: crypto/tls的握手不能中断后继续, 收到客户端的第一段密文后用一个协程执行Handshake,
+        EventLoop读到的密文交给握手协程, 握手协程产生的密文通过Execute放回写缓冲区;
+        同时运行的握手协程数受Options.TLSMaxHandshakes限制(默认1024), 超过时连接排队, 密文留在缓冲区中
+        握手不是由EventLoop读写事件驱动的状态机: Handshake读不到数据时只能阻塞, 返回错误后不能继续,
+        所以每个正在握手的连接占用一个协程, 用并发上限和TLSHandshakeTimeout限制协程数和占用时间
+     2. 握手完成后在EventLoop协程中同步加解密: 没有密文时返回Temporary的错误, crypto/tls会保留已经读到的部分记录
+   握手完成后才回调OnOpen, ReadBuff中是解密后的数据, Write的数据加密后放入WriteBuff
+   TLS连接不能在平滑重启时迁移, 留在父进程中按Shutdown的流程关闭
+*/
+
+const (
+	tlsTicketKeyCount       = 3    // 保留的session ticket密钥个数, 新的用于加密, 旧的仍然可以解密
+	defaultTLSMaxHandshakes = 1024 // 默认同时进行的握手数上限
+)
+
+var (
+	// ErrTLSHandshake TLS握手还没有完成
+	ErrTLSHandshake = errors.New("tls handshake not complete")
+
+	// ErrTLSHandshakeTimeout TLS握手超时, 见Options.TLSHandshakeTimeout
+	ErrTLSHandshakeTimeout = errors.New("tls handshake timeout")
+)
+
+// tlsWouldBlock 同步加解密时没有更多密文, crypto/tls对Temporary的错误不记录为连接错误
+type tlsWouldBlock struct{}
+
+func (tlsWouldBlock) Error() string   { return "tls: would block" }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+var errTLSWouldBlock net.Error = tlsWouldBlock{}
+
+// tlsConn 连接的TLS状态, 同时是crypto/tls下层的net.Conn
+type tlsConn struct {
+	conn  *Connection
+	tc    *tls.Conn
+	in    *RingBuffer // 从socket读到还没有解密的密文, 只在EventLoop协程中访问
+	timer *Timer      // 握手超时
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []byte // 握手期间交给握手协程的密文
+	closed  bool
+	ready   bool // 握手完成, 在EventLoop协程中同步加解密
+
+	started bool // 已经申请握手协程(可能在排队), 只在EventLoop协程中访问
+
+	local  net.Addr
+	remote net.Addr
+	state  tls.ConnectionState
+}
+
+// tlsAddr crypto/tls的ClientHelloInfo.Conn中使用的地址
+type tlsAddr string
+
+func (a tlsAddr) Network() string { return "tcp" }
+func (a tlsAddr) String() string  { return string(a) }
+
+// Read 握手协程等待EventLoop读到的密文; 握手完成后在EventLoop协程中读取in
+func (t *tlsConn) Read(b []byte) (n int, err error) {
+	t.mu.Lock()
+	if t.ready {
+		t.mu.Unlock()
+		if t.in.Len() == 0 {
+			return 0, errTLSWouldBlock
+		}
+		return t.in.Read(b)
+	}
+	for len(t.pending) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if len(t.pending) == 0 {
+		t.mu.Unlock()
+		return 0, io.EOF
+	}
+	n = copy(b, t.pending)
+	t.pending = t.pending[n:]
+	t.mu.Unlock()
+	return
+}
+
+// Write crypto/tls产生的密文放入写缓冲区
+func (t *tlsConn) Write(b []byte) (n int, err error) {
+	t.mu.Lock()
+	closed, ready := t.closed, t.ready
+	t.mu.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+	if ready {
+		return t.conn.WriteBuff.Write(b)
+	}
+
+	p := append([]byte(nil), b...)
+	conn := t.conn
+	conn.loop.Execute(func() {
+		if conn.State == ESTABLISHED {
+			_, _ = conn.WriteBuff.Write(p)
+			_ = conn.flush()
+		}
+	})
+	return len(b), nil
+}
+
+// Close crypto/tls不会关闭下层连接, 连接由EventLoop关闭
+func (t *tlsConn) Close() error                     { return nil }
+func (t *tlsConn) LocalAddr() net.Addr              { return t.local }
+func (t *tlsConn) RemoteAddr() net.Addr             { return t.remote }
+func (t *tlsConn) SetDeadline(time.Time) error      { return nil }
+func (t *tlsConn) SetReadDeadline(time.Time) error  { return nil }
+func (t *tlsConn) SetWriteDeadline(time.Time) error { return nil }
+
+// feed 把读到的密文交给握手协程
+func (t *tlsConn) feed() {
+	t.mu.Lock()
+	t.pending = append(t.pending, t.in.Bytes()...)
+	t.mu.Unlock()
+	t.in.Reset()
+	t.cond.Signal()
+}
+
+// close 连接关闭, 握手协程读到EOF后退出
+func (t *tlsConn) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.pending = nil
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	t.timer.Stop()
+	t.in.release()
+}
+
+// write 加密后放入写缓冲区
+func (t *tlsConn) write(b []byte) (n int, err error) {
+	if !t.ready {
+		return 0, ErrTLSHandshake
+	}
+	n, err = t.tc.Write(b)
+	if err != nil {
+		return
+	}
+	err = t.conn.flush()
+	return
+}
+
+// closeNotify 关闭前发送close_notify, 写缓冲区原来为空时也要开始监听写事件
+func (t *tlsConn) closeNotify() {
+	if t.ready {
+		_ = t.tc.CloseWrite()
+		_ = t.conn.flush()
+	}
+}
+
+// startTLS 新连接开始TLS握手, 握手完成后回调OnOpen
+func (el *EventLoop) startTLS(conn *Connection) {
+	t := &tlsConn{
+		conn:   conn,
+		in:     NewRingBuffer(0),
+		remote: tlsAddr(conn.idx),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	if sa, err := syscall.Getsockname(conn.Fd); err == nil {
+		t.local = tlsAddr(sockAddrToString(sa))
+	} else {
+		t.local = tlsAddr("")
+	}
+	t.tc = tls.Server(t, el.serv.TLSConfig())
+	conn.tls = t
+	conn.pendingOpen = true
+
+	if d := el.serv.opts.TLSHandshakeTimeout; d > 0 {
+		t.timer = el.AfterFunc(d, func() {
+			if conn.State == ESTABLISHED && !t.ready {
+				_ = el.closeConn(conn, ErrTLSHandshakeTimeout)
+			}
+		})
+	}
+
+}
+
+// handshakeLimiter 限制同时运行的握手协程数, 见Options.TLSMaxHandshakes
+type handshakeLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	queue  []*Connection // 等待握手的连接
+}
+
+// acquire 有空闲名额时返回true, 否则连接排队
+func (l *handshakeLimiter) acquire(conn *Connection) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active < l.max {
+		l.active++
+		return true
+	}
+	l.queue = append(l.queue, conn)
+	return false
+}
+
+// release 一个握手协程结束, 名额直接交给排队的连接; 排队期间已经关闭的连接跳过
+func (l *handshakeLimiter) release() {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if len(l.queue) == 0 {
+		l.active--
+		l.mu.Unlock()
+		return
+	}
+	next := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	l.mu.Unlock()
+
+	el := next.loop
+	el.Execute(func() {
+		if next.State == ESTABLISHED {
+			el.runHandshake(next)
+		} else {
+			l.release()
+		}
+	})
+}
+
+// startHandshake 收到第一段密文后申请握手协程
+func (el *EventLoop) startHandshake(conn *Connection) {
+	conn.tls.started = true
+	if el.serv.handshakes.acquire(conn) {
+		el.runHandshake(conn)
+	}
+}
+
+func (el *EventLoop) runHandshake(conn *Connection) {
+	t := conn.tls
+	go func() {
+		err := t.tc.Handshake()
+		conn.loop.Execute(func() { el.onHandshake(conn, err) })
+	}()
+}
+
+// onHandshake 握手协程结束, 切换到同步加解密并回调OnOpen
+func (el *EventLoop) onHandshake(conn *Connection, err error) {
+	el.serv.handshakes.release()
+	if conn.State != ESTABLISHED {
+		return
+	}
+	t := conn.tls
+	t.timer.Stop()
+	if err != nil {
+		// 尽力发送握手失败的alert
+		_, _ = conn.WriteBuff.writeFd(conn.Fd)
+		_ = el.closeConn(conn, fmt.Errorf("tls handshake: %s", err.Error()))
+		return
+	}
+
+	t.mu.Lock()
+	t.ready = true
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	// 握手协程没有读完的密文是之后的应用数据
+	_, _ = t.in.Write(pending)
+	t.state = t.tc.ConnectionState()
+
+	conn.pendingOpen = false
+	el.callOpen(conn)
+	el.afterOpen(conn)
+	// 和握手最后一条消息一起到达的应用数据可能已经被crypto/tls读进自己的缓冲区, in为空时也要尝试解密
+	if conn.State == ESTABLISHED {
+		el.tlsProcess(conn)
+	}
+}
+
+// tlsProcess 处理从socket读到的密文: 握手期间交给握手协程, 之后解密到ReadBuff交给Handler
+func (el *EventLoop) tlsProcess(conn *Connection) {
+	t := conn.tls
+	if !t.ready {
+		t.feed()
+		if !t.started {
+			el.startHandshake(conn)
+		}
+		return
+	}
+
+	total := 0
+	for {
+		n, err := t.tc.Read(el.buf)
+		if n > 0 {
+			_, _ = conn.ReadBuff.Write(el.buf[:n])
+			total += n
+		}
+		if err == errTLSWouldBlock {
+			break
+		}
+		if err != nil {
+			// 对端发送了close_notify(io.EOF)或者数据有错误
+			if total > 0 {
+				el.deliver(conn)
+			}
+			// 尽力发送crypto/tls产生的alert
+			if conn.State == ESTABLISHED {
+				_, _ = conn.WriteBuff.writeFd(conn.Fd)
+			}
+			_ = el.closeConn(conn, err)
+			return
+		}
+	}
+	// 解密时crypto/tls自己写的记录(例如回复KeyUpdate)只放进了写缓冲区, 要开始监听写事件
+	if conn.WriteBuff.Len() > 0 {
+		_ = conn.flush()
+	}
+	if total > 0 {
+		el.deliver(conn)
+	}
+}
+
+// TLSState TLS连接握手完成后的状态, 例如协商的协议版本、ALPN协议(NegotiatedProtocol)、SNI(ServerName)
+// 不是TLS连接时ok为false
+func (conn *Connection) TLSState() (state tls.ConnectionState, ok bool) {
+	if conn.tls == nil || !conn.tls.ready {
+		return
+	}
+	return conn.tls.state, true
+}
+
+// TLSConfig 新连接使用的TLS配置, 没有开启TLS时返回nil
+func (srv *Server) TLSConfig() *tls.Config {
+	srv.tlsMu.Lock()
+	defer srv.tlsMu.Unlock()
+	return srv.tlsConfig
+}
+
+// SetTLSConfig 替换TLS配置, 只影响之后的新连接, 例如证书更新; 服务器必须开启了TLS
+// session ticket密钥继续使用当前的
+func (srv *Server) SetTLSConfig(cfg *tls.Config) (err error) {
+	if srv.TLSConfig() == nil {
+		return fmt.Errorf("server is not serving tls")
+	}
+	cfg, err = newServerTLSConfig(cfg)
+	if err != nil {
+		return
+	}
+	srv.tlsMu.Lock()
+	defer srv.tlsMu.Unlock()
+	if len(srv.ticketKeys) > 0 {
+		cfg.SetSessionTicketKeys(srv.ticketKeys)
+	}
+	srv.tlsConfig = cfg
+	return
+}
+
+// newServerTLSConfig 复制使用者的配置, 默认最低TLS 1.2
+func newServerTLSConfig(cfg *tls.Config) (*tls.Config, error) {
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate == nil && cfg.GetConfigForClient == nil {
+		return nil, fmt.Errorf("tls config has no certificate")
+	}
+	cfg = cfg.Clone()
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	return cfg, nil
+}
+
+// RotateTicketKeys 生成新的session ticket密钥用于加密, 保留之前的几个用于解密
+// 设置了Options.TLSTicketKeyRotation时定时调用
+func (srv *Server) RotateTicketKeys() (err error) {
+	var key [32]byte
+	if _, err = io.ReadFull(rand.Reader, key[:]); err != nil {
+		return
+	}
+	srv.tlsMu.Lock()
+	defer srv.tlsMu.Unlock()
+	if srv.tlsConfig == nil {
+		return fmt.Errorf("server is not serving tls")
+	}
+	keys := append([][32]byte{key}, srv.ticketKeys...)
+	if len(keys) > tlsTicketKeyCount {
+		keys = keys[:tlsTicketKeyCount]
+	}
+	srv.ticketKeys = keys
+	srv.tlsConfig.SetSessionTicketKeys(keys)
+	return
+}
+
+func (srv *Server) rotateTicketKeysLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.done:
+			return
+		case <-ticker.C:
+			if err := srv.RotateTicketKeys(); err != nil {
+				fmt.Println("rotate tls ticket keys err: ", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package kimenet
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertStore 按SNI选择证书, 支持通配符证书, 证书文件更新后可以不重启重新加载
+// 用法: cfg.GetCertificate = store.GetCertificate; 第一个加入的证书是客户端没有发送SNI或没有匹配时的默认证书
+type CertStore struct {
+	mu      sync.RWMutex
+	entries []*certEntry
+	names   map[string]*tls.Certificate // 小写的域名, 通配符证书为"*.example.com"
+	def     *tls.Certificate
+}
+
+type certEntry struct {
+	cert     *tls.Certificate
+	certFile string // 从文件加载的证书, Reload时重新读取
+	keyFile  string
+	modTime  time.Time
+}
+
+func NewCertStore() *CertStore {
+	return &CertStore{names: make(map[string]*tls.Certificate)}
+}
+
+// Add 加入内存中的证书
+func (s *CertStore) Add(cert tls.Certificate) (err error) {
+	if err = parseLeaf(&cert); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, &certEntry{cert: &cert})
+	s.index()
+	return
+}
+
+// AddFile 加入PEM格式的证书和私钥文件
+func (s *CertStore) AddFile(certFile, keyFile string) (err error) {
+	e := &certEntry{certFile: certFile, keyFile: keyFile}
+	if err = e.load(); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	s.index()
+	return
+}
+
+// Reload 重新加载所有证书文件; 任何一个加载失败时保留原来的全部证书
+func (s *CertStore) Reload() (err error) {
+	_, err = s.reload(true)
+	return
+}
+
+// ReloadIfChanged 有证书文件的修改时间变化时重新加载
+func (s *CertStore) ReloadIfChanged() (changed bool, err error) {
+	return s.reload(false)
+}
+
+func (s *CertStore) reload(force bool) (changed bool, err error) {
+	s.mu.RLock()
+	old := s.entries
+	s.mu.RUnlock()
+
+	entries := make([]*certEntry, len(old))
+	for i, e := range old {
+		entries[i] = e
+		if e.certFile == "" {
+			continue
+		}
+		if !force {
+			if mod, ok := e.changed(); !ok || mod.Equal(e.modTime) {
+				continue
+			}
+		}
+		ne := &certEntry{certFile: e.certFile, keyFile: e.keyFile}
+		if err = ne.load(); err != nil {
+			return false, err
+		}
+		entries[i] = ne
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 加载期间加入的证书
+	entries = append(entries, s.entries[len(old):]...)
+	s.entries = entries
+	s.index()
+	return
+}
+
+// Watch 每隔interval检查证书文件, 有变化时重新加载, 直到stop关闭
+func (s *CertStore) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if changed, err := s.ReloadIfChanged(); err != nil {
+				fmt.Println("reload certificate err: ", err.Error())
+			} else if changed {
+				fmt.Println("certificate reloaded")
+			}
+		}
+	}
+}
+
+// GetCertificate 用作tls.Config.GetCertificate: 先精确匹配SNI, 再匹配通配符, 最后使用默认证书
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if name != "" {
+		if cert, ok := s.names[name]; ok {
+			return cert, nil
+		}
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			if cert, ok := s.names["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if s.def == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return s.def, nil
+}
+
+// index 重建域名索引, 调用前需要持有写锁; 同一个域名以先加入的证书为准
+func (s *CertStore) index() {
+	s.names = make(map[string]*tls.Certificate)
+	s.def = nil
+	for _, e := range s.entries {
+		if s.def == nil {
+			s.def = e.cert
+		}
+		leaf := e.cert.Leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, n := range names {
+			n = strings.ToLower(n)
+			if _, ok := s.names[n]; !ok {
+				s.names[n] = e.cert
+			}
+		}
+	}
+}
+
+func (e *certEntry) load() (err error) {
+	mod, _ := e.changed()
+	cert, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+	if err != nil {
+		return
+	}
+	if err = parseLeaf(&cert); err != nil {
+		return
+	}
+	e.cert = &cert
+	e.modTime = mod
+	return
+}
+
+// changed 证书和私钥文件中较新的修改时间
+func (e *certEntry) changed() (mod time.Time, ok bool) {
+	for _, f := range []string{e.certFile, e.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return
+		}
+		if fi.ModTime().After(mod) {
+			mod = fi.ModTime()
+		}
+	}
+	return mod, true
+}
+
+func parseLeaf(cert *tls.Certificate) (err error) {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("empty certificate")
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	}
+	return
+}
@@ -0,0 +1,436 @@
+package kimenet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert 生成自签名证书
+func testCert(t *testing.T, names ...string) (cert tls.Certificate, certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("GenerateKey: ", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("CreateCertificate: ", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("MarshalECPrivateKey: ", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal("X509KeyPair: ", err)
+	}
+	return
+}
+
+// tlsEchoHandler 记录握手后的状态
+type tlsEchoHandler struct {
+	echoHandler
+	opened chan tls.ConnectionState
+}
+
+func (h *tlsEchoHandler) OnOpen(conn *Connection) {
+	state, _ := conn.TLSState()
+	h.opened <- state
+}
+
+func (h *tlsEchoHandler) OnData(conn *Connection) {
+	if conn.ReadBuff.String() == "bye" {
+		conn.ReadBuff.Reset()
+		_, _ = conn.Write([]byte("bye"))
+		_ = conn.Close()
+		return
+	}
+	h.echoHandler.OnData(conn)
+}
+
+func newTLSEchoHandler() *tlsEchoHandler {
+	return &tlsEchoHandler{echoHandler: echoHandler{closed: make(chan error, 16)}, opened: make(chan tls.ConnectionState, 16)}
+}
+
+func tlsDial(t *testing.T, addr string, cfg *tls.Config) *tls.Conn {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		t.Fatal("tls.Dial: ", err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c
+}
+
+func tlsEcho(t *testing.T, c *tls.Conn, msg string) {
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal("Write: ", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal("ReadFull: ", err)
+	}
+	if string(got) != msg {
+		t.Fatalf("echo %q, want %q", got, msg)
+	}
+}
+
+func TestTLSEcho(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	h := newTLSEchoHandler()
+	srv := startTestServer(t, h, &Options{
+		NumLoops:  2,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}},
+	})
+	defer srv.Stop()
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		c := tlsDial(t, testAddr(srv), &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "localhost",
+			NextProtos:         []string{"http/1.1"},
+			MaxVersion:         version,
+		})
+		state := <-h.opened
+		if state.Version != version || state.NegotiatedProtocol != "http/1.1" || state.ServerName != "localhost" {
+			t.Fatalf("server state version %x alpn %q sni %q", state.Version, state.NegotiatedProtocol, state.ServerName)
+		}
+
+		// 大于一个TLS记录的数据
+		big := make([]byte, 100*1024)
+		for i := range big {
+			big[i] = byte(i)
+		}
+		tlsEcho(t, c, "hello tls")
+		tlsEcho(t, c, string(big))
+
+		// 服务端关闭时发送close_notify, 客户端读到EOF
+		if _, err := c.Write([]byte("bye")); err != nil {
+			t.Fatal("Write: ", err)
+		}
+		got, err := ioutil.ReadAll(c)
+		if err != nil || string(got) != "bye" {
+			t.Fatalf("ReadAll %q %v", got, err)
+		}
+		c.Close()
+		<-h.closed
+	}
+}
+
+func TestTLSHandshakeFailure(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	h := newTLSEchoHandler()
+	srv := startTestServer(t, h, &Options{
+		NumLoops:            1,
+		TLSConfig:           &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSHandshakeTimeout: 100 * time.Millisecond,
+	})
+	defer srv.Stop()
+
+	// 不是TLS的数据: 握手失败, 不回调OnOpen/OnClose
+	c, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	_, _ = ioutil.ReadAll(c)
+
+	// 一直不握手: 超时关闭
+	c2, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer c2.Close()
+	_ = c2.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("handshake timeout read err %v", err)
+	}
+
+	select {
+	case <-h.opened:
+		t.Fatal("OnOpen called")
+	case <-h.closed:
+		t.Fatal("OnClose called")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := srv.ActiveConns(); n != 0 {
+		t.Fatalf("ActiveConns %d", n)
+	}
+}
+
+func TestTLSSNICertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kimenet-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certA, certPEM, keyPEM := testCert(t, "a.example.com")
+	certFile, keyFile := filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key")
+	_ = ioutil.WriteFile(certFile, certPEM, 0600)
+	_ = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	certB, _, _ := testCert(t, "*.b.example.com")
+
+	store := NewCertStore()
+	if err = store.AddFile(certFile, keyFile); err != nil {
+		t.Fatal("AddFile: ", err)
+	}
+	if err = store.Add(certB); err != nil {
+		t.Fatal("Add: ", err)
+	}
+
+	h := newTLSEchoHandler()
+	srv := startTestServer(t, h, &Options{NumLoops: 1, TLSConfig: &tls.Config{GetCertificate: store.GetCertificate}})
+	defer srv.Stop()
+
+	peerCert := func(name string) []byte {
+		c := tlsDial(t, testAddr(srv), &tls.Config{InsecureSkipVerify: true, ServerName: name})
+		defer c.Close()
+		<-h.opened
+		return c.ConnectionState().PeerCertificates[0].Raw
+	}
+	same := func(a, b []byte) bool { return string(a) == string(b) }
+
+	if !same(peerCert("a.example.com"), certA.Certificate[0]) {
+		t.Fatal("a.example.com got wrong certificate")
+	}
+	if !same(peerCert("x.b.example.com"), certB.Certificate[0]) {
+		t.Fatal("wildcard got wrong certificate")
+	}
+	if !same(peerCert("unknown.example.org"), certA.Certificate[0]) {
+		t.Fatal("default certificate should be the first one")
+	}
+
+	// 证书文件更新后重新加载
+	certA2, certPEM, keyPEM := testCert(t, "a.example.com")
+	_ = ioutil.WriteFile(certFile, certPEM, 0600)
+	_ = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	if changed, err := store.ReloadIfChanged(); err != nil || !changed {
+		t.Fatalf("ReloadIfChanged %v %v", changed, err)
+	}
+	if !same(peerCert("a.example.com"), certA2.Certificate[0]) {
+		t.Fatal("certificate not reloaded")
+	}
+
+	// 加载失败时保留原来的证书
+	_ = ioutil.WriteFile(keyFile, []byte("bad key"), 0600)
+	if err = store.Reload(); err == nil {
+		t.Fatal("Reload with bad key should fail")
+	}
+	if !same(peerCert("a.example.com"), certA2.Certificate[0]) {
+		t.Fatal("certificate lost after failed reload")
+	}
+}
+
+func TestTLSTicketKeyRotation(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	h := newTLSEchoHandler()
+	srv := startTestServer(t, h, &Options{
+		NumLoops:             1,
+		TLSConfig:            &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSTicketKeyRotation: time.Hour,
+	})
+	defer srv.Stop()
+
+	cache := tls.NewLRUClientSessionCache(1)
+	resumed := func() bool {
+		c := tlsDial(t, testAddr(srv), &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+		defer c.Close()
+		<-h.opened
+		// TLS 1.3的ticket在握手之后发送, 读一次数据确保客户端收到
+		tlsEcho(t, c, "x")
+		return c.ConnectionState().DidResume
+	}
+
+	if resumed() {
+		t.Fatal("first conn resumed")
+	}
+	if !resumed() {
+		t.Fatal("second conn not resumed")
+	}
+	// 轮换之后旧密钥仍然可以解密
+	if err := srv.RotateTicketKeys(); err != nil {
+		t.Fatal("RotateTicketKeys: ", err)
+	}
+	if !resumed() {
+		t.Fatal("not resumed after one rotation")
+	}
+	// 加密ticket的密钥被轮换掉之后不能恢复
+	for i := 0; i < tlsTicketKeyCount; i++ {
+		_ = srv.RotateTicketKeys()
+	}
+	if resumed() {
+		t.Fatal("resumed with expired ticket key")
+	}
+}
+
+func TestTLSMaxHandshakes(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	h := newTLSEchoHandler()
+	srv := startTestServer(t, h, &Options{
+		NumLoops:         2,
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSMaxHandshakes: 1,
+	})
+	defer srv.Stop()
+	cfg := &tls.Config{InsecureSkipVerify: true}
+
+	// 没有发送数据的连接不占用握手名额
+	idle, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer idle.Close()
+	tlsEcho(t, tlsDial(t, testAddr(srv), cfg), "a")
+	<-h.opened
+
+	// 只发送了一部分ClientHello的连接占用唯一的名额, 之后的握手排队
+	stall, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	_, _ = stall.Write([]byte{0x16, 0x03, 0x01, 0x01, 0x00})
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", testAddr(srv), cfg)
+		if err == nil {
+			c.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("handshake finished while queued: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 占用名额的连接关闭后排队的连接开始握手
+	stall.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal("queued handshake: ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued handshake did not start")
+	}
+}
+
+// 默认限制同时进行的握手数, 小于0不限制
+func TestTLSMaxHandshakesDefault(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	for _, c := range []struct{ max, want int }{{0, defaultTLSMaxHandshakes}, {-1, -1}, {8, 8}} {
+		srv, err := NewServer("127.0.0.1:0", newTLSEchoHandler(), &Options{
+			TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+			TLSMaxHandshakes: c.max,
+		})
+		if err != nil {
+			t.Fatal("NewServer: ", err)
+		}
+		if srv.handshakes.max != c.want {
+			t.Fatalf("TLSMaxHandshakes %d: limit %d, want %d", c.max, srv.handshakes.max, c.want)
+		}
+		srv.Stop()
+	}
+}
+
+// hkdfExpandLabel TLS 1.3的HKDF-Expand-Label, 只支持SHA-256和不超过32字节的输出
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	var info bytes.Buffer
+	_ = binary.Write(&info, binary.BigEndian, uint16(length))
+	info.WriteByte(byte(len("tls13 " + label)))
+	info.WriteString("tls13 " + label)
+	info.WriteByte(0)
+	info.WriteByte(1)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(info.Bytes())
+	return mac.Sum(nil)[:length]
+}
+
+// 握手完成后crypto/tls在解密时写的记录(回复KeyUpdate)要立即发送, 不等到下一次Write
+func TestTLSKeyUpdate(t *testing.T) {
+	cert, _, _ := testCert(t, "localhost")
+	srv := startTestServer(t, newTLSEchoHandler(), &Options{
+		NumLoops:  1,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer srv.Stop()
+
+	raw, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer raw.Close()
+	_ = raw.SetDeadline(time.Now().Add(5 * time.Second))
+	var keyLog bytes.Buffer
+	c := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13, KeyLogWriter: &keyLog})
+	tlsEcho(t, c, "a")
+	if c.ConnectionState().CipherSuite != tls.TLS_AES_128_GCM_SHA256 {
+		t.Skip("cipher suite is not TLS_AES_128_GCM_SHA256")
+	}
+	var secret []byte
+	for _, line := range strings.Split(keyLog.String(), "\n") {
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "CLIENT_TRAFFIC_SECRET_0" {
+			secret, _ = hex.DecodeString(f[2])
+		}
+	}
+	if secret == nil {
+		t.Fatal("no client traffic secret")
+	}
+
+	// 用客户端的密钥加密一个要求对端更新的KeyUpdate, 之前已经发送了一个记录, 序号是1
+	block, _ := aes.NewCipher(hkdfExpandLabel(secret, "key", 16))
+	aead, _ := cipher.NewGCM(block)
+	nonce := hkdfExpandLabel(secret, "iv", 12)
+	nonce[11] ^= 1
+	inner := []byte{24, 0, 0, 1, 1, 22}
+	header := []byte{23, 3, 3, 0, byte(len(inner) + aead.Overhead())}
+	if _, err = raw.Write(aead.Seal(header, nonce, inner, header)); err != nil {
+		t.Fatal("Write: ", err)
+	}
+
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 5)
+	if _, err = io.ReadFull(raw, got); err != nil {
+		t.Fatal("KeyUpdate reply not sent: ", err)
+	}
+	if got[0] != 23 {
+		t.Fatalf("record type %d", got[0])
+	}
+}
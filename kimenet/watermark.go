@@ -0,0 +1,129 @@
+package kimenet
+
+// WatermarkHandler Handler可以选择实现它, 在写缓冲区超过高水位和回落到低水位时得到通知
+// 例如超过高水位时停止生产数据, 回落到低水位时再继续
+type WatermarkHandler interface {
+	// 写缓冲区的数据超过高水位
+	OnHighWatermark(conn *Connection)
+
+	// 超过高水位之后, 写缓冲区的数据回落到低水位以下
+	OnLowWatermark(conn *Connection)
+}
+
+// SetWriteWatermarks 设置写缓冲区的高低水位(字节), high<=0表示不检查; low<=0或不小于high时取high/2
+// 只能在EventLoop协程中调用
+func (conn *Connection) SetWriteWatermarks(high, low int) {
+	if low <= 0 || low >= high {
+		low = high / 2
+	}
+	conn.highWatermark = high
+	conn.lowWatermark = low
+	if high <= 0 && conn.aboveHigh {
+		conn.aboveHigh = false
+		conn.resumePeer()
+	}
+}
+
+// PauseRead 暂停读取连接的数据, 不再监听读事件, 对端继续发送时会被TCP流控阻塞
+// 只能在EventLoop协程中调用
+func (conn *Connection) PauseRead() (err error) {
+	if conn.State != ESTABLISHED || conn.readPaused {
+		return
+	}
+	conn.readPaused = true
+	if conn.connecting {
+		return
+	}
+	return conn.loop.modEvent(conn.Fd, conn.loop.connEvents(conn))
+}
+
+// ResumeRead 恢复读取连接的数据; 只能在EventLoop协程中调用
+func (conn *Connection) ResumeRead() (err error) {
+	if conn.State != ESTABLISHED || !conn.readPaused {
+		return
+	}
+	conn.readPaused = false
+	if conn.connecting {
+		return
+	}
+	// EPOLL_CTL_MOD会重新检查就绪状态, 暂停期间到达的数据在边缘触发下也会通知
+	return conn.loop.modEvent(conn.Fd, conn.loop.connEvents(conn))
+}
+
+// Pair 把两个连接配对, 例如代理的上下游连接: 一方的写缓冲区超过高水位时暂停读取另一方, 回落到低水位时恢复
+// 两个连接可以在不同的EventLoop上; 只能在conn所属的EventLoop协程中调用, 任一方关闭时解除配对
+func (conn *Connection) Pair(peer *Connection) {
+	conn.peer = peer
+	if peer.loop == conn.loop {
+		peer.peer = conn
+		return
+	}
+	peer.loop.Execute(func() {
+		if peer.State == ESTABLISHED {
+			peer.peer = conn
+		}
+	})
+}
+
+// checkHighWatermark 写入写缓冲区之后检查是否超过高水位
+func (conn *Connection) checkHighWatermark() {
+	if conn.highWatermark <= 0 || conn.aboveHigh || conn.WriteBuff.Len() <= conn.highWatermark {
+		return
+	}
+	conn.aboveHigh = true
+	conn.pausePeer()
+	if wh := conn.watermarkHandler(); wh != nil {
+		wh.OnHighWatermark(conn)
+	}
+}
+
+// checkLowWatermark 有发送进展之后检查是否回落到低水位
+func (el *EventLoop) checkLowWatermark(conn *Connection) {
+	if !conn.aboveHigh || conn.WriteBuff.Len() > conn.lowWatermark {
+		return
+	}
+	conn.aboveHigh = false
+	conn.resumePeer()
+	if wh := conn.watermarkHandler(); wh != nil {
+		wh.OnLowWatermark(conn)
+	}
+}
+
+func (conn *Connection) pausePeer() {
+	if peer := conn.peer; peer != nil {
+		peer.runOnLoop(conn, func() { _ = peer.PauseRead() })
+	}
+}
+
+func (conn *Connection) resumePeer() {
+	if peer := conn.peer; peer != nil {
+		peer.runOnLoop(conn, func() { _ = peer.ResumeRead() })
+	}
+}
+
+// unpair 连接关闭时解除配对, 恢复被它暂停的对端
+func (conn *Connection) unpair() {
+	peer := conn.peer
+	if peer == nil {
+		return
+	}
+	conn.peer = nil
+	paused := conn.aboveHigh
+	peer.runOnLoop(conn, func() {
+		if peer.peer == conn {
+			peer.peer = nil
+		}
+		if paused {
+			_ = peer.ResumeRead()
+		}
+	})
+}
+
+// runOnLoop 在conn所属的EventLoop协程中执行f, from是调用方所在EventLoop上的连接
+func (conn *Connection) runOnLoop(from *Connection, f func()) {
+	if conn.loop == from.loop {
+		f()
+		return
+	}
+	conn.loop.Execute(f)
+}
@@ -0,0 +1,103 @@
+package kimenet
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyHandler 把第一个连接收到的数据转发给第二个连接
+type proxyHandler struct {
+	BaseHandler
+	src, dst *Connection
+	events   chan string
+	seen     []string
+}
+
+func (h *proxyHandler) OnOpen(conn *Connection) {
+	if h.src == nil {
+		h.src = conn
+		return
+	}
+	h.dst = conn
+	h.dst.Pair(h.src)
+	h.notify("paired")
+}
+
+// notify 不能阻塞EventLoop, 高低水位可能来回触发多次, 只记录第一次
+func (h *proxyHandler) notify(ev string) {
+	for _, e := range h.seen {
+		if e == ev {
+			return
+		}
+	}
+	h.seen = append(h.seen, ev)
+	h.events <- ev
+}
+
+func (h *proxyHandler) OnData(conn *Connection) {
+	if conn != h.src || h.dst == nil {
+		return
+	}
+	_, _ = h.dst.Write(conn.ReadBuff.Bytes())
+	conn.ReadBuff.Reset()
+}
+
+func (h *proxyHandler) OnHighWatermark(conn *Connection) {
+	if conn == h.dst && h.src.readPaused {
+		h.notify("high")
+	}
+}
+
+func (h *proxyHandler) OnLowWatermark(conn *Connection) {
+	if conn == h.dst && !h.src.readPaused {
+		h.notify("low")
+	}
+}
+
+func waitEvent(t *testing.T, ch chan string, want string) {
+	select {
+	case got := <-ch:
+		if got != want {
+			t.Fatalf("got event %s, want %s", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("wait event %s timeout", want)
+	}
+}
+
+func TestWriteWatermarks(t *testing.T) {
+	h := &proxyHandler{events: make(chan string, 4)}
+	srv := startTestServer(t, h, &Options{NumLoops: 1, WriteHighWatermark: 256 << 10})
+	defer srv.Stop()
+
+	src, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer src.Close()
+	time.Sleep(20 * time.Millisecond)
+	dst, err := net.Dial("tcp", testAddr(srv))
+	if err != nil {
+		t.Fatal("Dial: ", err)
+	}
+	defer dst.Close()
+	waitEvent(t, h.events, "paired")
+
+	const total = 8 << 20
+	go func() {
+		_, _ = src.Write(make([]byte, total))
+	}()
+
+	// dst不读, 写缓冲区超过高水位后暂停读取src
+	waitEvent(t, h.events, "high")
+
+	_ = dst.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := io.CopyN(ioutil.Discard, dst, total)
+	if err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	waitEvent(t, h.events, "low")
+}